@@ -0,0 +1,358 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Size limit of the download cache when VIB_CACHE_MAX_SIZE is not set
+const DefaultCacheMaxSize = 10 << 30
+
+// Source stored in the download cache
+type CacheEntry struct {
+	Key      string    `json:"-"`
+	Type     string    `json:"type"`
+	URL      string    `json:"url"`
+	Ref      string    `json:"ref"` // Checksum of tar and file sources, commit of git sources
+	Size     int64     `json:"size"`
+	LastUsed time.Time `json:"-"`
+}
+
+// Get the directory of the download cache, $XDG_CACHE_HOME/vib
+func GetCacheDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "vib"), nil
+}
+
+// Get the size limit of the download cache, read from VIB_CACHE_MAX_SIZE
+// in bytes or with a K, M or G suffix
+func GetCacheMaxSize() (int64, error) {
+	value := os.Getenv("VIB_CACHE_MAX_SIZE")
+	if value == "" {
+		return DefaultCacheMaxSize, nil
+	}
+	size, err := ParseSize(value)
+	if err != nil {
+		return 0, fmt.Errorf("VIB_CACHE_MAX_SIZE: %s", err.Error())
+	}
+	return size, nil
+}
+
+// Parse a size in bytes, with an optional K, M or G suffix
+func ParseSize(value string) (int64, error) {
+	units := map[string]int64{"K": 1 << 10, "M": 1 << 20, "G": 1 << 30}
+	number := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(value)), "B")
+	multiplier := int64(1)
+	if unit, ok := units[number[max(len(number)-1, 0):]]; ok {
+		multiplier = unit
+		number = number[:len(number)-1]
+	}
+	size, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return size * multiplier, nil
+}
+
+// Generate the cache key of a source, along with the reference it is
+// pinned to. Tar and file sources are only cached with a checksum and git
+// sources with a commit, declared or locked, as the content of the others
+// may change. An empty key means the source is not cached
+func getSourceCacheKey(recipe *Recipe, source Source, moduleName string) (string, string) {
+	ref := ""
+	switch source.Type {
+	case "tar", "file":
+		ref = strings.TrimSpace(source.Checksum)
+	case "git":
+		if commit := strings.TrimSpace(source.Commit); commit != "" && !strings.EqualFold(commit, "latest") {
+			ref = commit
+		} else if recipe.Lock != nil {
+			if locked, ok := recipe.Lock.Source(source, moduleName); ok {
+				ref = locked.Commit
+			}
+		}
+	}
+	if ref == "" {
+		return "", ""
+	}
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(source.Type+"\n"+source.URL+"\n"+ref))), ref
+}
+
+// Download a source through the cache: the source is copied to dest from
+// the cache if it is there, or downloaded and stored in the cache once
+// validated. A cached source failing the validation is removed from the
+// cache and downloaded again. Failing to store a source only prints a
+// warning
+func downloadCachedSource(recipe *Recipe, source Source, moduleName string, dest string, download func() error, validate func() error) error {
+	key, ref := getSourceCacheKey(recipe, source, moduleName)
+	cached, err := restoreCachedSource(key, dest)
+	if err != nil {
+		return err
+	}
+	if cached {
+		fmt.Printf("Using cached source: %s (%s)\n", source.URL, ref)
+	} else {
+		err = download()
+		if err != nil {
+			return err
+		}
+	}
+
+	err = validate()
+	if err != nil && cached {
+		// the cache entry may have been stored by another vib version
+		// or damaged, the source is downloaded again instead
+		fmt.Printf("WARN: cached source %s is invalid, downloading it: %s\n", source.URL, err.Error())
+		cached = false
+		err = removeCachedSource(key)
+		if err != nil {
+			return err
+		}
+		err = os.RemoveAll(dest)
+		if err != nil {
+			return err
+		}
+		err = download()
+		if err != nil {
+			return err
+		}
+		err = validate()
+	}
+	if err != nil {
+		return err
+	}
+
+	if !cached && key != "" {
+		err = storeCachedSource(key, CacheEntry{Type: source.Type, URL: source.URL, Ref: ref}, dest)
+		if err != nil {
+			fmt.Printf("WARN: could not cache source %s: %s\n", source.URL, err.Error())
+		}
+	}
+	return nil
+}
+
+// Copy the cached content of the key to dest, if the cache has it. A
+// source which cannot be copied is a cache miss
+func restoreCachedSource(key string, dest string) (bool, error) {
+	if key == "" {
+		return false, nil
+	}
+	cacheDir, err := GetCacheDir()
+	if err != nil {
+		return false, nil
+	}
+	entry := filepath.Join(cacheDir, "sources", key)
+	if _, err := os.Stat(filepath.Join(entry, "content")); err != nil {
+		return false, nil
+	}
+
+	err = os.RemoveAll(dest)
+	if err != nil {
+		return false, err
+	}
+	err = os.MkdirAll(filepath.Dir(dest), 0o777)
+	if err != nil {
+		return false, err
+	}
+	err = copyPath(filepath.Join(entry, "content"), dest)
+	if err != nil {
+		// another build may have pruned the entry meanwhile, the source
+		// is downloaded instead
+		fmt.Printf("WARN: could not restore cached source, downloading it: %s\n", err.Error())
+		return false, os.RemoveAll(dest)
+	}
+
+	now := time.Now()
+	os.Chtimes(filepath.Join(entry, "entry.json"), now, now)
+	return true, nil
+}
+
+// Remove the cached content of the key
+func removeCachedSource(key string) error {
+	cacheDir, err := GetCacheDir()
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(filepath.Join(cacheDir, "sources", key))
+}
+
+// Store the content at path in the cache under the key, then prune the
+// cache to its size limit
+func storeCachedSource(key string, entry CacheEntry, path string) error {
+	cacheDir, err := GetCacheDir()
+	if err != nil {
+		return err
+	}
+	sourcesDir := filepath.Join(cacheDir, "sources")
+	err = os.MkdirAll(sourcesDir, 0o755)
+	if err != nil {
+		return err
+	}
+
+	// the entry is written aside and renamed, so concurrent builds
+	// never see a partial entry
+	tmp, err := os.MkdirTemp(sourcesDir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	err = copyPath(path, filepath.Join(tmp, "content"))
+	if err != nil {
+		return err
+	}
+	entry.Size, err = pathSize(filepath.Join(tmp, "content"))
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(filepath.Join(tmp, "entry.json"), data, 0o644)
+	if err != nil {
+		return err
+	}
+
+	// another build may have stored the same source meanwhile
+	if _, err := os.Stat(filepath.Join(sourcesDir, key)); err == nil {
+		return nil
+	}
+	err = os.Rename(tmp, filepath.Join(sourcesDir, key))
+	if err != nil {
+		return err
+	}
+
+	maxSize, err := GetCacheMaxSize()
+	if err != nil {
+		return err
+	}
+	_, err = PruneCache(maxSize, 0)
+	return err
+}
+
+// List the sources in the download cache, the least recently used first
+func ListCache() ([]CacheEntry, error) {
+	cacheDir, err := GetCacheDir()
+	if err != nil {
+		return nil, err
+	}
+	dirs, err := os.ReadDir(filepath.Join(cacheDir, "sources"))
+	if os.IsNotExist(err) {
+		return []CacheEntry{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	entries := []CacheEntry{}
+	for _, dir := range dirs {
+		if !dir.IsDir() || strings.HasPrefix(dir.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(cacheDir, "sources", dir.Name(), "entry.json")
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var entry CacheEntry
+		err = json.Unmarshal(data, &entry)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err.Error())
+		}
+		entry.Key = dir.Name()
+		entry.LastUsed = info.ModTime()
+		entries = append(entries, entry)
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].LastUsed.Before(entries[j].LastUsed)
+	})
+	return entries, nil
+}
+
+// Remove the sources of the download cache unused for longer than
+// olderThan, if not zero, then the least recently used ones until the
+// cache fits in maxSize, if not zero. Returns the removed sources
+func PruneCache(maxSize int64, olderThan time.Duration) ([]CacheEntry, error) {
+	entries, err := ListCache()
+	if err != nil {
+		return nil, err
+	}
+	cacheDir, err := GetCacheDir()
+	if err != nil {
+		return nil, err
+	}
+
+	total := int64(0)
+	for _, entry := range entries {
+		total += entry.Size
+	}
+
+	removed := []CacheEntry{}
+	for _, entry := range entries {
+		expired := olderThan > 0 && time.Since(entry.LastUsed) > olderThan
+		if !expired && (maxSize == 0 || total <= maxSize) {
+			continue
+		}
+		err = os.RemoveAll(filepath.Join(cacheDir, "sources", entry.Key))
+		if err != nil {
+			return removed, err
+		}
+		total -= entry.Size
+		removed = append(removed, entry)
+	}
+	return removed, nil
+}
+
+// Remove every source of the download cache
+func ClearCache() error {
+	cacheDir, err := GetCacheDir()
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(filepath.Join(cacheDir, "sources"))
+}
+
+// Copy a file or a directory, keeping its modes and symlinks
+func copyPath(src string, dest string) error {
+	out, err := exec.Command("cp", "-a", src, dest).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("cp: %s", strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// Compute the size of the files in path
+func pathSize(path string) (int64, error) {
+	size := int64(0)
+	err := filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
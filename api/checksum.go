@@ -0,0 +1,180 @@
+package api
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// Hash functions of the checksum prefixes, a checksum without prefix is
+// a sha256 hash
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+	"blake2b": func() hash.Hash {
+		h, _ := blake2b.New512(nil)
+		return h
+	},
+}
+
+var fullCommitPattern = regexp.MustCompile(`^([0-9a-f]{40}|[0-9a-f]{64})$`)
+
+// git abbreviates commit hashes to 4 characters at least
+var shortCommitPattern = regexp.MustCompile(`^[0-9a-f]{4,63}$`)
+
+// Split a checksum in its algorithm and hex digest, checking that the
+// digest has the length of the algorithm
+func ParseChecksum(checksum string) (string, string, error) {
+	algorithm, digest, found := strings.Cut(strings.TrimSpace(checksum), ":")
+	if !found {
+		algorithm, digest = "sha256", algorithm
+	}
+	algorithm = strings.ToLower(algorithm)
+	digest = strings.ToLower(digest)
+
+	newHash, ok := checksumAlgorithms[algorithm]
+	if !ok {
+		return "", "", fmt.Errorf("unsupported checksum algorithm %s, expected sha256, sha512 or blake2b", algorithm)
+	}
+	if _, err := hex.DecodeString(digest); err != nil || len(digest) != newHash().Size()*2 {
+		return "", "", fmt.Errorf("invalid %s checksum %s", algorithm, digest)
+	}
+	return algorithm, digest, nil
+}
+
+// Hash a file with the algorithm
+func hashFile(algorithm string, path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := checksumAlgorithms[algorithm]()
+	_, err = io.Copy(h, file)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Hash a file, or a directory tree with the algorithm. The tree hash
+// covers, in lexical order, the relative path of every directory, the
+// relative path, executable bit and content hash of every file and the
+// relative path and target of every symlink, so renaming, adding or
+// removing a file changes it as well
+func HashTree(algorithm string, path string) (string, error) {
+	if _, ok := checksumAlgorithms[algorithm]; !ok {
+		return "", fmt.Errorf("unsupported checksum algorithm %s", algorithm)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return hashFile(algorithm, path)
+	}
+
+	tree := checksumAlgorithms[algorithm]()
+	err = filepath.WalkDir(path, func(current string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(path, current)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		switch {
+		case d.IsDir():
+			fmt.Fprintf(tree, "dir %s\n", rel)
+		case d.Type()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(current)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(tree, "link %s %s\n", rel, target)
+		case d.Type().IsRegular():
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			mode := "-"
+			if info.Mode()&0o111 != 0 {
+				mode = "x"
+			}
+			digest, err := hashFile(algorithm, current)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(tree, "file %s %s %s\n", rel, mode, digest)
+		default:
+			return fmt.Errorf("unsupported file type %s", rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(tree.Sum(nil)), nil
+}
+
+// Validate the checksum of a downloaded file, or the tree hash of a local
+// source, when the source declares one
+func checksumValidation(source Source, path string) error {
+	if len(strings.TrimSpace(source.Checksum)) == 0 {
+		return nil
+	}
+
+	algorithm, expected, err := ParseChecksum(source.Checksum)
+	if err != nil {
+		return fmt.Errorf("%s source %s: %s", source.Type, source.URL, err.Error())
+	}
+	calculated, err := HashTree(algorithm, path)
+	if err != nil {
+		return fmt.Errorf("could not calculate checksum: %v", err)
+	}
+	if calculated != expected {
+		return fmt.Errorf("%s source module checksum doesn't match: expected %s:%s, got %s:%s", source.Type, algorithm, expected, algorithm, calculated)
+	}
+
+	return nil
+}
+
+// Check that the checked out HEAD of a git source is the commit it
+// declares, if any. An abbreviated hash must be a prefix of HEAD, and a
+// tag only pins a commit along with its full hash, as tags can be moved
+// by force-pushing them
+func verifyGitCommit(source Source, path string) error {
+	commit := strings.ToLower(strings.TrimSpace(source.Commit))
+	if commit == "" || commit == "latest" {
+		return nil
+	}
+	full := fullCommitPattern.MatchString(commit)
+	if !full && source.Tag != "" {
+		return fmt.Errorf("git source %s: the commit of tag %s must be a full commit hash, got %s", source.URL, source.Tag, source.Commit)
+	}
+	if !full && !shortCommitPattern.MatchString(commit) {
+		return fmt.Errorf("git source %s: commit %s is not a commit hash", source.URL, source.Commit)
+	}
+
+	head, err := GitHeadCommit(path)
+	if err != nil {
+		return fmt.Errorf("could not get the commit of %s: %s", source.URL, err.Error())
+	}
+	if !strings.HasPrefix(head, commit) {
+		return fmt.Errorf("git source %s (%s) checked out commit %s, expected %s", source.URL, GitRef(source), head, commit)
+	}
+	return nil
+}
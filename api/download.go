@@ -2,6 +2,7 @@ package api
 
 import (
 	"crypto/sha256"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
@@ -42,31 +43,89 @@ func GetSourcePath(source Source, moduleName string) string {
 	return ""
 }
 
+// Generate the path of the stamp recording that the source of the module was
+// fetched ahead of the build, in the download path
+func GetSourceStampPath(downloadPath string, source Source, moduleName string) string {
+	key, _ := json.Marshal(source)
+	sum := sha256.Sum256(append([]byte(moduleName+"\n"), key...))
+	return filepath.Join(downloadPath, ".stamps", fmt.Sprintf("%x", sum)[:16])
+}
+
+// Check whether the source of the module was already downloaded and moved
+// to the sources path
+func IsSourceFetched(downloadPath string, source Source, moduleName string) bool {
+	_, err := os.Stat(GetSourceStampPath(downloadPath, source, moduleName))
+	return err == nil
+}
+
+// Check that the source of the module was fetched ahead of the build, as
+// the modules only read their sources from the sources path
+func CheckSourceFetched(recipe *Recipe, source Source, moduleName string) error {
+	if !IsSourceFetched(recipe.DownloadsPath, source, moduleName) {
+		return fmt.Errorf("source %s of module %s was not fetched", source.URL, moduleName)
+	}
+	return nil
+}
+
+// Record that the source of the module was downloaded and moved to the
+// sources path, so the modules building it do not fetch it again
+func MarkSourceFetched(downloadPath string, source Source, moduleName string) error {
+	stamp := GetSourceStampPath(downloadPath, source, moduleName)
+	err := os.MkdirAll(filepath.Dir(stamp), 0o755)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(stamp, []byte(source.URL+"\n"), 0o644)
+}
+
 // Download the source based on its type and validate its checksum
 func DownloadSource(recipe *Recipe, source Source, moduleName string) error {
+	if IsSourceFetched(recipe.DownloadsPath, source, moduleName) {
+		fmt.Printf("Source already fetched: %s\n", source.URL)
+		return nil
+	}
 	fmt.Printf("Downloading source: %s\n", source.URL)
 
+	// tar, file and git sources pinned to a checksum or a commit go
+	// through the download cache
 	switch source.Type {
 	case "git":
-		return DownloadGitSource(recipe.DownloadsPath, source, moduleName)
+		destinationPath := filepath.Join(recipe.DownloadsPath, GetSourcePath(source, moduleName))
+		return downloadCachedSource(recipe, source, moduleName, destinationPath,
+			func() error {
+				err := DownloadGitSource(recipe.DownloadsPath, source, moduleName)
+				if err != nil {
+					return err
+				}
+				return checkoutLockedCommit(recipe, source, moduleName)
+			},
+			func() error {
+				err := verifyGitCommit(source, destinationPath)
+				if err != nil {
+					return err
+				}
+				return verifyLockedCommit(recipe, source, moduleName)
+			},
+		)
 	case "tar":
-		err := DownloadTarSource(recipe.DownloadsPath, source, moduleName)
-		if err != nil {
-			return err
-		}
-		return checksumValidation(source, filepath.Join(recipe.DownloadsPath, GetSourcePath(source, moduleName), moduleName+".tar"))
+		destinationPath := filepath.Join(recipe.DownloadsPath, GetSourcePath(source, moduleName), moduleName+".tar")
+		return downloadCachedSource(recipe, source, moduleName, destinationPath,
+			func() error { return DownloadTarSource(recipe.DownloadsPath, source, moduleName) },
+			func() error { return checksumValidation(source, destinationPath) },
+		)
 	case "file":
-		err := DownloadFileSource(recipe.DownloadsPath, source, moduleName)
-		if err != nil {
-			return err
-		}
-
 		extension := filepath.Ext(source.URL)
 		filename := fmt.Sprintf("%s%s", moduleName, extension)
 		destinationPath := filepath.Join(recipe.DownloadsPath, GetSourcePath(source, moduleName), filename)
-
-		return checksumValidation(source, destinationPath)
+		return downloadCachedSource(recipe, source, moduleName, destinationPath,
+			func() error { return DownloadFileSource(recipe.DownloadsPath, source, moduleName) },
+			func() error { return checksumValidation(source, destinationPath) },
+		)
 	case "local":
+		err := checksumValidation(source, source.URL)
+		if err != nil {
+			return err
+		}
 		return DownloadLocalSource(recipe.SourcesPath, source, moduleName)
 	default:
 		return fmt.Errorf("unsupported source type %s", source.Type)
@@ -238,6 +297,9 @@ func MoveSources(downloadPath string, sourcesPath string, sources []Source, modu
 // tarballs: extract
 // git repositories: move
 func MoveSource(downloadPath string, sourcesPath string, source Source, moduleName string) error {
+	if IsSourceFetched(downloadPath, source, moduleName) {
+		return nil
+	}
 	fmt.Printf("Moving source: %s\n", moduleName)
 
 	err := os.MkdirAll(filepath.Join(sourcesPath, moduleName), 0777)
@@ -272,38 +334,6 @@ func MoveSource(downloadPath string, sourcesPath string, source Source, moduleNa
 	}
 }
 
-// Validate the checksum of the downloaded file
-func checksumValidation(source Source, path string) error {
-	// No checksum provided
-	if len(strings.TrimSpace(source.Checksum)) == 0 {
-		return nil
-	}
-
-	// Open the file
-	file, err := os.Open(path)
-	if err != nil {
-		return fmt.Errorf("could not open file: %v", err)
-	}
-
-	// Close the file when the function ends
-	defer file.Close()
-
-	// Calculate the checksum
-	checksum := sha256.New()
-	_, err = io.Copy(checksum, file)
-	if err != nil {
-		return fmt.Errorf("could not calculate checksum: %v", err)
-	}
-
-	// Validate the checksum based on source type
-	calculatedChecksum := fmt.Sprintf("%x", checksum.Sum(nil))
-	if (source.Type == "tar" || source.Type == "file") && calculatedChecksum != source.Checksum {
-		return fmt.Errorf("%s source module checksum doesn't match: expected %s, got %s", source.Type, source.Checksum, calculatedChecksum)
-	}
-
-	return nil
-}
-
 // Download a file source from a URL and save it to the specified download path.
 // Create necessary directories and handle file naming based on the URL extension.
 func DownloadFileSource(downloadPath string, source Source, moduleName string) error {
@@ -0,0 +1,129 @@
+package api
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Resolved state of the remote files and git sources of a recipe, as
+// recorded in the vib.lock file next to the recipe
+type Lock struct {
+	Includes []LockedInclude `json:"includes" yaml:"includes"`
+	Sources  []LockedSource  `json:"sources" yaml:"sources"`
+}
+
+// Content hash of a remote include or base recipe
+type LockedInclude struct {
+	URL    string `json:"url" yaml:"url"`
+	Sha256 string `json:"sha256" yaml:"sha256"`
+}
+
+// Commit a git source of a module resolved to
+type LockedSource struct {
+	Module string `json:"module" yaml:"module"`
+	URL    string `json:"url" yaml:"url"`
+	Ref    string `json:"ref" yaml:"ref"`
+	Commit string `json:"commit" yaml:"commit"`
+}
+
+// Find the locked hash of a remote include
+func (l *Lock) Include(url string) (LockedInclude, bool) {
+	for _, include := range l.Includes {
+		if include.URL == url {
+			return include, true
+		}
+	}
+	return LockedInclude{}, false
+}
+
+// Find the locked commit of a git source of the given module
+func (l *Lock) Source(source Source, moduleName string) (LockedSource, bool) {
+	ref := GitRef(source)
+	for _, locked := range l.Sources {
+		if locked.Module == moduleName && locked.URL == source.URL && locked.Ref == ref {
+			return locked, true
+		}
+	}
+	return LockedSource{}, false
+}
+
+// Describe the reference a git source is declared with, used to tell
+// apart sources of the same module pointing to the same repository
+func GitRef(source Source) string {
+	if source.Tag != "" {
+		return "tag " + source.Tag
+	}
+	if len(strings.TrimSpace(source.Commit)) > 0 && !strings.EqualFold(source.Commit, "latest") {
+		return "commit " + source.Commit
+	}
+	return "branch " + source.Branch
+}
+
+// Retrieve the commit checked out in a Git repository
+func GitHeadCommit(dest string) (string, error) {
+	cmd := exec.Command("git", "rev-parse", "HEAD")
+	cmd.Dir = dest
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// Check that a downloaded git source matches the commit recorded in the
+// recipe lock, if the recipe has one
+func verifyLockedCommit(recipe *Recipe, source Source, moduleName string) error {
+	if recipe.Lock == nil {
+		return nil
+	}
+
+	locked, ok := recipe.Lock.Source(source, moduleName)
+	if !ok {
+		return fmt.Errorf("git source %s (%s) of module %s is not in the lock file, run vib lock --update", source.URL, GitRef(source), moduleName)
+	}
+
+	commit, err := GitHeadCommit(filepath.Join(recipe.DownloadsPath, GetSourcePath(source, moduleName)))
+	if err != nil {
+		return fmt.Errorf("could not get the commit of %s: %s", source.URL, err.Error())
+	}
+	if !strings.HasPrefix(commit, locked.Commit) {
+		return fmt.Errorf("git source %s (%s) of module %s drifted from the lock file: expected commit %s, got %s, run vib lock --update to accept it", source.URL, GitRef(source), moduleName, locked.Commit, commit)
+	}
+
+	return nil
+}
+
+// Check out the commit recorded in the recipe lock for a downloaded git
+// source, so a locked build keeps working once the branch or the tag has
+// moved. The commit is fetched when the clone does not have it, as with
+// shallow tag clones
+func checkoutLockedCommit(recipe *Recipe, source Source, moduleName string) error {
+	if recipe.Lock == nil {
+		return nil
+	}
+	locked, ok := recipe.Lock.Source(source, moduleName)
+	if !ok {
+		return nil
+	}
+
+	dest := filepath.Join(recipe.DownloadsPath, GetSourcePath(source, moduleName))
+	commit, err := GitHeadCommit(dest)
+	if err == nil && strings.HasPrefix(commit, locked.Commit) {
+		return nil
+	}
+
+	cmd := exec.Command("git", "cat-file", "-e", locked.Commit+"^{commit}")
+	cmd.Dir = dest
+	if cmd.Run() != nil {
+		cmd = exec.Command("git", "fetch", "-q", "origin", locked.Commit)
+		cmd.Dir = dest
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("could not fetch the locked commit %s of git source %s (%s) of module %s: %s", locked.Commit, source.URL, GitRef(source), moduleName, strings.TrimSpace(string(out)))
+		}
+	}
+	fmt.Printf("Checking out locked commit: %s\n", locked.Commit)
+	return gitCheckout(locked.Commit, dest)
+}
@@ -27,14 +27,38 @@ type Recipe struct {
 	PluginPath    string
 	Containerfile string
 	Finalize      []interface{}
+	Vars          map[string]string
+	Secrets       map[string]Secret
+	Lock          *Lock `yaml:"-"`
+	// Timestamp the build is pinned to, empty unless the build is
+	// reproducible
+	SourceDateEpoch string `yaml:"-"`
+	// Id of the stage to build, with the stages it depends on, empty to
+	// build all the stages
+	Target string `yaml:"-"`
+	// Secrets declared by the modules, filled in while generating the
+	// Containerfile
+	ModuleSecrets map[string]Secret `yaml:"-"`
+	// What vib tracks about the recipe while loading and building it,
+	// such as the location of its modules. Not passed to plugins
+	BuildState interface{} `yaml:"-" json:"-"`
+}
+
+// Configuration for a build secret, read from a local file or from an
+// environment variable of the host
+type Secret struct {
+	File string `json:"file"`
+	Env  string `json:"env"`
 }
 
 // Configuration for a stage in the recipe
 type Stage struct {
 	Id          string            `json:"id"`
 	Base        string            `json:"base"`
+	If          string            `json:"if"`
 	Copy        []Copy            `json:"copy"`
 	Addincludes bool              `json:"addincludes"`
+	SingleLayer bool              `json:"singlelayer"`
 	Labels      map[string]string `json:"labels"`
 	Env         map[string]string `json:"env"`
 	Adds        []Add             `json:"adds"`
@@ -45,6 +69,13 @@ type Stage struct {
 	Modules     []interface{}     `json:"modules"`
 	Entrypoint  Entrypoint
 	Cleanup     []string          `json:"cleanup"`
+	Cache       []Cache           `json:"cache"`
+	Workdir     string            `json:"workdir"`
+	User        string            `json:"user"`
+	Volumes     []string          `json:"volumes"`
+	Healthcheck Healthcheck       `json:"healthcheck"`
+	Shell       []string          `json:"shell"`
+	StopSignal  string            `json:"stopsignal"`
 }
 
 type PluginType int
@@ -59,6 +90,15 @@ type PluginInfo struct {
 	Name             string
 	Type             PluginType
 	UseContainerCmds bool
+	Cache            []Cache `json:"cache"`
+}
+
+// Configuration for a cache mounted while running the commands of a
+// module, kept between builds but left out of the image
+type Cache struct {
+	Target  string `json:"target"`
+	Id      string `json:"id"`
+	Sharing string `json:"sharing"`
 }
 
 // Configuration for copying files or directories in a stage
@@ -86,6 +126,17 @@ type Cmd struct {
 	Workdir string
 }
 
+// Configuration for the health check of the container, Test is the
+// command checking the health in the exec form
+type Healthcheck struct {
+	Test        []string `json:"test"`
+	Interval    string   `json:"interval"`
+	Timeout     string   `json:"timeout"`
+	StartPeriod string   `json:"startperiod"`
+	Retries     int      `json:"retries"`
+	Disable     bool     `json:"disable"`
+}
+
 // Configuration for commands to run in the container
 type Run struct {
 	Commands []string
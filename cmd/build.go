@@ -24,12 +24,25 @@ func NewBuildCommand() *cobra.Command {
     vib build
 
   To specify a recipe file, use:
-    vib build /path/to/recipe.yml`,
+    vib build /path/to/recipe.yml
+
+  To override a recipe variable, use:
+    vib build --set version=1.2.0 /path/to/recipe.yml
+
+  To generate a Containerfile for a reproducible build, use:
+    vib build --reproducible /path/to/recipe.yml
+
+  To generate only the stages needed by the build stage, use:
+    vib build --target build /path/to/recipe.yml`,
 		RunE: buildCommand,
 	}
 
 	cmd.Flags().StringP("output", "o", "Containerfile", "Output path for the generated Containerfile, relative to the recipe file")
 	cmd.Flags().StringP("arch", "a", runtime.GOARCH, "target architecture")
+	cmd.Flags().StringArray("set", []string{}, "Override a recipe variable, in the key=value form (can be repeated)")
+	cmd.Flags().Bool("reproducible", false, "Pin the build to SOURCE_DATE_EPOCH and normalize the timestamps of the sources")
+	cmd.Flags().String("target", "", "Build only the given stage and the stages it depends on")
+	cmd.Flags().Int("jobs", core.BuildOptions{}.PrefetchJobs(), "Number of sources fetched at the same time")
 	cmd.Flags().SetInterspersed(false)
 
 	return cmd
@@ -49,6 +62,16 @@ func buildCommand(cmd *cobra.Command, args []string) error {
 
 	arch, _ = cmd.Flags().GetString("arch")
 	containerfilePath, _ = cmd.Flags().GetString("output")
+	reproducible, _ := cmd.Flags().GetBool("reproducible")
+	target, _ := cmd.Flags().GetString("target")
+	jobs, _ := cmd.Flags().GetInt("jobs")
+	if jobs < 0 {
+		return fmt.Errorf("invalid number of jobs %d, expected 0 or more", jobs)
+	}
+	vars, err := getVarOverrides(cmd)
+	if err != nil {
+		return err
+	}
 
 	if len(args) == 0 {
 		for _, name := range commonNames {
@@ -90,10 +113,32 @@ func buildCommand(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("missing recipe path")
 	}
 
-	_, err := core.BuildRecipe(recipePath, arch, containerfilePath)
+	_, err = core.BuildRecipe(recipePath, arch, core.BuildOptions{
+		Containerfile: containerfilePath,
+		Vars:          vars,
+		Reproducible:  reproducible,
+		Target:        target,
+		Jobs:          jobs,
+	})
 	if err != nil {
 		return err
 	}
 
 	return nil
 }
+
+// Collect the recipe variables overridden through the --set flag
+//
+// Returns: map of variable names to their values
+func getVarOverrides(cmd *cobra.Command) (map[string]string, error) {
+	values, _ := cmd.Flags().GetStringArray("set")
+	vars := map[string]string{}
+	for _, value := range values {
+		name, varValue, found := strings.Cut(value, "=")
+		if !found || len(strings.TrimSpace(name)) == 0 {
+			return nil, fmt.Errorf("invalid variable override %s, expected key=value", value)
+		}
+		vars[name] = varValue
+	}
+	return vars, nil
+}
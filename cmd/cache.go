@@ -0,0 +1,119 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/vanilla-os/vib/api"
+)
+
+// Create and return a new cache command for the Cobra CLI, with the ls,
+// prune and clear subcommands
+func NewCacheCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "cache",
+		Short: "Manage the download cache",
+		Long:  "List, prune or clear the sources kept in the download cache, under $XDG_CACHE_HOME/vib",
+		Example: `  vib cache ls
+  vib cache prune --max-size 2G
+  vib cache prune --older-than 720h
+  vib cache clear`,
+	}
+
+	lsCmd := &cobra.Command{
+		Use:   "ls",
+		Short: "List the cached sources",
+		Args:  cobra.NoArgs,
+		RunE:  cacheLsCommand,
+	}
+
+	pruneCmd := &cobra.Command{
+		Use:   "prune",
+		Short: "Remove the least recently used sources",
+		Long:  "Remove the sources unused for longer than --older-than, then the least recently used ones until the cache fits in --max-size, which defaults to VIB_CACHE_MAX_SIZE",
+		Args:  cobra.NoArgs,
+		RunE:  cachePruneCommand,
+	}
+	pruneCmd.Flags().String("max-size", "", "Size limit of the cache, in bytes or with a K, M or G suffix")
+	pruneCmd.Flags().Duration("older-than", 0, "Remove the sources unused for longer than this duration, e.g. 720h")
+
+	clearCmd := &cobra.Command{
+		Use:   "clear",
+		Short: "Remove every cached source",
+		Args:  cobra.NoArgs,
+		RunE:  cacheClearCommand,
+	}
+
+	cmd.AddCommand(lsCmd, pruneCmd, clearCmd)
+	return cmd
+}
+
+// List the cached sources with their size and last use
+func cacheLsCommand(cmd *cobra.Command, args []string) error {
+	entries, err := api.ListCache()
+	if err != nil {
+		return err
+	}
+
+	total := int64(0)
+	for _, entry := range entries {
+		fmt.Printf("%s  %-4s %s @ %s  %s, used %s\n", entry.Key[:12], entry.Type, entry.URL, entry.Ref, formatSize(entry.Size), entry.LastUsed.Format(time.DateTime))
+		total += entry.Size
+	}
+	fmt.Printf("%d sources, %s\n", len(entries), formatSize(total))
+	return nil
+}
+
+// Prune the cache to the given size and age
+func cachePruneCommand(cmd *cobra.Command, args []string) error {
+	maxSize, err := api.GetCacheMaxSize()
+	if err != nil {
+		return err
+	}
+	if value, _ := cmd.Flags().GetString("max-size"); value != "" {
+		maxSize, err = api.ParseSize(value)
+		if err != nil {
+			return err
+		}
+	}
+	olderThan, _ := cmd.Flags().GetDuration("older-than")
+
+	removed, err := api.PruneCache(maxSize, olderThan)
+	for _, entry := range removed {
+		fmt.Printf("Removed %s @ %s\n", entry.URL, entry.Ref)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Removed %d sources\n", len(removed))
+	return nil
+}
+
+// Remove every cached source
+func cacheClearCommand(cmd *cobra.Command, args []string) error {
+	err := api.ClearCache()
+	if err != nil {
+		return err
+	}
+	fmt.Println("Download cache cleared")
+	return nil
+}
+
+// Format a size in bytes with a K, M or G suffix
+func formatSize(size int64) string {
+	units := []string{"K", "M", "G"}
+	if size < 1<<10 {
+		return fmt.Sprintf("%dB", size)
+	}
+	value := float64(size)
+	unit := ""
+	for _, u := range units {
+		if value < 1<<10 {
+			break
+		}
+		value /= 1 << 10
+		unit = u
+	}
+	return fmt.Sprintf("%.1f%s", value, unit)
+}
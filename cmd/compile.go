@@ -19,12 +19,20 @@ func NewCompileCommand() *cobra.Command {
 		Example: `  vib compile // using the recipe in the current directory and the system's default runtime
   vib compile --runtime podman // using the recipe in the current directory and Podman as the runtime
   vib compile /path/to/recipe.yml --runtime podman // using the recipe at the specified path and Podman as the runtime
+  vib compile --set version=1.2.0 // overriding the version variable of the recipe
+  vib compile --target build // building only the build stage and the stages it depends on
+  vib compile --runtime podman --platform linux/amd64,linux/arm64 // building a manifest list for amd64 and arm64
   Both docker and podman are supported as runtimes. If none is specified, the detected runtime will be used, giving priority to Docker.`,
 		RunE: compileCommand,
 	}
 
 	cmd.Flags().StringP("output", "o", "Containerfile", "Output path for the generated Containerfile, relative to the recipe file")
 	cmd.Flags().StringP("runtime", "r", "", "The runtime to use (docker/podman)")
+	cmd.Flags().StringArray("set", []string{}, "Override a recipe variable, in the key=value form (can be repeated)")
+	cmd.Flags().Bool("reproducible", false, "Pin the build to SOURCE_DATE_EPOCH and normalize the timestamps of the sources")
+	cmd.Flags().String("target", "", "Build only the given stage and the stages it depends on")
+	cmd.Flags().StringSlice("platform", []string{}, "Compile for the given platforms, in the os/arch form (comma separated), assembling a manifest list with podman")
+	cmd.Flags().Int("jobs", core.BuildOptions{}.PrefetchJobs(), "Number of sources fetched at the same time")
 	cmd.Flags().SetInterspersed(false)
 
 	return cmd
@@ -46,6 +54,17 @@ func compileCommand(cmd *cobra.Command, args []string) error {
 	arch = runtime.GOARCH
 	containerRuntime, _ = cmd.Flags().GetString("runtime")
 	containerfilePath, _ = cmd.Flags().GetString("output")
+	reproducible, _ := cmd.Flags().GetBool("reproducible")
+	target, _ := cmd.Flags().GetString("target")
+	platforms, _ := cmd.Flags().GetStringSlice("platform")
+	jobs, _ := cmd.Flags().GetInt("jobs")
+	if jobs < 0 {
+		return fmt.Errorf("invalid number of jobs %d, expected 0 or more", jobs)
+	}
+	vars, err := getVarOverrides(cmd)
+	if err != nil {
+		return err
+	}
 
 	if len(args) == 0 {
 		for _, name := range commonNames {
@@ -69,7 +88,18 @@ func compileCommand(cmd *cobra.Command, args []string) error {
 		containerRuntime = detectedRuntime
 	}
 
-	err := core.CompileRecipe(recipePath, arch, containerRuntime, IsRoot, OrigGID, OrigUID, containerfilePath)
+	options := core.BuildOptions{
+		Containerfile: containerfilePath,
+		Vars:          vars,
+		Reproducible:  reproducible,
+		Target:        target,
+		Jobs:          jobs,
+	}
+	if len(platforms) > 0 {
+		return core.CompileRecipePlatforms(recipePath, platforms, containerRuntime, IsRoot, OrigGID, OrigUID, options)
+	}
+
+	err = core.CompileRecipe(recipePath, arch, containerRuntime, IsRoot, OrigGID, OrigUID, options)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,44 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/vanilla-os/vib/core"
+)
+
+// Create and return a new flatten command for the Cobra CLI
+func NewFlattenCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "flatten",
+		Short: "Print the fully merged recipe",
+		Long:  "Print the given Vib recipe with the recipes it extends merged into it and its variables resolved",
+		Example: `  vib flatten recipe.yml
+  vib flatten --set edition=server recipe.yml > server.yml`,
+		RunE: flattenCommand,
+	}
+	cmd.Flags().StringArray("set", []string{}, "Override a recipe variable, in the key=value form (can be repeated)")
+	cmd.Flags().SetInterspersed(false)
+
+	return cmd
+}
+
+// Print the merged recipe to the standard output
+func flattenCommand(cmd *cobra.Command, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("no recipe path specified")
+	}
+
+	vars, err := getVarOverrides(cmd)
+	if err != nil {
+		return err
+	}
+
+	flattened, err := core.FlattenRecipe(args[0], vars)
+	if err != nil {
+		return err
+	}
+
+	fmt.Print(string(flattened))
+	return nil
+}
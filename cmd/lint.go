@@ -0,0 +1,114 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/vanilla-os/vib/core"
+)
+
+// Create and return a new lint command for the Cobra CLI
+func NewLintCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "lint",
+		Short: "Check the given recipe for common mistakes",
+		Long:  "Run opinionated checks on the given Vib recipe and the local modules it includes, beyond the schema validation done by vib test",
+		Example: `  vib lint recipe.yml
+  vib lint --format json recipe.yml
+  vib lint --list-rules`,
+		RunE: lintCommand,
+	}
+	cmd.Flags().String("format", "text", "Output format: text, json or github")
+	cmd.Flags().String("config", "", "Path to the lint configuration, defaults to "+core.LintConfigFileName+" next to the recipe")
+	cmd.Flags().Bool("list-rules", false, "List the lint rules and their default severity")
+	cmd.Flags().StringArray("set", []string{}, "Override a recipe variable, in the key=value form (can be repeated)")
+	cmd.Flags().SetInterspersed(false)
+
+	return cmd
+}
+
+// Lint the provided recipe and print the issues found
+func lintCommand(cmd *cobra.Command, args []string) error {
+	listRules, _ := cmd.Flags().GetBool("list-rules")
+	if listRules {
+		for _, rule := range core.LintRules {
+			fmt.Printf("%-24s %-8s %s\n", rule.Id, rule.Severity, rule.Description)
+		}
+		return nil
+	}
+
+	if len(args) == 0 {
+		return fmt.Errorf("no recipe path specified")
+	}
+
+	vars, err := getVarOverrides(cmd)
+	if err != nil {
+		return err
+	}
+
+	recipePath := args[0]
+	configPath, _ := cmd.Flags().GetString("config")
+	if configPath == "" {
+		configPath = filepath.Join(filepath.Dir(recipePath), core.LintConfigFileName)
+	}
+	config, err := core.LoadLintConfig(configPath)
+	if err != nil {
+		return err
+	}
+
+	issues, err := core.LintRecipe(recipePath, vars, config)
+	if err != nil {
+		return err
+	}
+
+	format, _ := cmd.Flags().GetString("format")
+	switch format {
+	case "text":
+		for _, issue := range issues {
+			fmt.Println(issue)
+		}
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if issues == nil {
+			issues = []core.LintIssue{}
+		}
+		err = encoder.Encode(issues)
+		if err != nil {
+			return err
+		}
+	case "github":
+		// workflow commands, shown as annotations by GitHub Actions
+		for _, issue := range issues {
+			level := "notice"
+			switch issue.Severity {
+			case core.LintError:
+				level = "error"
+			case core.LintWarning:
+				level = "warning"
+			}
+			file := filepath.Join(filepath.Dir(recipePath), issue.File)
+			if strings.Contains(issue.File, "://") || filepath.IsAbs(issue.File) {
+				file = issue.File
+			}
+			fmt.Printf("::%s file=%s,line=%d,col=%d,title=%s::%s\n", level, file, issue.Line, issue.Column, issue.Rule, issue.Message)
+		}
+	default:
+		return fmt.Errorf("unknown output format %s, expected text, json or github", format)
+	}
+
+	errors := 0
+	for _, issue := range issues {
+		if issue.Severity == core.LintError {
+			errors++
+		}
+	}
+	if errors > 0 {
+		return fmt.Errorf("%d lint errors found", errors)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/vanilla-os/vib/core"
+)
+
+// Create and return a new lock command for the Cobra CLI
+func NewLockCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "lock",
+		Short: "Create or check the lock file of the given recipe",
+		Long:  "Record the content hash of the remote includes and the resolved commit of the git sources of the given Vib recipe in vib.lock, or check that the existing lock file is up to date",
+		Example: `  vib lock recipe.yml
+  vib lock --update recipe.yml`,
+		RunE: lockCommand,
+	}
+	cmd.Flags().Bool("update", false, "Rewrite the lock file with the current state of the remote includes and git sources")
+	cmd.Flags().StringArray("set", []string{}, "Override a recipe variable, in the key=value form (can be repeated)")
+	cmd.Flags().SetInterspersed(false)
+
+	return cmd
+}
+
+// Write the lock file if missing or requested, otherwise compare it
+// with the current state and report what drifted
+func lockCommand(cmd *cobra.Command, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("no recipe path specified")
+	}
+
+	vars, err := getVarOverrides(cmd)
+	if err != nil {
+		return err
+	}
+	update, _ := cmd.Flags().GetBool("update")
+
+	recipePath := args[0]
+	lockPath := filepath.Join(filepath.Dir(recipePath), core.LockFileName)
+
+	current, err := core.LoadLock(lockPath)
+	if err != nil {
+		return err
+	}
+	resolved, err := core.ResolveLock(recipePath, vars)
+	if err != nil {
+		return err
+	}
+
+	if current != nil && !update {
+		changes := core.DiffLock(current, resolved)
+		if len(changes) > 0 {
+			return fmt.Errorf("%s is out of date, run vib lock --update to accept the changes:\n  %s", lockPath, strings.Join(changes, "\n  "))
+		}
+		fmt.Printf("%s is up to date\n", lockPath)
+		return nil
+	}
+
+	err = core.WriteLock(lockPath, resolved)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Locked %d includes and %d git sources in %s\n", len(resolved.Includes), len(resolved.Sources), lockPath)
+	return nil
+}
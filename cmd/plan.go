@@ -0,0 +1,175 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/vanilla-os/vib/core"
+	"golang.org/x/sys/unix"
+)
+
+// Create a new plan command for the Cobra CLI
+//
+// Returns: new Cobra command for showing the build plan of a recipe
+func NewPlanCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "plan",
+		Short: "Show what building the given recipe does",
+		Long:  "Show the stages, the modules with their handler, sources and commands, and the Containerfile of the given Vib recipe, without writing it",
+		Example: `  Using the recipe.yml/yaml or vib.yml/yaml file in the current directory:
+    vib plan
+
+  To print the plan as JSON, use:
+    vib plan --format json /path/to/recipe.yml
+
+  To show the plan of the build stage and the stages it depends on, use:
+    vib plan --target build /path/to/recipe.yml`,
+		RunE: planCommand,
+	}
+
+	cmd.Flags().StringP("format", "f", "text", "Output format (text/json)")
+	cmd.Flags().StringP("arch", "a", runtime.GOARCH, "target architecture")
+	cmd.Flags().StringArray("set", []string{}, "Override a recipe variable, in the key=value form (can be repeated)")
+	cmd.Flags().String("target", "", "Plan only the given stage and the stages it depends on")
+	cmd.Flags().Int("jobs", core.BuildOptions{}.PrefetchJobs(), "Number of sources fetched at the same time")
+	cmd.Flags().SetInterspersed(false)
+
+	return cmd
+}
+
+// Handle the plan command for the Cobra CLI
+func planCommand(cmd *cobra.Command, args []string) error {
+	commonNames := []string{
+		"recipe.yml",
+		"recipe.yaml",
+		"vib.yml",
+		"vib.yaml",
+	}
+	var recipePath string
+
+	format, _ := cmd.Flags().GetString("format")
+	arch, _ := cmd.Flags().GetString("arch")
+	target, _ := cmd.Flags().GetString("target")
+	jobs, _ := cmd.Flags().GetInt("jobs")
+	if jobs < 0 {
+		return fmt.Errorf("invalid number of jobs %d, expected 0 or more", jobs)
+	}
+	vars, err := getVarOverrides(cmd)
+	if err != nil {
+		return err
+	}
+	if format != "text" && format != "json" {
+		return fmt.Errorf("invalid format %s, expected text or json", format)
+	}
+
+	if len(args) == 0 {
+		for _, name := range commonNames {
+			if _, err := os.Stat(name); err == nil {
+				recipePath = name
+				break
+			}
+		}
+	} else {
+		recipePath = args[0]
+	}
+
+	if recipePath == "" {
+		return fmt.Errorf("missing recipe path")
+	}
+
+	// the progress of the build goes to stderr, leaving stdout to the plan
+	restoreStdout, err := redirectStdout()
+	if err != nil {
+		return err
+	}
+	plan, err := core.PlanRecipe(recipePath, arch, core.BuildOptions{Vars: vars, Target: target, Jobs: jobs})
+	restoreErr := restoreStdout()
+	if err != nil {
+		return err
+	}
+	if restoreErr != nil {
+		return restoreErr
+	}
+
+	if format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(plan)
+	}
+
+	printPlan(plan)
+	return nil
+}
+
+// Point the stdout file descriptor at stderr until the returned function
+// is called. Swapping os.Stdout is not enough, as the plugins have their
+// own Go runtime and write to the file descriptor directly
+func redirectStdout() (func() error, error) {
+	stdout, err := unix.Dup(unix.Stdout)
+	if err != nil {
+		return nil, err
+	}
+	err = unix.Dup2(unix.Stderr, unix.Stdout)
+	if err != nil {
+		unix.Close(stdout)
+		return nil, err
+	}
+
+	return func() error {
+		defer unix.Close(stdout)
+		return unix.Dup2(stdout, unix.Stdout)
+	}, nil
+}
+
+// Print the plan as an indented tree of stages and modules
+func printPlan(plan *core.Plan) {
+	fmt.Printf("Recipe %s (%s) for %s\n", plan.Name, plan.Id, plan.Arch)
+	if plan.Target != "" {
+		fmt.Printf("Target stage: %s\n", plan.Target)
+	}
+
+	for _, stage := range plan.Stages {
+		fmt.Printf("\nStage %s from %s\n", stage.Id, stage.Base)
+		if stage.Skipped {
+			fmt.Printf("  skipped, if: %s\n", stage.Condition)
+			continue
+		}
+		for _, module := range stage.Modules {
+			printModulePlan(module, 1)
+		}
+	}
+
+	fmt.Printf("\nContainerfile:\n%s", plan.Containerfile)
+}
+
+func printModulePlan(module *core.ModulePlan, depth int) {
+	indent := strings.Repeat("  ", depth)
+	fmt.Printf("%s- %s [%s, %s]", indent, module.Name, module.Type, module.Handler)
+	if module.Location != "" {
+		fmt.Printf(" at %s", module.Location)
+	}
+	fmt.Println()
+
+	if module.Skipped {
+		fmt.Printf("%s    skipped, if: %s\n", indent, module.Condition)
+		return
+	}
+	if module.Workdir != "" {
+		fmt.Printf("%s    workdir: %s\n", indent, module.Workdir)
+	}
+	for _, source := range module.Sources {
+		fmt.Printf("%s    source: %s %s%s\n", indent, source.Type, source.URL, source.Path)
+	}
+	for _, command := range module.Commands {
+		for _, line := range strings.Split(command, "\n") {
+			fmt.Printf("%s    | %s\n", indent, line)
+		}
+	}
+	for _, nested := range module.Modules {
+		printModulePlan(nested, depth+1)
+	}
+}
@@ -24,11 +24,16 @@ var rootCmd = &cobra.Command{
 	Version:      Version,
 }
 
-// Initialize the root command with build, test, and compile commands
+// Initialize the root command with build, test, lint, compile, flatten, lock, plan and cache commands
 func init() {
 	rootCmd.AddCommand(NewBuildCommand())
 	rootCmd.AddCommand(NewTestCommand())
+	rootCmd.AddCommand(NewLintCommand())
 	rootCmd.AddCommand(NewCompileCommand())
+	rootCmd.AddCommand(NewFlattenCommand())
+	rootCmd.AddCommand(NewLockCommand())
+	rootCmd.AddCommand(NewPlanCommand())
+	rootCmd.AddCommand(NewCacheCommand())
 }
 
 // Execute the root command, handling root user environment setup and privilege dropping
@@ -15,6 +15,7 @@ func NewTestCommand() *cobra.Command {
 		Long:  "Test the given Vib recipe to check if it's valid",
 		RunE:  testCommand,
 	}
+	cmd.Flags().StringArray("set", []string{}, "Override a recipe variable, in the key=value form (can be repeated)")
 	cmd.Flags().SetInterspersed(false)
 
 	return cmd
@@ -26,8 +27,13 @@ func testCommand(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("no recipe path specified")
 	}
 
+	vars, err := getVarOverrides(cmd)
+	if err != nil {
+		return err
+	}
+
 	recipePath := args[0]
-	_, err := core.TestRecipe(recipePath)
+	_, err = core.TestRecipe(recipePath, vars)
 	if err != nil {
 		return err
 	}
@@ -5,47 +5,99 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/mitchellh/mapstructure"
 	"github.com/vanilla-os/vib/api"
+	"gopkg.in/yaml.v3"
 )
 
 // Add a WORKDIR instruction to the containerfile
-func ChangeWorkingDirectory(workdir string, containerfile *os.File) error {
+func ChangeWorkingDirectory(workdir string, containerfile *Containerfile) {
 	if workdir != "" {
-		_, err := containerfile.WriteString(
-			fmt.Sprintf("WORKDIR %s\n", workdir),
-		)
-		if err != nil {
-			return err
-		}
+		containerfile.Add(WorkdirInstruction{Path: workdir})
 	}
-	return nil
 }
 
-// Add a WORKDIR instruction to reset to the root directory
-func RestoreWorkingDirectory(workdir string, containerfile *os.File) error {
+// Add a WORKDIR instruction to reset to the working directory of the
+// stage, the root directory if the stage has none
+func RestoreWorkingDirectory(workdir string, stageWorkdir string, containerfile *Containerfile) {
 	if workdir != "" {
-		_, err := containerfile.WriteString(
-			fmt.Sprintf("WORKDIR %s\n", "/"),
-		)
-		if err != nil {
-			return err
+		if stageWorkdir == "" {
+			stageWorkdir = "/"
 		}
+		containerfile.Add(WorkdirInstruction{Path: stageWorkdir})
 	}
+}
 
-	return nil
+// Options of a build of a recipe
+type BuildOptions struct {
+	// Path of the Containerfile relative to the recipe, Containerfile
+	// when empty
+	Containerfile string
+	// Overrides of the recipe variables
+	Vars map[string]string
+	// Pin the build to SOURCE_DATE_EPOCH and normalize the timestamps
+	// of the sources to it
+	Reproducible bool
+	// Build only this stage and the stages it depends on
+	Target string
+	// Number of sources fetched at the same time, 4 when 0
+	Jobs int
 }
 
-// Load and build a Containerfile from the specified recipe
-func BuildRecipe(recipePath string, arch string, containerfilePath string) (api.Recipe, error) {
-	// load the recipe
-	recipe, err := LoadRecipe(recipePath)
+// PrefetchJobs returns the number of sources fetched at the same time
+func (o BuildOptions) PrefetchJobs() int {
+	if o.Jobs == 0 {
+		return 4
+	}
+	return o.Jobs
+}
+
+// Load and build a Containerfile from the specified recipe. In
+// reproducible mode, the build is pinned to SOURCE_DATE_EPOCH and the
+// timestamps of the sources are normalized to it
+func BuildRecipe(recipePath string, arch string, options BuildOptions) (api.Recipe, error) {
+	recipe, err := loadBuildRecipe(recipePath, options)
+	if err != nil {
+		return api.Recipe{}, err
+	}
+
+	err = buildRecipeContainerfile(recipe, recipePath, arch, options.Containerfile)
 	if err != nil {
 		return api.Recipe{}, err
 	}
+	return *recipe, nil
+}
+
+// loadBuildRecipe loads the recipe and applies the build options, so one
+// load can generate the Containerfiles of several architectures
+func loadBuildRecipe(recipePath string, options BuildOptions) (*api.Recipe, error) {
+	// load the recipe
+	recipe, err := LoadRecipe(recipePath, options.Vars)
+	if err != nil {
+		return nil, err
+	}
 
+	if options.Reproducible {
+		epoch, err := SourceDateEpoch(recipe.ParentPath)
+		if err != nil {
+			return nil, err
+		}
+		recipe.SourceDateEpoch = strconv.FormatInt(epoch, 10)
+		fmt.Printf("Reproducible build, SOURCE_DATE_EPOCH=%s\n", recipe.SourceDateEpoch)
+	}
+
+	recipe.Target = options.Target
+	getBuildState(recipe).prefetchJobs = options.PrefetchJobs()
+	return recipe, nil
+}
+
+// buildRecipeContainerfile generates the Containerfile of a loaded recipe
+// for the architecture, fetching the sources it still lacks
+func buildRecipeContainerfile(recipe *api.Recipe, recipePath string, arch string, containerfilePath string) error {
 	fmt.Printf("Building recipe %s\n", recipe.Name)
 
 	// assuming the Containerfile location is relative
@@ -57,9 +109,21 @@ func BuildRecipe(recipePath string, arch string, containerfilePath string) (api.
 	}
 
 	// build the Containerfile
-	err = BuildContainerfile(recipe, arch)
+	err := BuildContainerfile(recipe, arch)
 	if err != nil {
-		return api.Recipe{}, err
+		return err
+	}
+
+	// the sources are copied into the image with their timestamps
+	if recipe.SourceDateEpoch != "" {
+		epoch, err := strconv.ParseInt(recipe.SourceDateEpoch, 10, 64)
+		if err != nil {
+			return err
+		}
+		err = normalizeTimestamps(recipe.SourcesPath, epoch)
+		if err != nil {
+			return err
+		}
 	}
 
 	modules := 0
@@ -71,251 +135,244 @@ func BuildRecipe(recipePath string, arch string, containerfilePath string) (api.
 	fmt.Printf("Processed %d stages\n", len(recipe.Stages))
 	fmt.Printf("Processed %d modules\n", modules)
 
-	return *recipe, nil
+	return nil
 }
 
 // Generate a Containerfile from the recipe
 func BuildContainerfile(recipe *api.Recipe, arch string) error {
-	err := os.RemoveAll(recipe.Containerfile)
+	containerfile, err := GenerateContainerfile(recipe, arch)
 	if err != nil {
 		return err
 	}
 
-	containerfile, err := os.Create(recipe.Containerfile)
+	content, err := containerfile.Emit()
 	if err != nil {
 		return err
 	}
 
-	defer containerfile.Close()
+	err = os.RemoveAll(recipe.Containerfile)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(recipe.Containerfile, []byte(content), 0644)
+}
+
+// GenerateContainerfile builds the instructions of the Containerfile of
+// the recipe, along with the commands of its modules
+func GenerateContainerfile(recipe *api.Recipe, arch string) (*Containerfile, error) {
+	containerfile := &Containerfile{}
+	state := getBuildState(recipe)
+	defer func() { state.stageIncludes = nil }()
+
+	// only the target and the stages it depends on are built
+	var needed []int
+	if recipe.Target != "" {
+		graph, err := BuildStageGraph(recipe)
+		if err != nil {
+			return nil, err
+		}
+		needed, err = graph.StagesFor(recipe.Target)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// the sources are fetched together, before the modules are built
+	err := prefetchSources(recipe, arch, needed)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, stage := range recipe.Stages {
+		if recipe.Target != "" && !containsInt(needed, i) {
+			fmt.Printf("Skipping stage [%s], not needed by target %s\n", stage.Id, recipe.Target)
+			continue
+		}
+
+		// stages whose condition is false are left out, keeping a
+		// trace of them in the Containerfile
+		if stage.If != "" {
+			enabled, err := EvaluateCondition(stage.If, ConditionContext{Arch: arch, Vars: recipe.Vars})
+			if err != nil {
+				location, _ := StageLocation(recipe, i)
+				return nil, locateError(location, err)
+			}
+			if !enabled {
+				fmt.Printf("Skipping stage [%s], condition %s is false\n", stage.Id, stage.If)
+				containerfile.Add(CommentInstruction{Text: fmt.Sprintf("Skipped Stage: %s - if: %s", stage.Id, singleLine(stage.If))})
+				recordStage(recipe, stage, true)
+				continue
+			}
+		}
+
+		recordStage(recipe, stage, false)
+
+		// modules included once are built once per stage
+		state.stageIncludes = nil
 
-	for _, stage := range recipe.Stages {
 		// build the modules*
 		// * actually just build the commands that will be used
 		//   in the Containerfile to build the modules
-		cmds, err := BuildModules(recipe, stage.Modules, stage.Cleanup, arch)
+		cmds, err := BuildModules(recipe, stage.Modules, stage.Cleanup, stage.Cache, arch, stage.SingleLayer)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		// FROM
 		if stage.Id != "" {
-			_, err = containerfile.WriteString(
-				fmt.Sprintf("# Stage: %s\n", stage.Id),
-			)
-			if err != nil {
-				return err
-			}
-			_, err = containerfile.WriteString(
-				fmt.Sprintf("FROM %s AS %s\n", stage.Base, stage.Id),
+			containerfile.Add(
+				CommentInstruction{Text: "Stage: " + stage.Id},
+				FromInstruction{Image: stage.Base, Name: stage.Id},
 			)
-			if err != nil {
-				return err
-			}
 		} else {
-			_, err = containerfile.WriteString(
-				fmt.Sprintf("FROM %s\n", stage.Base),
-			)
-			if err != nil {
-				return err
-			}
+			containerfile.Add(FromInstruction{Image: stage.Base})
 		}
 
+		// SOURCE_DATE_EPOCH is made available to every command of
+		// the stage, so the tools honoring it produce the same output
+		if recipe.SourceDateEpoch != "" {
+			containerfile.Add(ArgInstruction{Key: "SOURCE_DATE_EPOCH", Value: recipe.SourceDateEpoch})
+		}
+
+		// SHELL
+		if len(stage.Shell) > 0 {
+			containerfile.Add(ShellInstruction{Exec: stage.Shell})
+		}
+
+		// WORKDIR, kept by every following instruction of the stage
+		ChangeWorkingDirectory(stage.Workdir, containerfile)
+
 		// COPY
-		if len(stage.Copy) > 0 {
-			for _, copy := range stage.Copy {
-				if len(copy.SrcDst) > 0 {
-					err = ChangeWorkingDirectory(copy.Workdir, containerfile)
-					if err != nil {
-						return err
-					}
-
-					for src, dst := range copy.SrcDst {
-						if copy.From != "" {
-							_, err = containerfile.WriteString(
-								fmt.Sprintf("COPY --from=%s %s %s\n", copy.From, src, dst),
-							)
-							if err != nil {
-								return err
-							}
-						} else {
-							_, err = containerfile.WriteString(
-								fmt.Sprintf("COPY %s %s\n", src, dst),
-							)
-							if err != nil {
-								return err
-							}
-						}
-					}
-
-					err = RestoreWorkingDirectory(copy.Workdir, containerfile)
-					if err != nil {
-						return err
-					}
+		for j, copy := range stage.Copy {
+			if len(copy.SrcDst) > 0 {
+				ChangeWorkingDirectory(copy.Workdir, containerfile)
+				for _, src := range stageKeys(recipe, i, fmt.Sprintf("copy.%d.srcdst", j), copy.SrcDst) {
+					containerfile.Add(CopyInstruction{From: copy.From, Sources: []string{src}, Dest: copy.SrcDst[src]})
 				}
+				RestoreWorkingDirectory(copy.Workdir, stage.Workdir, containerfile)
 			}
 		}
 
 		// LABELS
-		for key, value := range stage.Labels {
-			_, err = containerfile.WriteString(
-				fmt.Sprintf("LABEL %s='%s'\n", key, value),
-			)
-			if err != nil {
-				return err
-			}
+		for _, key := range stageKeys(recipe, i, "labels", stage.Labels) {
+			containerfile.Add(LabelInstruction{Key: key, Value: stage.Labels[key]})
 		}
 
 		// ENV
-		for key, value := range stage.Env {
-			_, err = containerfile.WriteString(
-				fmt.Sprintf("ENV %s=%s\n", key, value),
-			)
-			if err != nil {
-				return err
-			}
+		for _, key := range stageKeys(recipe, i, "env", stage.Env) {
+			containerfile.Add(EnvInstruction{Key: key, Value: stage.Env[key]})
 		}
 
 		// ARGS
-		for key, value := range stage.Args {
-			_, err = containerfile.WriteString(
-				fmt.Sprintf("ARG %s=%s\n", key, value),
-			)
-			if err != nil {
-				return err
-			}
+		for _, key := range stageKeys(recipe, i, "args", stage.Args) {
+			containerfile.Add(ArgInstruction{Key: key, Value: stage.Args[key]})
 		}
 
 		// RUN(S)
 		if len(stage.Runs.Commands) > 0 {
-			err = ChangeWorkingDirectory(stage.Runs.Workdir, containerfile)
+			ChangeWorkingDirectory(stage.Runs.Workdir, containerfile)
+			caches, err := resolveCaches(stage.Cache, arch)
 			if err != nil {
-				return err
+				return nil, err
 			}
-
-			cleanupSuffix := api.GetCleanupSuffix(stage.Cleanup)
-			for _, cmd := range stage.Runs.Commands {
-				_, err = containerfile.WriteString(
-					fmt.Sprintf("RUN %s\n", cmd + cleanupSuffix),
-				)
-				if err != nil {
-					return err
-				}
-			}
-
-			err = RestoreWorkingDirectory(stage.Runs.Workdir, containerfile)
+			suffix := cleanupSuffix(stage.Cleanup, caches)
+			secrets, err := secretMounts(recipe, nil)
 			if err != nil {
-				return err
+				return nil, err
+			}
+			for _, cmd := range stage.Runs.Commands {
+				containerfile.Add(RunInstruction{Flags: secrets, Caches: caches, Command: cmd + suffix})
 			}
+			RestoreWorkingDirectory(stage.Runs.Workdir, stage.Workdir, containerfile)
 		}
 
 		// EXPOSE
-		for key, value := range stage.Expose {
-			_, err = containerfile.WriteString(
-				fmt.Sprintf("EXPOSE %s/%s\n", key, value),
-			)
-			if err != nil {
-				return err
-			}
+		for _, key := range stageKeys(recipe, i, "expose", stage.Expose) {
+			containerfile.Add(ExposeInstruction{Port: fmt.Sprintf("%s/%s", key, stage.Expose[key])})
 		}
 
 		// ADDS
-		if len(stage.Adds) > 0 {
-			for _, add := range stage.Adds {
-				if len(add.SrcDst) > 0 {
-					err = ChangeWorkingDirectory(add.Workdir, containerfile)
-					if err != nil {
-						return err
-					}
-
-					for src, dst := range add.SrcDst {
-						_, err = containerfile.WriteString(
-							fmt.Sprintf("ADD %s %s\n", src, dst),
-						)
-						if err != nil {
-							return err
-						}
-					}
-				}
-
-				err = RestoreWorkingDirectory(add.Workdir, containerfile)
-				if err != nil {
-					return err
+		for j, add := range stage.Adds {
+			if len(add.SrcDst) > 0 {
+				ChangeWorkingDirectory(add.Workdir, containerfile)
+				for _, src := range stageKeys(recipe, i, fmt.Sprintf("adds.%d.srcdst", j), add.SrcDst) {
+					containerfile.Add(AddInstruction{Sources: []string{src}, Dest: add.SrcDst[src]})
 				}
 			}
+			RestoreWorkingDirectory(add.Workdir, stage.Workdir, containerfile)
 		}
 
 		// INCLUDES.CONTAINER
 		if stage.Addincludes {
-			_, err = containerfile.WriteString(fmt.Sprintf("ADD %s /\n", recipe.IncludesPath))
-			if err != nil {
-				return err
-			}
+			containerfile.Add(AddInstruction{Sources: []string{recipe.IncludesPath}, Dest: "/"})
 		}
 
 		for _, cmd := range cmds {
-			err = ChangeWorkingDirectory(cmd.Workdir, containerfile)
-			if err != nil {
-				return err
-			}
-
-			_, err = containerfile.WriteString(strings.Join(cmd.Command, "\n"))
-			if err != nil {
-				return err
-			}
+			ChangeWorkingDirectory(cmd.Workdir, containerfile)
+			containerfile.Add(cmd.Instructions...)
+			RestoreWorkingDirectory(cmd.Workdir, stage.Workdir, containerfile)
+		}
 
-			err = RestoreWorkingDirectory(cmd.Workdir, containerfile)
-			if err != nil {
-				return err
-			}
+		// VOLUME
+		if len(stage.Volumes) > 0 {
+			containerfile.Add(VolumeInstruction{Paths: stage.Volumes})
 		}
 
-		// CMD
-		err = ChangeWorkingDirectory(stage.Cmd.Workdir, containerfile)
-		if err != nil {
-			return err
+		// USER, after the modules which usually need root
+		if stage.User != "" {
+			containerfile.Add(UserInstruction{User: stage.User})
 		}
 
-		if len(stage.Cmd.Exec) > 0 {
-			_, err = containerfile.WriteString(
-				fmt.Sprintf("CMD [\"%s\"]\n", strings.Join(stage.Cmd.Exec, "\",\"")),
-			)
-			if err != nil {
-				return err
-			}
+		// HEALTHCHECK
+		if stage.Healthcheck.Disable || len(stage.Healthcheck.Test) > 0 {
+			containerfile.Add(HealthcheckInstruction{
+				Test:        stage.Healthcheck.Test,
+				Interval:    stage.Healthcheck.Interval,
+				Timeout:     stage.Healthcheck.Timeout,
+				StartPeriod: stage.Healthcheck.StartPeriod,
+				Retries:     stage.Healthcheck.Retries,
+				Disable:     stage.Healthcheck.Disable,
+			})
+		}
 
-			err = RestoreWorkingDirectory(stage.Cmd.Workdir, containerfile)
-			if err != nil {
-				return err
-			}
+		// STOPSIGNAL
+		if stage.StopSignal != "" {
+			containerfile.Add(StopSignalInstruction{Signal: stage.StopSignal})
 		}
 
-		// ENTRYPOINT
-		err = ChangeWorkingDirectory(stage.Entrypoint.Workdir, containerfile)
-		if err != nil {
-			return err
+		// CMD
+		if len(stage.Cmd.Exec) > 0 {
+			ChangeWorkingDirectory(stage.Cmd.Workdir, containerfile)
+			containerfile.Add(CmdInstruction{Exec: stage.Cmd.Exec})
+			RestoreWorkingDirectory(stage.Cmd.Workdir, stage.Workdir, containerfile)
 		}
 
+		// ENTRYPOINT
 		if len(stage.Entrypoint.Exec) > 0 {
-			_, err = containerfile.WriteString(
-				fmt.Sprintf("ENTRYPOINT [\"%s\"]\n", strings.Join(stage.Entrypoint.Exec, "\",\"")),
-			)
-			if err != nil {
-				return err
-			}
-
-			err = RestoreWorkingDirectory(stage.Entrypoint.Workdir, containerfile)
-			if err != nil {
-				return err
-			}
+			ChangeWorkingDirectory(stage.Entrypoint.Workdir, containerfile)
+			containerfile.Add(EntrypointInstruction{Exec: stage.Entrypoint.Exec})
+			RestoreWorkingDirectory(stage.Entrypoint.Workdir, stage.Workdir, containerfile)
 		}
 	}
 
-	return nil
+	return containerfile, nil
 }
 
-// Build commands for each module in the recipe
-func BuildModules(recipe *api.Recipe, modules []interface{}, cleanup []string, arch string) ([]ModuleCommand, error) {
+// Build commands for each module in the recipe. Consecutive modules of
+// the same layer are merged into one command, as are the modules of a
+// single layer stage, except for those in their own layer
+func BuildModules(recipe *api.Recipe, modules []interface{}, cleanup []string, caches []api.Cache, arch string, singleLayer bool) ([]ModuleCommand, error) {
 	cmds := []ModuleCommand{}
+
+	var layer []ModuleCommand
+	layerName := ""
+	flushLayer := func() {
+		if len(layer) > 0 {
+			cmds = append(cmds, MergeModuleCommands(layer, cleanup)...)
+		}
+		layer = nil
+	}
+
 	for _, moduleInterface := range modules {
 		var module Module
 		err := mapstructure.Decode(moduleInterface, &module)
@@ -323,119 +380,322 @@ func BuildModules(recipe *api.Recipe, modules []interface{}, cleanup []string, a
 			return nil, err
 		}
 
-		cmd, err := BuildModule(recipe, moduleInterface, cleanup, arch)
+		merged := module.Layer != OwnLayer && (module.Layer != "" || singleLayer)
+		if !merged || module.Layer != layerName {
+			flushLayer()
+		}
+
+		// merged modules leave the cleanup to the end of their layer
+		moduleCleanup := cleanup
+		if merged {
+			moduleCleanup = nil
+		}
+		instructions, err := BuildModule(recipe, moduleInterface, moduleCleanup, caches, nil, arch)
 		if err != nil {
 			return nil, err
 		}
 
-		cmds = append(cmds, ModuleCommand{
-			Name:    module.Name,
-			Command: append(cmd, ""), // add empty entry to ensure proper newline in Containerfile
-			Workdir: module.Workdir,
-		})
+		// skipped modules only leave a comment, which needs no workdir
+		workdir := module.Workdir
+		if skipped, _, _ := skipModule(recipe, moduleInterface, arch); skipped {
+			workdir = ""
+		}
+
+		cmd := ModuleCommand{
+			Name:         module.Name,
+			Instructions: instructions,
+			Workdir:      workdir,
+		}
+		if merged {
+			layer = append(layer, cmd)
+			layerName = module.Layer
+		} else {
+			cmds = append(cmds, cmd)
+		}
 	}
+	flushLayer()
 
 	return cmds, nil
 }
 
-func buildIncludesModule(moduleInterface interface{}, recipe *api.Recipe, cleanup []string, arch string) (string, error) {
-	var include IncludesModule
-	err := mapstructure.Decode(moduleInterface, &include)
+func buildIncludesModule(moduleInterface interface{}, recipe *api.Recipe, cleanup []string, caches []api.Cache, env []RunVariable, arch string) ([]Instruction, error) {
+	var includesModule IncludesModule
+	err := mapstructure.Decode(moduleInterface, &includesModule)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	if len(include.Includes) == 0 {
-		return "", errors.New("includes module must have at least one module to include")
+	if len(includesModule.Includes) == 0 {
+		return nil, errors.New("includes module must have at least one module to include")
 	}
 
-	var commands []string
-	for _, include := range include.Includes {
-		var modulePath string
+	includes, err := resolveIncludes(recipe.ParentPath, includesModule.Includes, includesModule.Exclude)
+	if err != nil {
+		return nil, err
+	}
 
-		// in case of a remote include, we need to download the
-		// recipe before including it
-		if include[:4] == "http" {
-			fmt.Printf("Downloading recipe from %s\n", include)
-			modulePath, err = downloadRecipe(include)
+	var instructions []Instruction
+	for _, include := range includes {
+		modulePath, remote, err := includePath(recipe, include)
+		if err != nil {
+			return nil, err
+		}
+		if remote {
+			err = verifyLockedInclude(recipe.Lock, include, modulePath)
 			if err != nil {
-				return "", err
+				return nil, err
 			}
-		} else if followsGhPattern(include) {
-			// if the include follows the github pattern, we need to
-			// download the recipe from the github repository
-			fmt.Printf("Downloading recipe from %s\n", include)
-			modulePath, err = downloadGhRecipe(include)
-			if err != nil {
-				return "", err
+		}
+
+		// included modules are located in their own file, while
+		// their path continues from the includes module
+		file := include
+		if !remote {
+			file = displayPath(recipe, modulePath)
+		}
+		state := getBuildState(recipe)
+		chain := state.includeChain
+		for i, chained := range chain {
+			if chained == file {
+				return nil, fmt.Errorf("include cycle: %s", strings.Join(append(append([]string{}, chain[i:]...), file), " -> "))
 			}
-		} else {
-			modulePath = filepath.Join(recipe.ParentPath, include)
+		}
+		if includesModule.Once && state.stageIncludes[file] {
+			fmt.Printf("Skipping include %s, already included\n", file)
+			instructions = append(instructions, CommentInstruction{Text: fmt.Sprintf("Already included: %s", file)})
+			continue
 		}
 
-		includeModule, err := GenModule(modulePath)
+		includeModule, includeNode, err := genModule(modulePath, recipe.Vars)
 		if err != nil {
-			return "", err
+			return nil, fmt.Errorf("%s: %w", file, err)
 		}
+		parent, _ := ModuleLocation(recipe, moduleInterface)
+		registerModuleLocation(recipe, func(*yaml.Node) string { return file }, includeNode, includeModule, parent.Path)
+
+		// only the includes marked once are skipped by the later ones,
+		// an include without once is built wherever it appears
+		if includesModule.Once {
+			if state.stageIncludes == nil {
+				state.stageIncludes = map[string]bool{}
+			}
+			state.stageIncludes[file] = true
+		}
+		state.includeChain = append(chain, file)
+		moduleInstructions, err := BuildModule(recipe, includeModule, cleanup, caches, env, arch)
+		state.includeChain = chain
+		if err != nil {
+			return nil, err
+		}
+		instructions = append(instructions, moduleInstructions...)
+	}
+	return instructions, nil
+}
 
-		buildModule, err := BuildModule(recipe, includeModule, cleanup, arch)
+// skipModule evaluates the if: condition of a module and reports whether
+// the module must be skipped, along with the condition
+func skipModule(recipe *api.Recipe, moduleInterface interface{}, arch string) (bool, string, error) {
+	value := lookupKey(moduleInterface, "if")
+	if value == nil {
+		return false, "", nil
+	}
+
+	condition := fmt.Sprint(value)
+	enabled, err := EvaluateCondition(condition, ConditionContext{Arch: arch, Vars: recipe.Vars})
+	if err != nil {
+		return false, condition, err
+	}
+	return !enabled, condition, nil
+}
+
+// moduleVariables returns the inherited variables with those of the
+// module, its args then its env, each in lexical order. A variable of the
+// module replaces the inherited one of the same name
+func moduleVariables(recipe *api.Recipe, inherited []RunVariable, moduleInterface interface{}) ([]RunVariable, error) {
+	own := []RunVariable{}
+	for _, field := range []string{"args", "env"} {
+		values, err := moduleScalars(recipe, moduleInterface, field)
 		if err != nil {
-			return "", err
+			return nil, err
+		}
+		keys := []string{}
+		for key := range values {
+			err := checkVariableName("module", key)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			own = append(own, RunVariable{Key: key, Value: values[key]})
+		}
+	}
+	if len(own) == 0 {
+		return inherited, nil
+	}
+
+	variables := []RunVariable{}
+	for _, variable := range append(append([]RunVariable{}, inherited...), own...) {
+		replaced := false
+		for i := range variables {
+			if variables[i].Key == variable.Key {
+				variables[i].Value = variable.Value
+				replaced = true
+			}
+		}
+		if !replaced {
+			variables = append(variables, variable)
+		}
+	}
+	return variables, nil
+}
+
+// moduleScalars returns a map of scalars of a module, such as env, as
+// written in the YAML file: the module map holds decoded values, where
+// 3.10 became a float and printed as 3.1. Modules built from code have
+// no YAML node, their values are printed as they are
+func moduleScalars(recipe *api.Recipe, moduleInterface interface{}, field string) (map[string]string, error) {
+	values := map[string]string{}
+
+	node := moduleYAMLNode(recipe, moduleInterface)
+	if node != nil {
+		mapping := mappingValue(node, field, true)
+		if mapping == nil {
+			return values, nil
+		}
+		// errors point at the value itself rather than at the module
+		location, _ := ModuleLocation(recipe, moduleInterface)
+		valueError := func(node *yaml.Node, format string, args ...interface{}) error {
+			location.Line, location.Column = node.Line, node.Column
+			return &LocatedError{Location: location, Err: fmt.Errorf(format, args...)}
+		}
+		if mapping.Kind != yaml.MappingNode {
+			return nil, valueError(mapping, "%s must be a map", field)
+		}
+		for i := 0; i+1 < len(mapping.Content); i += 2 {
+			key := mapping.Content[i]
+			value := resolveAlias(mapping.Content[i+1])
+			switch {
+			case value.Kind != yaml.ScalarNode:
+				return nil, valueError(value, "%s %s must be a string, a number or a boolean", field, key.Value)
+			case value.Tag == "!!null":
+				return nil, valueError(key, "%s %s has no value", field, key.Value)
+			}
+			values[key.Value] = value.Value
+		}
+		return values, nil
+	}
+
+	decoded := lookupKey(moduleInterface, field)
+	if decoded == nil {
+		return values, nil
+	}
+	mapping, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s must be a map", field)
+	}
+	for key, value := range mapping {
+		if value == nil {
+			return nil, fmt.Errorf("%s %s has no value", field, key)
 		}
-		commands = append(commands, buildModule...)
+		values[key] = fmt.Sprint(value)
 	}
-	return strings.Join(commands, "\n"), nil
+	return values, nil
 }
 
-// Build a command string for the given module in the recipe
-func BuildModule(recipe *api.Recipe, moduleInterface interface{}, cleanup []string, arch string) ([]string, error) {
+// singleLine joins the lines of s, so it fits in a Containerfile comment
+func singleLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// Build the instructions of the given module in the recipe
+func BuildModule(recipe *api.Recipe, moduleInterface interface{}, cleanup []string, caches []api.Cache, env []RunVariable, arch string) ([]Instruction, error) {
+	location, ok := ModuleLocation(recipe, moduleInterface)
+	if !ok {
+		location = Location{File: displayPath(recipe, recipe.Path), Path: []string{moduleLabel(moduleInterface)}}
+	}
+
 	var module Module
 	err := mapstructure.Decode(moduleInterface, &module)
 	if err != nil {
-		return []string{""}, err
+		return nil, locateError(location, err)
+	}
+
+	skipped, condition, err := skipModule(recipe, moduleInterface, arch)
+	if err != nil {
+		return nil, locateError(location, err)
+	}
+	modulePlan := recordModule(recipe, module, moduleInterface, location, condition, skipped, arch)
+	if skipped {
+		fmt.Printf("Skipping module [%s], condition %s is false\n", module.Name, condition)
+		return []Instruction{
+			BlankLine{},
+			CommentInstruction{Text: fmt.Sprintf("Skipped Module %s - %s - if: %s", module.Name, module.Type, singleLine(condition))},
+			BlankLine{},
+		}, nil
 	}
 
 	fmt.Printf("Building module [%s] of type [%s]\n", module.Name, module.Type)
 
-	commands := []string{fmt.Sprintf("\n# Begin Module %s - %s", module.Name, module.Type)}
+	instructions := []Instruction{
+		BlankLine{},
+		CommentInstruction{Text: fmt.Sprintf("Begin Module %s - %s", module.Name, module.Type)},
+	}
 
-	if len(module.Modules) > 0 {
-		for _, nestedModule := range module.Modules {
-			buildModule, err := BuildModule(recipe, nestedModule, append(cleanup, module.Cleanup...), arch)
-			if err != nil {
-				return []string{""}, err
-			}
-			commands = append(commands, buildModule...)
+	// the variables of the module override the inherited ones, and are
+	// inherited in turn by the nested modules
+	env, err = moduleVariables(recipe, env, moduleInterface)
+	if err != nil {
+		return nil, locateError(location, err)
+	}
+
+	// nested modules are taken from the module map itself, since
+	// they are tracked by identity to report their location. They get
+	// fresh slices, so appending to them never writes to the ones of
+	// their siblings
+	nestedCleanup := append(append([]string{}, cleanup...), module.Cleanup...)
+	nestedCaches := append(append([]api.Cache{}, caches...), module.Cache...)
+	for _, nestedModule := range nestedModules(moduleInterface) {
+		nestedInstructions, err := BuildModule(recipe, nestedModule, nestedCleanup, nestedCaches, env, arch)
+		if err != nil {
+			return nil, locateError(location, err)
 		}
+		instructions = append(instructions, nestedInstructions...)
 	}
 
-	moduleBuilders := map[string]func(interface{}, *api.Recipe, []string, string) (string, error){
+	moduleBuilders := map[string]func(interface{}, *api.Recipe, []string, []api.Cache, []RunVariable, string) ([]Instruction, error){
 		"shell":    BuildShellModule,
 		"includes": buildIncludesModule,
 	}
 
+	var moduleInstructions []Instruction
 	if moduleBuilder, ok := moduleBuilders[module.Type]; ok {
-		command, err := moduleBuilder(moduleInterface, recipe, cleanup, arch)
-		if err != nil {
-			return []string{""}, err
-		}
-		commands = append(commands, command)
+		moduleInstructions, err = moduleBuilder(moduleInterface, recipe, cleanup, caches, env, arch)
 	} else {
-		command, err := LoadBuildPlugin(module.Type, moduleInterface, recipe, cleanup, arch)
-		if err != nil {
-			return []string{""}, err
-		}
-		commands = append(commands, command...)
+		moduleInstructions, err = LoadBuildPlugin(module.Type, moduleInterface, recipe, cleanup, caches, env, arch)
+	}
+	if err != nil {
+		return nil, locateError(location, err)
+	}
+	instructions = append(instructions, moduleInstructions...)
+
+	err = endModule(recipe, modulePlan, moduleInstructions)
+	if err != nil {
+		return nil, locateError(location, err)
 	}
 
 	moduleSourcePath := filepath.Join(recipe.SourcesPath, module.Name)
 	err = os.MkdirAll(moduleSourcePath, 0755)
 	if err != nil {
-		return []string{""}, err
+		return nil, locateError(location, err)
 	}
 
-	commands = append(commands, fmt.Sprintf("# End Module %s - %s\n", module.Name, module.Type))
+	instructions = append(instructions,
+		CommentInstruction{Text: fmt.Sprintf("End Module %s - %s", module.Name, module.Type)},
+		BlankLine{},
+	)
 
 	fmt.Printf("Module [%s] built successfully\n", module.Name)
-	return commands, nil
+	return instructions, nil
 }
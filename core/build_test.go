@@ -0,0 +1,612 @@
+package core_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/vanilla-os/vib/api"
+	"github.com/vanilla-os/vib/core"
+)
+
+// Test that the Containerfile keeps the declared order of the stage maps
+// and that reproducible builds pin SOURCE_DATE_EPOCH
+func TestBuildContainerfileOrder(t *testing.T) {
+	t.Setenv("SOURCE_DATE_EPOCH", "1700000000")
+	path := writeRecipeFiles(t, map[string]string{
+		"recipe.yml": `name: Test
+id: test
+vibversion: 1.0.0
+stages:
+  - id: build
+    base: debian:sid-slim
+    labels:
+      zeta: "1"
+      alpha: "2"
+      mid: "3"
+    env:
+      PATH_B: /b
+      PATH_A: /a
+    args:
+      Z_ARG: z
+      A_ARG: a
+    expose:
+      "8080": tcp
+      "443": tcp
+    copy:
+      - srcdst:
+          /z: /z
+          /a: /a
+    modules:
+      - name: hello
+        type: shell
+        commands:
+          - echo hello
+`,
+	})
+
+	var previous string
+	for i := 0; i < 5; i++ {
+		_, err := core.BuildRecipe(path, "amd64", core.BuildOptions{Reproducible: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := os.ReadFile(filepath.Join(filepath.Dir(path), "Containerfile"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i > 0 && string(content) != previous {
+			t.Fatalf("expected the same Containerfile on every build, got:\n%s\nand:\n%s", previous, content)
+		}
+		previous = string(content)
+	}
+
+	last := -1
+	for _, line := range []string{
+		`ARG SOURCE_DATE_EPOCH="1700000000"`,
+		"COPY /z /z", "COPY /a /a",
+		`LABEL zeta="1"`, `LABEL alpha="2"`, `LABEL mid="3"`,
+		`ENV PATH_B="/b"`, `ENV PATH_A="/a"`,
+		`ARG Z_ARG="z"`, `ARG A_ARG="a"`,
+		"EXPOSE 8080/tcp", "EXPOSE 443/tcp",
+	} {
+		index := strings.Index(previous, line+"\n")
+		if index < 0 || index < last {
+			t.Fatalf("expected %q after the previous instructions:\n%s", line, previous)
+		}
+		last = index
+	}
+
+	info, err := os.Stat(filepath.Join(filepath.Dir(path), "sources", "hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ModTime().Unix() != 1700000000 {
+		t.Errorf("expected the sources timestamps to be normalized, got %s", info.ModTime())
+	}
+}
+
+// Test that a single layer stage merges the module commands into one RUN
+// with the cleanup at its end
+func TestBuildSingleLayer(t *testing.T) {
+	path := writeRecipeFiles(t, map[string]string{
+		"recipe.yml": `name: Test
+id: test
+vibversion: 1.0.0
+stages:
+  - id: build
+    base: debian:sid-slim
+    singlelayer: true
+    cleanup:
+      - /var/lib/apt/lists
+    modules:
+      - name: first
+        type: shell
+        commands:
+          - apt-get update
+          - apt-get install -y curl
+      - name: second
+        type: shell
+        workdir: /opt/app dir
+        commands:
+          - make install
+`,
+	})
+
+	_, err := core.BuildRecipe(path, "amd64", core.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(filepath.Join(filepath.Dir(path), "Containerfile"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `RUN --mount=source=sources/first,target=/sources/first,rw --mount=source=sources/second,target=/sources/second,rw <<'EOF'
+set -e
+# Begin Module first - shell
+set -e
+trap '[ $? -eq 0 ] || echo "Command failed: $vib_command" >&2' EXIT
+vib_command='apt-get update'
+apt-get update
+vib_command='apt-get install -y curl'
+apt-get install -y curl
+trap - EXIT
+# End Module first - shell
+# Begin Module second - shell
+(
+mkdir -p '/opt/app dir' && cd '/opt/app dir'
+make install
+# End Module second - shell
+)
+rm -rf /var/lib/apt/lists
+EOF
+`
+	if !strings.HasSuffix(string(content), expected) {
+		t.Errorf("expected the modules in a single RUN:\n%s\ngot:\n%s", expected, content)
+	}
+	if strings.Count(string(content), "RUN ") != 1 {
+		t.Errorf("expected a single RUN instruction, got:\n%s", content)
+	}
+}
+
+// Test that consecutive modules of the same layer share a RUN and that
+// modules in their own layer are never merged
+func TestBuildModuleLayers(t *testing.T) {
+	path := writeRecipeFiles(t, map[string]string{
+		"recipe.yml": `name: Test
+id: test
+vibversion: 1.0.0
+stages:
+  - id: build
+    base: debian:sid-slim
+    modules:
+      - name: first
+        type: shell
+        layer: packages
+        commands:
+          - echo first
+      - name: second
+        type: shell
+        layer: packages
+        commands:
+          - echo second
+      - name: third
+        type: shell
+        commands:
+          - echo third
+  - id: final
+    base: debian:sid-slim
+    singlelayer: true
+    modules:
+      - name: fourth
+        type: shell
+        commands:
+          - echo fourth
+      - name: fifth
+        type: shell
+        layer: own
+        commands:
+          - echo fifth
+      - name: sixth
+        type: shell
+        commands:
+          - echo sixth
+`,
+	})
+
+	_, err := core.BuildRecipe(path, "amd64", core.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(filepath.Join(filepath.Dir(path), "Containerfile"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{
+		"set -e\n# Begin Module first - shell\necho first\n# End Module first - shell\n# Begin Module second - shell\necho second\n# End Module second - shell\n",
+		"RUN --mount=source=sources/third,target=/sources/third,rw echo third\n",
+		"set -e\n# Begin Module fourth - shell\necho fourth\n# End Module fourth - shell\n",
+		"RUN --mount=source=sources/fifth,target=/sources/fifth,rw echo fifth\n",
+		"set -e\n# Begin Module sixth - shell\necho sixth\n# End Module sixth - shell\n",
+	} {
+		if !hasLines(string(content), expected) {
+			t.Errorf("expected %q in the Containerfile:\n%s", expected, content)
+		}
+	}
+	if count := strings.Count(string(content), "RUN "); count != 5 {
+		t.Errorf("expected 5 RUN instructions, got %d:\n%s", count, content)
+	}
+}
+
+// Test the order of the stage instructions and that workdirs are restored
+// to the working directory of the stage
+func TestBuildStageInstructions(t *testing.T) {
+	path := writeRecipeFiles(t, map[string]string{
+		"recipe.yml": `name: Test
+id: test
+vibversion: 1.0.0
+stages:
+  - id: app
+    base: debian:sid-slim
+    shell: ["/bin/bash", "-c"]
+    workdir: /app
+    user: app:app
+    volumes:
+      - /data
+      - /var/log/app
+    stopsignal: SIGTERM
+    healthcheck:
+      test: ["curl", "-f", "http://localhost/"]
+      interval: 30s
+      retries: 3
+    runs:
+      workdir: /tmp
+      commands:
+        - echo run
+    cmd:
+      exec: ["app"]
+`,
+	})
+
+	_, err := core.BuildRecipe(path, "amd64", core.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(filepath.Join(filepath.Dir(path), "Containerfile"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `# Stage: app
+FROM debian:sid-slim AS app
+SHELL ["/bin/bash","-c"]
+WORKDIR /app
+WORKDIR /tmp
+RUN echo run
+WORKDIR /app
+VOLUME ["/data","/var/log/app"]
+USER app:app
+HEALTHCHECK --interval=30s --retries=3 CMD ["curl","-f","http://localhost/"]
+STOPSIGNAL SIGTERM
+CMD ["app"]
+`
+	if string(content) != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, content)
+	}
+}
+
+// Test that caches are mounted on the module commands and that the
+// cleanup leaves them alone
+func TestBuildCacheMounts(t *testing.T) {
+	path := writeRecipeFiles(t, map[string]string{
+		"recipe.yml": `name: Test
+id: test
+vibversion: 1.0.0
+stages:
+  - id: build
+    base: debian:sid-slim
+    cache:
+      - target: /var/cache/pip
+    cleanup:
+      - /var/cache
+      - /var/cache/pip/http
+      - /tmp/build
+    runs:
+      commands:
+        - echo run
+    modules:
+      - name: npm
+        type: shell
+        cache:
+          - target: /root/.npm
+            id: npm
+            sharing: locked
+        commands:
+          - npm ci
+`,
+	})
+
+	_, err := core.BuildRecipe(path, "amd64", core.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(filepath.Join(filepath.Dir(path), "Containerfile"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cleanup := ` && rm -rf /tmp/build && { [ ! -d '/var/cache' ] || find '/var/cache' -mindepth 1 \( -path '/var/cache/pip' \) -prune -o -prune -exec rm -rf {} +; }`
+	for _, expected := range []string{
+		"RUN --mount=type=cache,target=/var/cache/pip,id=vib-amd64/var/cache/pip echo run" + cleanup + "\n",
+		"RUN --mount=source=sources/npm,target=/sources/npm,rw --mount=type=cache,target=/var/cache/pip,id=vib-amd64/var/cache/pip --mount=type=cache,target=/root/.npm,id=npm,sharing=locked npm ci" + cleanup + "\n",
+	} {
+		if !hasLines(string(content), expected) {
+			t.Errorf("expected %q in the Containerfile:\n%s", expected, content)
+		}
+	}
+}
+
+// Test that the secrets of the recipe are mounted on the runs of the
+// stages and on all the modules, those of a module on the module only,
+// and that conflicting declarations are rejected
+func TestBuildSecrets(t *testing.T) {
+	recipe := `name: Test
+id: test
+vibversion: 1.0.0
+secrets:
+  mirror-token:
+    env: MIRROR_TOKEN
+stages:
+  - id: build
+    base: debian:sid-slim
+    runs:
+      commands:
+        - echo runs
+    modules:
+      - name: private
+        type: shell
+        secrets:
+          netrc:
+            file: secrets/netrc
+        commands:
+          - cp /run/secrets/netrc /root/.netrc
+      - name: public
+        type: shell
+        commands:
+          - echo public
+`
+	path := writeRecipeFiles(t, map[string]string{"recipe.yml": recipe})
+
+	_, err := core.BuildRecipe(path, "amd64", core.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(filepath.Join(filepath.Dir(path), "Containerfile"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{
+		"RUN --mount=source=sources/private,target=/sources/private,rw --mount=type=secret,id=mirror-token --mount=type=secret,id=netrc cp /run/secrets/netrc /root/.netrc\n",
+		"RUN --mount=source=sources/public,target=/sources/public,rw --mount=type=secret,id=mirror-token echo public\n",
+		"RUN --mount=type=secret,id=mirror-token echo runs\n",
+	} {
+		if !hasLines(string(content), expected) {
+			t.Errorf("expected %q in the Containerfile:\n%s", expected, content)
+		}
+	}
+
+	path = writeRecipeFiles(t, map[string]string{
+		"recipe.yml": strings.Replace(recipe, "          netrc:\n            file: secrets/netrc", "          mirror-token:\n            file: secrets/token", 1),
+	})
+	_, err = core.BuildRecipe(path, "amd64", core.BuildOptions{})
+	if err == nil || !strings.Contains(err.Error(), "secret mirror-token is declared more than once") {
+		t.Errorf("expected an error for the conflicting secret, got %v", err)
+	}
+}
+
+// Test that the env and args of a module are exported for its commands
+// only, and inherited by its nested modules
+func TestBuildModuleVariables(t *testing.T) {
+	path := writeRecipeFiles(t, map[string]string{
+		"recipe.yml": `name: Test
+id: test
+vibversion: 1.0.0
+stages:
+  - id: build
+    base: debian:sid-slim
+    modules:
+      - name: parent
+        type: shell
+        env:
+          CFLAGS: -O2 -g
+          PY: 3.10
+        args:
+          JOBS: 4
+        commands:
+          - make -j$JOBS
+        modules:
+          - name: child
+            type: shell
+            env:
+              CFLAGS: -O0
+            commands:
+              - make
+      - name: other
+        type: shell
+        commands:
+          - echo other
+  - id: final
+    base: debian:sid-slim
+    singlelayer: true
+    modules:
+      - name: first
+        type: shell
+        env:
+          NAME: it's
+        commands:
+          - echo $NAME
+      - name: second
+        type: shell
+        commands:
+          - echo second
+`,
+	})
+
+	_, err := core.BuildRecipe(path, "amd64", core.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(filepath.Join(filepath.Dir(path), "Containerfile"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{
+		"RUN --mount=source=sources/child,target=/sources/child,rw export JOBS='4' CFLAGS='-O0' PY='3.10' && make\n",
+		"RUN --mount=source=sources/parent,target=/sources/parent,rw export JOBS='4' CFLAGS='-O2 -g' PY='3.10' && make -j$JOBS\n",
+		"RUN --mount=source=sources/other,target=/sources/other,rw echo other\n",
+		"# Begin Module first - shell\n(\nexport NAME='it'\\''s'\necho $NAME\n)\n# End Module first - shell\n# Begin Module second - shell\necho second\n",
+	} {
+		if !hasLines(string(content), expected) {
+			t.Errorf("expected %q in the Containerfile:\n%s", expected, content)
+		}
+	}
+
+	path = writeRecipeFiles(t, map[string]string{
+		"recipe.yml": `name: Test
+id: test
+vibversion: 1.0.0
+stages:
+  - id: build
+    base: debian:sid-slim
+    modules:
+      - name: invalid
+        type: shell
+        env:
+          NOT-A-NAME: value
+        commands:
+          - true
+`,
+	})
+	_, err = core.BuildRecipe(path, "amd64", core.BuildOptions{})
+	if err == nil || !strings.Contains(err.Error(), `invalid variable name "NOT-A-NAME"`) {
+		t.Errorf("expected an error for the invalid variable name, got %v", err)
+	}
+
+	path = writeRecipeFiles(t, map[string]string{
+		"recipe.yml": `name: Test
+id: test
+vibversion: 1.0.0
+stages:
+  - id: build
+    base: debian:sid-slim
+    modules:
+      - name: empty
+        type: shell
+        env:
+          EMPTY:
+        commands:
+          - true
+`,
+	})
+	_, err = core.BuildRecipe(path, "amd64", core.BuildOptions{})
+	if err == nil || !strings.Contains(err.Error(), "recipe.yml:11:11: stage build → module empty: env EMPTY has no value") {
+		t.Errorf("expected a located error for the variable with no value, got %v", err)
+	}
+}
+
+// Test that shell modules with a script, a shell or several commands are
+// written as a heredoc script reporting the failing command
+func TestBuildShellScript(t *testing.T) {
+	path := writeRecipeFiles(t, map[string]string{
+		"recipe.yml": `name: Test
+id: test
+vibversion: 1.0.0
+stages:
+  - id: build
+    base: debian:sid-slim
+    modules:
+      - name: setup
+        type: shell
+        script: scripts/setup.sh
+        shell: bash
+        strict: true
+        commands:
+          - |
+            for f in a b; do
+              echo "$f"
+            done
+      - name: invalid
+        type: shell
+        shell: zsh
+        commands:
+          - echo invalid
+`,
+		"scripts/setup.sh": "echo setup\n",
+	})
+
+	_, err := core.BuildRecipe(path, "amd64", core.BuildOptions{})
+	if err == nil || !strings.Contains(err.Error(), "invalid shell zsh, expected sh or bash") {
+		t.Fatalf("expected an error for the invalid shell, got %v", err)
+	}
+
+	recipe, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path, []byte(strings.Split(string(recipe), "      - name: invalid")[0]), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = core.BuildRecipe(path, "amd64", core.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(filepath.Join(filepath.Dir(path), "Containerfile"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `RUN --mount=source=sources/setup,target=/sources/setup,rw <<'EOF'
+#!/bin/bash
+set -euo pipefail
+trap '[ $? -eq 0 ] || echo "Command failed: $vib_command" >&2' EXIT
+vib_command='bash -euo pipefail '\''/sources/setup/setup.sh'\'''
+bash -euo pipefail '/sources/setup/setup.sh'
+vib_command='for f in a b; do
+  echo "$f"
+done'
+for f in a b; do
+  echo "$f"
+done
+trap - EXIT
+EOF
+`
+	if !hasLines(string(content), expected) {
+		t.Errorf("expected %q in the Containerfile:\n%s", expected, content)
+	}
+	script, err := os.ReadFile(filepath.Join(filepath.Dir(path), "sources", "setup", "setup.sh"))
+	if err != nil || string(script) != "echo setup\n" {
+		t.Errorf("expected the script in the sources of the module, got %q, %v", script, err)
+	}
+}
+
+// Test that a single command of a strict module is written as a script
+// setting the strict mode instead of inline
+func TestBuildShellModuleStrictSingleCommand(t *testing.T) {
+	recipe := &api.Recipe{DownloadsPath: t.TempDir(), SourcesPath: t.TempDir()}
+	module := map[string]interface{}{
+		"name":     "strict",
+		"type":     "shell",
+		"strict":   true,
+		"commands": []interface{}{"curl -fsSL https://example.com | tar -x"},
+	}
+	instructions, err := core.BuildShellModule(module, recipe, nil, nil, nil, "amd64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(instructions) != 1 {
+		t.Fatalf("expected a single instruction, got %v", instructions)
+	}
+	emitted, err := instructions[0].Emit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `RUN --mount=source=sources/strict,target=/sources/strict,rw <<'EOF'
+#!/bin/sh
+set -eu
+if (set -o pipefail) 2>/dev/null; then set -o pipefail; fi
+trap '[ $? -eq 0 ] || echo "Command failed: $vib_command" >&2' EXIT
+vib_command='curl -fsSL https://example.com | tar -x'
+curl -fsSL https://example.com | tar -x
+trap - EXIT
+EOF`
+	if emitted != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, emitted)
+	}
+}
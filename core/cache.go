@@ -0,0 +1,120 @@
+package core
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/vanilla-os/vib/api"
+)
+
+// resolveCaches checks the cache declarations and fills in their
+// defaults. A later declaration of the same target replaces the earlier
+// one, so modules can override the caches of their stage and plugin
+func resolveCaches(caches []api.Cache, arch string) ([]api.Cache, error) {
+	resolved := []api.Cache{}
+	index := map[string]int{}
+	for _, cache := range caches {
+		target := filepath.Clean(cache.Target)
+		if !filepath.IsAbs(cache.Target) || strings.ContainsAny(target, ", \t\r\n") {
+			return nil, fmt.Errorf("invalid cache target %q, expected an absolute path", cache.Target)
+		}
+		cache.Target = target
+
+		switch cache.Sharing {
+		case "", "shared", "private", "locked":
+		default:
+			return nil, fmt.Errorf("invalid sharing %q for cache %s, expected shared, private or locked", cache.Sharing, cache.Target)
+		}
+
+		// caches hold architecture specific files, so each
+		// architecture gets its own unless an id is given
+		if cache.Id == "" {
+			cache.Id = fmt.Sprintf("vib-%s%s", arch, cache.Target)
+		}
+		if strings.ContainsAny(cache.Id, ", \t\r\n") {
+			return nil, fmt.Errorf("invalid id %q for cache %s", cache.Id, cache.Target)
+		}
+
+		if i, ok := index[cache.Target]; ok {
+			resolved[i] = cache
+			continue
+		}
+		index[cache.Target] = len(resolved)
+		resolved = append(resolved, cache)
+	}
+	return resolved, nil
+}
+
+// cacheMount returns the RUN flag mounting a cache
+func cacheMount(cache api.Cache) string {
+	mount := fmt.Sprintf("--mount=type=cache,target=%s,id=%s", cache.Target, cache.Id)
+	if cache.Sharing != "" {
+		mount += ",sharing=" + cache.Sharing
+	}
+	return mount
+}
+
+// cleanupSuffix returns the cleanup command to append to a RUN, leaving
+// the mounted caches alone: paths inside a cache are not removed, and
+// the directories containing a cache are emptied around it
+func cleanupSuffix(cleanup []string, caches []api.Cache) string {
+	paths := []string{}
+	finds := []string{}
+	for _, path := range cleanup {
+		clean := filepath.Clean(path)
+		kept := []string{}
+		inside := false
+		for _, cache := range caches {
+			if isWithin(clean, cache.Target) {
+				inside = true
+				break
+			}
+			if isWithin(cache.Target, clean) {
+				kept = append(kept, cache.Target)
+			}
+		}
+		switch {
+		case inside:
+			continue
+		case len(kept) > 0:
+			finds = append(finds, cleanupAround(clean, kept))
+		default:
+			paths = append(paths, path)
+		}
+	}
+
+	suffix := api.GetCleanupSuffix(paths)
+	for _, find := range finds {
+		suffix += " && " + find
+	}
+	return suffix
+}
+
+// cleanupAround empties a directory except for the given caches and the
+// directories leading to them
+func cleanupAround(dir string, caches []string) string {
+	pruned := []string{}
+	kept := []string{}
+	for _, cache := range caches {
+		pruned = append(pruned, "-path "+shellQuote(cache))
+		for parent := filepath.Dir(cache); parent != dir && isWithin(parent, dir); parent = filepath.Dir(parent) {
+			path := "-path " + shellQuote(parent)
+			if !containsString(kept, path) {
+				kept = append(kept, path)
+			}
+		}
+	}
+
+	find := fmt.Sprintf("find %s -mindepth 1 \\( %s \\) -prune", shellQuote(dir), strings.Join(pruned, " -o "))
+	if len(kept) > 0 {
+		find += fmt.Sprintf(" -o \\( %s \\)", strings.Join(kept, " -o "))
+	}
+	// as rm -rf, succeed when there is nothing to clean up
+	return fmt.Sprintf("{ [ ! -d %s ] || %s -o -prune -exec rm -rf {} +; }", shellQuote(dir), find)
+}
+
+// isWithin reports whether path is dir or one of its descendants
+func isWithin(path string, dir string) bool {
+	return path == dir || strings.HasPrefix(path, strings.TrimSuffix(dir, "/")+"/")
+}
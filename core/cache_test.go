@@ -0,0 +1,64 @@
+package core_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/vanilla-os/vib/api"
+	"github.com/vanilla-os/vib/core"
+)
+
+// Test that the caches get their defaults, that a later declaration of a
+// target replaces the earlier one and that invalid caches are rejected
+func TestResolveCaches(t *testing.T) {
+	cases := []struct {
+		caches   []api.Cache
+		expected []api.Cache
+		err      string
+	}{
+		{
+			caches:   []api.Cache{{Target: "/var/cache/apt/"}, {Target: "/root/.cache", Id: "pip", Sharing: "locked"}},
+			expected: []api.Cache{{Target: "/var/cache/apt", Id: "vib-amd64/var/cache/apt"}, {Target: "/root/.cache", Id: "pip", Sharing: "locked"}},
+		},
+		{
+			caches:   []api.Cache{{Target: "/var/cache/apt"}, {Target: "/root/.cache"}, {Target: "/var/cache/apt", Sharing: "private"}},
+			expected: []api.Cache{{Target: "/var/cache/apt", Id: "vib-amd64/var/cache/apt", Sharing: "private"}, {Target: "/root/.cache", Id: "vib-amd64/root/.cache"}},
+		},
+		{caches: []api.Cache{{Target: "var/cache/apt"}}, err: `invalid cache target "var/cache/apt", expected an absolute path`},
+		{caches: []api.Cache{{Target: "/var/cache/a,b"}}, err: `invalid cache target "/var/cache/a,b", expected an absolute path`},
+		{caches: []api.Cache{{Target: "/var/cache/apt", Sharing: "exclusive"}}, err: `invalid sharing "exclusive" for cache /var/cache/apt, expected shared, private or locked`},
+		{caches: []api.Cache{{Target: "/var/cache/apt", Id: "apt cache"}}, err: `invalid id "apt cache" for cache /var/cache/apt`},
+	}
+	for _, c := range cases {
+		resolved, err := core.ResolveCaches(c.caches, "amd64")
+		if c.err != "" {
+			if err == nil || err.Error() != c.err {
+				t.Errorf("%+v: expected the error %q, got %v", c.caches, c.err, err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(resolved, c.expected) {
+			t.Errorf("%+v: expected %+v, got %+v, %v", c.caches, c.expected, resolved, err)
+		}
+	}
+}
+
+// Test that the cleanup leaves the mounted caches alone
+func TestCleanupSuffix(t *testing.T) {
+	caches := []api.Cache{{Target: "/var/cache/apt"}, {Target: "/root/.cache/pip"}}
+	cases := []struct {
+		cleanup  []string
+		expected string
+	}{
+		{nil, ""},
+		{[]string{"/tmp/build", "/var/lib/apt/lists"}, " && rm -rf /tmp/build /var/lib/apt/lists"},
+		{[]string{"/var/cache/apt/archives"}, ""},
+		{[]string{"/var/cache"}, ` && { [ ! -d '/var/cache' ] || find '/var/cache' -mindepth 1 \( -path '/var/cache/apt' \) -prune -o -prune -exec rm -rf {} +; }`},
+		{[]string{"/tmp/build", "/root"}, ` && rm -rf /tmp/build && { [ ! -d '/root' ] || find '/root' -mindepth 1 \( -path '/root/.cache/pip' \) -prune -o \( -path '/root/.cache' \) -o -prune -exec rm -rf {} +; }`},
+	}
+	for _, c := range cases {
+		if got := core.CleanupSuffix(c.cleanup, caches); got != c.expected {
+			t.Errorf("%v: expected %q, got %q", c.cleanup, c.expected, got)
+		}
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	goruntime "runtime"
+	"strings"
 	"syscall"
 
 	"github.com/mitchellh/mapstructure"
@@ -11,22 +13,130 @@ import (
 )
 
 // Compile and build the recipe using the specified runtime
-func CompileRecipe(recipePath string, arch string, runtime string, isRoot bool, origGid int, origUid int, containerfilePath string) error {
-	recipe, err := BuildRecipe(recipePath, arch, containerfilePath)
+func CompileRecipe(recipePath string, arch string, runtime string, isRoot bool, origGid int, origUid int, options BuildOptions) error {
+	recipe, err := BuildRecipe(recipePath, arch, options)
 	if err != nil {
 		return err
 	}
 
+	err = compileImage(recipe, runtime, origGid, origUid, "", "", false)
+	if err != nil {
+		return err
+	}
+
+	err = finalizeRecipe(recipe, arch, runtime, isRoot, origGid, origUid)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Image %s built successfully using %s\n", recipe.Id, runtime)
+
+	return nil
+}
+
+// Compile the recipe for each of the given platforms, in the os/arch or
+// os/arch/variant form. The recipe is loaded once and each platform gets
+// its own Containerfile, named after the platform, and with podman the
+// images are assembled in a manifest list tagged as the recipe
+func CompileRecipePlatforms(recipePath string, platforms []string, runtime string, isRoot bool, origGid int, origUid int, options BuildOptions) error {
+	if len(platforms) == 0 {
+		return fmt.Errorf("no platform specified")
+	}
+	if runtime == "docker" && len(platforms) > 1 {
+		return fmt.Errorf("docker cannot assemble a manifest list from local images, use podman to compile for several platforms")
+	}
+
+	for _, platform := range platforms {
+		_, err := PlatformArch(platform)
+		if err != nil {
+			return err
+		}
+	}
+
+	containerfilePath := options.Containerfile
+	if containerfilePath == "" {
+		containerfilePath = "Containerfile"
+	}
+
+	recipe, err := loadBuildRecipe(recipePath, options)
+	if err != nil {
+		return err
+	}
+
+	// the finalize modules run once, on the manifest list when there
+	// is one, with the recipe and architecture of the first platform
+	var firstRecipe api.Recipe
+	firstArch := ""
+	manifest := ""
+	for i, platform := range platforms {
+		arch, _ := PlatformArch(platform)
+		checkEmulation(arch)
+
+		fmt.Printf("Compiling for platform %s\n", platform)
+		err = buildRecipeContainerfile(recipe, recipePath, arch, PlatformContainerfile(containerfilePath, platform))
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			firstRecipe, firstArch = *recipe, arch
+		}
+
+		// the manifest list replaces the image or the manifest list of
+		// the previous compile
+		if runtime == "podman" {
+			manifest = fmt.Sprintf("localhost/%s", recipe.Id)
+		}
+		err = compileImage(*recipe, runtime, origGid, origUid, platform, manifest, i == 0)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = finalizeRecipe(firstRecipe, firstArch, runtime, isRoot, origGid, origUid)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Image %s built successfully using %s for %s\n", recipe.Id, runtime, strings.Join(platforms, ", "))
+
+	return nil
+}
+
+// PlatformContainerfile returns the path of the Containerfile of a
+// platform, the given path suffixed with the platform
+func PlatformContainerfile(containerfilePath string, platform string) string {
+	return containerfilePath + "." + strings.ReplaceAll(platform, "/", "-")
+}
+
+// Build the image of the recipe through the runtime, for the given
+// platform if any. With a manifest, replaceManifest removes the manifest
+// list or the image it names first, in the storage the build uses
+func compileImage(recipe api.Recipe, runtime string, origGid int, origUid int, platform string, manifest string, replaceManifest bool) error {
+	var err error
+
 	syscall.Setegid(0)
 	syscall.Seteuid(0)
+	// drop the privileges again however the build ends, the gid first
+	// since changing it requires root
+	defer func() {
+		syscall.Setegid(origGid)
+		syscall.Seteuid(origUid)
+	}()
+
 	switch runtime {
 	case "docker":
-		err = compileDocker(recipe, origGid, origUid)
+		err = compileDocker(recipe, origGid, origUid, platform)
 		if err != nil {
 			return err
 		}
 	case "podman":
-		err = compilePodman(recipe, origGid, origUid)
+		if manifest != "" && replaceManifest {
+			err = removeManifest(manifest)
+			if err != nil {
+				return err
+			}
+		}
+		err = compilePodman(recipe, origGid, origUid, platform, manifest)
 		if err != nil {
 			return err
 		}
@@ -35,9 +145,12 @@ func CompileRecipe(recipePath string, arch string, runtime string, isRoot bool,
 	default:
 		return fmt.Errorf("no runtime specified and the prometheus library is not implemented yet")
 	}
-	syscall.Setegid(origGid)
-	syscall.Seteuid(origUid)
 
+	return nil
+}
+
+// Run the finalize plugins of the recipe on the built image
+func finalizeRecipe(recipe api.Recipe, arch string, runtime string, isRoot bool, origGid int, origUid int) error {
 	for _, finalizeInterface := range recipe.Finalize {
 		var module Finalize
 
@@ -50,25 +163,36 @@ func CompileRecipe(recipePath string, arch string, runtime string, isRoot bool,
 			return err
 		}
 	}
-
-	fmt.Printf("Image %s built successfully using %s\n", recipe.Id, runtime)
-
 	return nil
 }
 
 // Build an OCI image using the specified recipe through Docker
-func compileDocker(recipe api.Recipe, gid int, uid int) error {
+func compileDocker(recipe api.Recipe, gid int, uid int, platform string) error {
 	docker, err := exec.LookPath("docker")
 	if err != nil {
 		return err
 	}
 
-	cmd := exec.Command(
-		docker, "build",
+	args := []string{
+		"build",
 		"-t", fmt.Sprintf("localhost/%s", recipe.Id),
 		"-f", recipe.Containerfile,
-		".",
-	)
+	}
+	if platform != "" {
+		args = append(args, "--platform", platform)
+	}
+	// BuildKit pins the image timestamps to this build argument
+	if recipe.SourceDateEpoch != "" {
+		args = append(args, "--build-arg", "SOURCE_DATE_EPOCH="+recipe.SourceDateEpoch)
+	}
+	secrets, err := secretFlags(recipe)
+	if err != nil {
+		return err
+	}
+	args = append(args, secrets...)
+	args = append(args, ".")
+
+	cmd := exec.Command(docker, args...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	cmd.Dir = recipe.ParentPath
@@ -77,21 +201,120 @@ func compileDocker(recipe api.Recipe, gid int, uid int) error {
 }
 
 // Build an OCI image using the specified recipe through Podman
-func compilePodman(recipe api.Recipe, gid int, uid int) error {
+func compilePodman(recipe api.Recipe, gid int, uid int, platform string, manifest string) error {
 	podman, err := exec.LookPath("podman")
 	if err != nil {
 		return err
 	}
 
-	cmd := exec.Command(
-		podman, "build",
-		"-t", fmt.Sprintf("localhost/%s", recipe.Id),
-		"-f", recipe.Containerfile,
-		".",
-	)
+	args := []string{"build", "-f", recipe.Containerfile}
+	if platform != "" {
+		args = append(args, "--platform", platform)
+	}
+	// each platform gets its own tag, the recipe tag names the
+	// manifest list gathering them
+	if manifest != "" {
+		args = append(args,
+			"-t", fmt.Sprintf("localhost/%s:%s", recipe.Id, strings.ReplaceAll(platform, "/", "-")),
+			"--manifest", manifest,
+		)
+	} else {
+		args = append(args, "-t", fmt.Sprintf("localhost/%s", recipe.Id))
+	}
+	// pin the creation date of the image and of its layers
+	if recipe.SourceDateEpoch != "" {
+		args = append(args, "--timestamp", recipe.SourceDateEpoch)
+	}
+	secrets, err := secretFlags(recipe)
+	if err != nil {
+		return err
+	}
+	args = append(args, secrets...)
+	args = append(args, ".")
+
+	cmd := exec.Command(podman, args...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	cmd.Dir = recipe.ParentPath
 
 	return cmd.Run()
 }
+
+// Remove the manifest list of a previous compile, podman would add the
+// new images to it otherwise, or the image of a compile for a single
+// platform, which podman cannot turn into a manifest list
+func removeManifest(manifest string) error {
+	podman, err := exec.LookPath("podman")
+	if err != nil {
+		return err
+	}
+	var cmd *exec.Cmd
+	switch {
+	case exec.Command(podman, "manifest", "exists", manifest).Run() == nil:
+		cmd = exec.Command(podman, "manifest", "rm", manifest)
+	case exec.Command(podman, "image", "exists", manifest).Run() == nil:
+		cmd = exec.Command(podman, "rmi", manifest)
+	default:
+		return nil
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// PlatformArch returns the architecture of a platform in the os/arch or
+// os/arch/variant form, as used by only-arches
+func PlatformArch(platform string) (string, error) {
+	parts := strings.Split(platform, "/")
+	if len(parts) < 2 || len(parts) > 3 {
+		return "", fmt.Errorf("invalid platform %q, expected os/arch or os/arch/variant", platform)
+	}
+	for _, part := range parts {
+		if part == "" || strings.ContainsAny(part, " \t,") {
+			return "", fmt.Errorf("invalid platform %q, expected os/arch or os/arch/variant", platform)
+		}
+	}
+	return parts[1], nil
+}
+
+// Architectures the host runs without emulation, besides its own
+var nativeArches = map[string][]string{
+	"amd64": {"386"},
+	"arm64": {"arm"},
+}
+
+// Names of the qemu-user interpreters registered in binfmt_misc
+var qemuArches = map[string]string{
+	"amd64":    "x86_64",
+	"386":      "i386",
+	"arm64":    "aarch64",
+	"arm":      "arm",
+	"ppc64le":  "ppc64le",
+	"s390x":    "s390x",
+	"riscv64":  "riscv64",
+	"mips64le": "mips64el",
+}
+
+// checkEmulation warns when the commands of a foreign architecture may
+// not run, as qemu-user is not registered in binfmt_misc. The runtime
+// reports the error if they cannot
+func checkEmulation(arch string) {
+	if arch == goruntime.GOARCH {
+		return
+	}
+	for _, native := range nativeArches[goruntime.GOARCH] {
+		if arch == native {
+			return
+		}
+	}
+
+	qemuArch, ok := qemuArches[arch]
+	if !ok {
+		fmt.Printf("WARN: no emulation known for architecture %s, the build may fail\n", arch)
+		return
+	}
+	content, err := os.ReadFile("/proc/sys/fs/binfmt_misc/qemu-" + qemuArch)
+	if err != nil || !strings.HasPrefix(string(content), "enabled") {
+		fmt.Printf("WARN: qemu-%s is not registered in binfmt_misc, building for %s on %s may fail: install qemu-user-static (or qemu-user-binfmt)\n", qemuArch, arch, goruntime.GOARCH)
+	}
+}
@@ -0,0 +1,148 @@
+package core_test
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/vanilla-os/vib/core"
+)
+
+// Test that the architecture is taken from platforms in the os/arch and
+// os/arch/variant forms, and that other forms are rejected
+func TestPlatformArch(t *testing.T) {
+	tests := []struct {
+		platform string
+		arch     string
+		valid    bool
+	}{
+		{"linux/amd64", "amd64", true},
+		{"linux/arm64", "arm64", true},
+		{"linux/arm/v7", "arm", true},
+		{"linux", "", false},
+		{"amd64", "", false},
+		{"linux/arm/v7/extra", "", false},
+		{"linux//v7", "", false},
+		{"linux/amd64,linux/arm64", "", false},
+		{"linux/ amd64", "", false},
+	}
+	for _, test := range tests {
+		arch, err := core.PlatformArch(test.platform)
+		if test.valid && (err != nil || arch != test.arch) {
+			t.Errorf("%s: expected %s, got %q, %v", test.platform, test.arch, arch, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: expected an invalid platform, got %q", test.platform, arch)
+		}
+	}
+}
+
+// Test that each platform gets a Containerfile named after it
+func TestPlatformContainerfile(t *testing.T) {
+	tests := []struct {
+		containerfile string
+		platform      string
+		expected      string
+	}{
+		{"Containerfile", "linux/amd64", "Containerfile.linux-amd64"},
+		{"Containerfile", "linux/arm/v7", "Containerfile.linux-arm-v7"},
+		{"build/Containerfile", "linux/arm64", "build/Containerfile.linux-arm64"},
+	}
+	for _, test := range tests {
+		if got := core.PlatformContainerfile(test.containerfile, test.platform); got != test.expected {
+			t.Errorf("%s for %s: expected %s, got %s", test.containerfile, test.platform, test.expected, got)
+		}
+	}
+}
+
+// Test that the platforms are checked before the recipe is loaded, and
+// that docker is limited to a single platform
+func TestCompileRecipePlatformsRejected(t *testing.T) {
+	tests := []struct {
+		runtime   string
+		platforms []string
+		expected  string
+	}{
+		{"docker", []string{"linux/amd64", "linux/arm64"}, "docker cannot assemble a manifest list from local images, use podman to compile for several platforms"},
+		{"podman", nil, "no platform specified"},
+		{"podman", []string{"linux/amd64", "arm64"}, `invalid platform "arm64", expected os/arch or os/arch/variant`},
+	}
+	for _, test := range tests {
+		err := core.CompileRecipePlatforms("recipe.yml", test.platforms, test.runtime, false, 0, 0, core.BuildOptions{})
+		if err == nil || err.Error() != test.expected {
+			t.Errorf("%s %v: expected %q, got %v", test.runtime, test.platforms, test.expected, err)
+		}
+	}
+}
+
+// Test that the recipe is loaded once for all the platforms, each of
+// them getting its Containerfile and keeping the sources of the others
+func TestCompileRecipePlatforms(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	bin := t.TempDir()
+	podman := "#!/bin/sh\ncase \"$1\" in manifest|image) exit 1;; esac\n"
+	err := os.WriteFile(filepath.Join(bin, "podman"), []byte(podman), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	repo := t.TempDir()
+	for _, args := range [][]string{
+		{"init", "-q", "-b", "main"},
+		{"-c", "user.name=vib", "-c", "user.email=vib@localhost", "commit", "-q", "--allow-empty", "-m", "initial"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repo
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %s: %s", args[0], out)
+		}
+	}
+
+	path := writeRecipeFiles(t, map[string]string{
+		"recipe.yml": `name: Test
+id: test
+vibversion: 1.0.0
+stages:
+  - id: build
+    base: debian:sid-slim
+    modules:
+      - name: app
+        type: shell
+        sources:
+          - type: git
+            url: ` + repo + `
+            branch: main
+            path: amd64
+            only-arches:
+              - amd64
+          - type: git
+            url: ` + repo + `
+            branch: main
+            path: arm64
+            only-arches:
+              - arm64
+        commands:
+          - ls /sources/app
+`,
+	})
+
+	err = core.CompileRecipePlatforms(path, []string{"linux/amd64", "linux/arm64"}, "podman", false, os.Getgid(), os.Getuid(), core.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Dir(path)
+	for _, arch := range []string{"amd64", "arm64"} {
+		if _, err := os.Stat(filepath.Join(dir, "Containerfile.linux-"+arch)); err != nil {
+			t.Errorf("expected the Containerfile of %s: %v", arch, err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "sources", "app", arch, ".git")); err != nil {
+			t.Errorf("expected the source of %s in the sources directory: %v", arch, err)
+		}
+	}
+	content, err := os.ReadFile(filepath.Join(dir, "Containerfile.linux-arm64"))
+	if err != nil || !hasLines(string(content), "RUN --mount=source=sources/app,target=/sources/app,rw ls /sources/app\n") {
+		t.Errorf("expected the module in the Containerfile of arm64, got %s, %v", content, err)
+	}
+}
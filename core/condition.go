@@ -0,0 +1,246 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// Context the if: conditions of stages and modules are evaluated in
+type ConditionContext struct {
+	Arch string
+	Vars map[string]string
+}
+
+// EvaluateCondition evaluates an if: expression. The expression compares
+// strings with == and != and combines the results with &&, || and !,
+// grouped by parentheses. The values are string literals in single or
+// double quotes, true and false, arch, vars.<name> for recipe variables
+// and env.<name> for environment variables. A value used as a condition
+// is true unless it is empty or "false"
+func EvaluateCondition(expression string, context ConditionContext) (bool, error) {
+	tokens, err := tokenizeCondition(expression)
+	if err != nil {
+		return false, fmt.Errorf("invalid condition %q: %w", expression, err)
+	}
+
+	parser := &conditionParser{tokens: tokens, context: context}
+	value, err := parser.parseOr()
+	if err == nil && parser.pos < len(parser.tokens) {
+		err = fmt.Errorf("unexpected %s", parser.tokens[parser.pos])
+	}
+	if err != nil {
+		return false, fmt.Errorf("invalid condition %q: %w", expression, err)
+	}
+
+	return isTruthy(value), nil
+}
+
+type conditionTokenKind int
+
+const (
+	conditionOperator conditionTokenKind = iota
+	conditionString
+	conditionIdentifier
+)
+
+type conditionToken struct {
+	kind  conditionTokenKind
+	value string
+}
+
+func (t conditionToken) String() string {
+	if t.kind == conditionString {
+		return fmt.Sprintf("%q", t.value)
+	}
+	return t.value
+}
+
+// tokenizeCondition splits an expression into operators, string
+// literals and identifiers
+func tokenizeCondition(expression string) ([]conditionToken, error) {
+	tokens := []conditionToken{}
+	runes := []rune(expression)
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(' || r == ')':
+			tokens = append(tokens, conditionToken{conditionOperator, string(r)})
+			i++
+		case r == '"' || r == '\'':
+			end := i + 1
+			for end < len(runes) && runes[end] != r {
+				end++
+			}
+			if end == len(runes) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			tokens = append(tokens, conditionToken{conditionString, string(runes[i+1 : end])})
+			i = end + 1
+		case i+1 < len(runes) && (string(runes[i:i+2]) == "==" || string(runes[i:i+2]) == "!=" ||
+			string(runes[i:i+2]) == "&&" || string(runes[i:i+2]) == "||"):
+			tokens = append(tokens, conditionToken{conditionOperator, string(runes[i : i+2])})
+			i += 2
+		case r == '!':
+			tokens = append(tokens, conditionToken{conditionOperator, "!"})
+			i++
+		case isIdentifierRune(r):
+			end := i
+			for end < len(runes) && isIdentifierRune(runes[end]) {
+				end++
+			}
+			tokens = append(tokens, conditionToken{conditionIdentifier, string(runes[i:end])})
+			i = end
+		default:
+			return nil, fmt.Errorf("unexpected character %q", r)
+		}
+	}
+
+	return tokens, nil
+}
+
+func isIdentifierRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '.' || r == '-'
+}
+
+func isTruthy(value string) bool {
+	return value != "" && value != "false"
+}
+
+func conditionResult(result bool) string {
+	if result {
+		return "true"
+	}
+	return "false"
+}
+
+// recursive descent parser evaluating the expression as it goes
+type conditionParser struct {
+	tokens  []conditionToken
+	pos     int
+	context ConditionContext
+}
+
+// accept consumes the next token if it is the given operator
+func (p *conditionParser) accept(operator string) bool {
+	if p.pos < len(p.tokens) && p.tokens[p.pos].kind == conditionOperator && p.tokens[p.pos].value == operator {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *conditionParser) parseOr() (string, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return "", err
+	}
+	for p.accept("||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return "", err
+		}
+		left = conditionResult(isTruthy(left) || isTruthy(right))
+	}
+	return left, nil
+}
+
+func (p *conditionParser) parseAnd() (string, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return "", err
+	}
+	for p.accept("&&") {
+		right, err := p.parseNot()
+		if err != nil {
+			return "", err
+		}
+		left = conditionResult(isTruthy(left) && isTruthy(right))
+	}
+	return left, nil
+}
+
+func (p *conditionParser) parseNot() (string, error) {
+	if p.accept("!") {
+		value, err := p.parseNot()
+		if err != nil {
+			return "", err
+		}
+		return conditionResult(!isTruthy(value)), nil
+	}
+	return p.parseComparison()
+}
+
+func (p *conditionParser) parseComparison() (string, error) {
+	left, err := p.parseValue()
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case p.accept("=="):
+		right, err := p.parseValue()
+		if err != nil {
+			return "", err
+		}
+		return conditionResult(left == right), nil
+	case p.accept("!="):
+		right, err := p.parseValue()
+		if err != nil {
+			return "", err
+		}
+		return conditionResult(left != right), nil
+	}
+	return left, nil
+}
+
+func (p *conditionParser) parseValue() (string, error) {
+	if p.pos >= len(p.tokens) {
+		return "", fmt.Errorf("unexpected end of expression")
+	}
+
+	if p.accept("(") {
+		value, err := p.parseOr()
+		if err != nil {
+			return "", err
+		}
+		if !p.accept(")") {
+			return "", fmt.Errorf("missing )")
+		}
+		return value, nil
+	}
+
+	token := p.tokens[p.pos]
+	switch token.kind {
+	case conditionString:
+		p.pos++
+		return token.value, nil
+	case conditionIdentifier:
+		p.pos++
+		return p.resolve(token.value)
+	}
+	return "", fmt.Errorf("unexpected %s", token)
+}
+
+// resolve returns the value of an identifier
+func (p *conditionParser) resolve(identifier string) (string, error) {
+	switch {
+	case identifier == "true" || identifier == "false":
+		return identifier, nil
+	case identifier == "arch":
+		return p.context.Arch, nil
+	case strings.HasPrefix(identifier, "vars."):
+		name := strings.TrimPrefix(identifier, "vars.")
+		value, ok := p.context.Vars[name]
+		if !ok {
+			return "", fmt.Errorf("unknown variable %s", name)
+		}
+		return value, nil
+	case strings.HasPrefix(identifier, "env."):
+		return os.Getenv(strings.TrimPrefix(identifier, "env.")), nil
+	}
+	return "", fmt.Errorf("unknown identifier %s, expected arch, vars.<name> or env.<name>", identifier)
+}
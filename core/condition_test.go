@@ -0,0 +1,123 @@
+package core_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/vanilla-os/vib/core"
+)
+
+// Test the evaluation of if: expressions
+func TestEvaluateCondition(t *testing.T) {
+	t.Setenv("VIB_TEST_CI", "1")
+	context := core.ConditionContext{Arch: "arm64", Vars: map[string]string{"edition": "desktop", "debug": "false"}}
+
+	tests := map[string]bool{
+		`arch == "arm64"`: true,
+		`arch == 'amd64'`: false,
+		`arch == "arm64" && vars.edition != "server"`:    true,
+		`arch == "amd64" || vars.edition == "desktop"`:   true,
+		`!(arch == "arm64" || vars.edition == "server")`: false,
+		`vars.debug`:                            false,
+		`!vars.debug && env.VIB_TEST_CI == "1"`: true,
+		`env.VIB_TEST_UNSET`:                    false,
+		`true`:                                  true,
+	}
+	for expression, expected := range tests {
+		result, err := core.EvaluateCondition(expression, context)
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", expression, err)
+		} else if result != expected {
+			t.Errorf("%s: expected %t, got %t", expression, expected, result)
+		}
+	}
+
+	for _, expression := range []string{`arch ==`, `(arch == "arm64"`, `vars.missing == "x"`, `platform == "x"`, `arch = "arm64"`} {
+		if _, err := core.EvaluateCondition(expression, context); err == nil {
+			t.Errorf("%s: expected an error", expression)
+		}
+	}
+}
+
+// Test that stages and modules whose condition is false are skipped
+func TestBuildConditions(t *testing.T) {
+	path := writeRecipeFiles(t, map[string]string{
+		"recipe.yml": `name: Test
+id: test
+vibversion: 1.0.0
+vars:
+  edition: server
+stages:
+  - id: build
+    base: debian:sid-slim
+    modules:
+      - name: arm
+        type: shell
+        if: arch == "arm64"
+        workdir: /arm
+        commands:
+          - echo arm
+      - name: parent
+        type: shell
+        commands:
+          - echo parent
+        modules:
+          - name: desktop
+            type: shell
+            if: vars.edition == "desktop"
+            commands:
+              - echo desktop
+          - name: included
+            type: includes
+            includes:
+              - modules/server.yml
+  - id: extra
+    base: debian:sid-slim
+    if: vars.edition == "desktop"
+    modules:
+      - name: extra
+        type: shell
+        commands:
+          - echo extra
+`,
+		"modules/server.yml": `name: server
+type: shell
+if: vars.edition == "server" && arch != "arm64"
+commands:
+  - echo server
+`,
+	})
+
+	if errs, err := core.ValidateRecipeSchema(path, nil); err != nil || len(errs) > 0 {
+		t.Fatalf("unexpected schema errors %v %v", errs, err)
+	}
+
+	_, err := core.BuildRecipe(path, "amd64", core.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(filepath.Join(filepath.Dir(path), "Containerfile"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	containerfile := string(content)
+
+	for _, expected := range []string{
+		`# Skipped Module arm - shell - if: arch == "arm64"`,
+		`# Skipped Module desktop - shell - if: vars.edition == "desktop"`,
+		`# Skipped Stage: extra - if: vars.edition == "desktop"`,
+		"echo server",
+	} {
+		if !strings.Contains(containerfile, expected) {
+			t.Errorf("expected the Containerfile to contain %q:\n%s", expected, containerfile)
+		}
+	}
+	for _, unexpected := range []string{"echo arm", "WORKDIR /arm", "echo desktop", "echo extra"} {
+		if strings.Contains(containerfile, unexpected) {
+			t.Errorf("expected the Containerfile not to contain %q:\n%s", unexpected, containerfile)
+		}
+	}
+}
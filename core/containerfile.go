@@ -0,0 +1,535 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/vanilla-os/vib/api"
+)
+
+// Instruction of a Containerfile. Each instruction type knows how its
+// values must be quoted, Emit fails on values the Containerfile syntax
+// cannot represent
+type Instruction interface {
+	Emit() (string, error)
+}
+
+// Containerfile made of typed instructions, emitted in order
+type Containerfile struct {
+	Instructions []Instruction
+}
+
+// Add appends instructions to the Containerfile
+func (c *Containerfile) Add(instructions ...Instruction) {
+	c.Instructions = append(c.Instructions, instructions...)
+}
+
+// Emit returns the text of the Containerfile, one instruction per line
+// or per heredoc
+func (c *Containerfile) Emit() (string, error) {
+	var text strings.Builder
+	for _, instruction := range c.Instructions {
+		line, err := instruction.Emit()
+		if err != nil {
+			return "", err
+		}
+		text.WriteString(line)
+		text.WriteString("\n")
+	}
+	return text.String(), nil
+}
+
+// Empty line, used to separate groups of instructions
+type BlankLine struct{}
+
+func (BlankLine) Emit() (string, error) {
+	return "", nil
+}
+
+// Comment, each line of the text is commented out
+type CommentInstruction struct {
+	Text string
+}
+
+func (i CommentInstruction) Emit() (string, error) {
+	lines := strings.Split(strings.TrimRight(i.Text, "\n"), "\n")
+	for j, line := range lines {
+		lines[j] = strings.TrimRight("# "+line, " ")
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// FROM instruction, Name is the optional stage name
+type FromInstruction struct {
+	Image string
+	Name  string
+}
+
+func (i FromInstruction) Emit() (string, error) {
+	err := checkWord("FROM", i.Image)
+	if err != nil {
+		return "", err
+	}
+	if i.Name == "" {
+		return "FROM " + i.Image, nil
+	}
+	err = checkWord("FROM", i.Name)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("FROM %s AS %s", i.Image, i.Name), nil
+}
+
+// LABEL instruction
+type LabelInstruction struct {
+	Key   string
+	Value string
+}
+
+// label keys made of these characters need no quoting
+var plainLabelKey = regexp.MustCompile(`^[A-Za-z0-9._/-]+$`)
+
+func (i LabelInstruction) Emit() (string, error) {
+	key := i.Key
+	if !plainLabelKey.MatchString(key) {
+		var err error
+		key, err = quoteLiteral("LABEL", key)
+		if err != nil {
+			return "", err
+		}
+	}
+	value, err := quoteLiteral("LABEL "+i.Key, i.Value)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("LABEL %s=%s", key, value), nil
+}
+
+// ENV instruction
+type EnvInstruction struct {
+	Key   string
+	Value string
+}
+
+func (i EnvInstruction) Emit() (string, error) {
+	err := checkVariableName("ENV", i.Key)
+	if err != nil {
+		return "", err
+	}
+	value, err := quoteValue("ENV "+i.Key, i.Value)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("ENV %s=%s", i.Key, value), nil
+}
+
+// ARG instruction, an empty value declares the argument without a
+// default value
+type ArgInstruction struct {
+	Key   string
+	Value string
+}
+
+func (i ArgInstruction) Emit() (string, error) {
+	err := checkVariableName("ARG", i.Key)
+	if err != nil {
+		return "", err
+	}
+	if i.Value == "" {
+		return "ARG " + i.Key, nil
+	}
+	value, err := quoteValue("ARG "+i.Key, i.Value)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("ARG %s=%s", i.Key, value), nil
+}
+
+// EXPOSE instruction, Port may carry a protocol as in 8080/tcp
+type ExposeInstruction struct {
+	Port string
+}
+
+func (i ExposeInstruction) Emit() (string, error) {
+	err := checkWord("EXPOSE", i.Port)
+	if err != nil {
+		return "", err
+	}
+	return "EXPOSE " + i.Port, nil
+}
+
+// COPY instruction, From is the optional stage or image to copy from
+type CopyInstruction struct {
+	From    string
+	Sources []string
+	Dest    string
+}
+
+func (i CopyInstruction) Emit() (string, error) {
+	var flags []string
+	if i.From != "" {
+		err := checkWord("COPY --from", i.From)
+		if err != nil {
+			return "", err
+		}
+		flags = append(flags, "--from="+i.From)
+	}
+	return emitFileInstruction("COPY", flags, i.Sources, i.Dest)
+}
+
+// ADD instruction
+type AddInstruction struct {
+	Sources []string
+	Dest    string
+}
+
+func (i AddInstruction) Emit() (string, error) {
+	return emitFileInstruction("ADD", nil, i.Sources, i.Dest)
+}
+
+// WORKDIR instruction
+type WorkdirInstruction struct {
+	Path string
+}
+
+func (i WorkdirInstruction) Emit() (string, error) {
+	if i.Path == "" || strings.ContainsAny(i.Path, "\r\n") {
+		return "", fmt.Errorf("WORKDIR: invalid path %q", i.Path)
+	}
+	return "WORKDIR " + i.Path, nil
+}
+
+// RUN instruction. Flags such as --mount are written before the
+// command, followed by the cache mounts, commands spanning several
+// lines are written as a heredoc. The variables are exported for the
+// command only, inline or as the first line of the heredoc. A command
+// with a shell is always written as a heredoc, starting with its shebang
+type RunInstruction struct {
+	Flags   []string
+	Caches  []api.Cache
+	Env     []RunVariable
+	Shell   string
+	Command string
+}
+
+// Variable exported for the command of a RUN instruction
+type RunVariable struct {
+	Key   string
+	Value string
+}
+
+func (i RunInstruction) Emit() (string, error) {
+	parts := []string{"RUN"}
+	for _, flag := range i.Flags {
+		err := checkWord("RUN", flag)
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, flag)
+	}
+	for _, cache := range i.Caches {
+		mount := cacheMount(cache)
+		err := checkWord("RUN", mount)
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, mount)
+	}
+
+	command := strings.TrimRight(i.Command, "\n")
+	if strings.TrimSpace(command) == "" {
+		return "", fmt.Errorf("RUN: empty command")
+	}
+	exports, err := exportVariables(i.Env)
+	if err != nil {
+		return "", err
+	}
+
+	// a trailing backslash would continue the instruction on the
+	// next line, a heredoc keeps it inside the command
+	if i.Shell == "" && !strings.Contains(exports+command, "\n") && !strings.HasSuffix(command, "\\") {
+		if exports != "" {
+			command = exports + " && " + command
+		}
+		return strings.Join(append(parts, command), " "), nil
+	}
+	if exports != "" {
+		command = exports + "\n" + command
+	}
+	if i.Shell != "" {
+		if strings.ContainsAny(i.Shell, " \t\r\n") {
+			return "", fmt.Errorf("RUN: invalid shell %q", i.Shell)
+		}
+		command = "#!" + i.Shell + "\n" + command
+	}
+
+	delimiter := heredocDelimiter(command)
+	parts = append(parts, "<<'"+delimiter+"'")
+	return fmt.Sprintf("%s\n%s\n%s", strings.Join(parts, " "), command, delimiter), nil
+}
+
+// exportVariables returns the export command setting the variables, or
+// an empty string when there are none
+func exportVariables(variables []RunVariable) (string, error) {
+	if len(variables) == 0 {
+		return "", nil
+	}
+	parts := []string{"export"}
+	for _, variable := range variables {
+		err := checkVariableName("RUN", variable.Key)
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, variable.Key+"="+shellQuote(variable.Value))
+	}
+	return strings.Join(parts, " "), nil
+}
+
+// CMD instruction, always written in the exec form
+type CmdInstruction struct {
+	Exec []string
+}
+
+func (i CmdInstruction) Emit() (string, error) {
+	exec, err := jsonArray(i.Exec)
+	if err != nil {
+		return "", fmt.Errorf("CMD: %w", err)
+	}
+	return "CMD " + exec, nil
+}
+
+// ENTRYPOINT instruction, always written in the exec form
+type EntrypointInstruction struct {
+	Exec []string
+}
+
+func (i EntrypointInstruction) Emit() (string, error) {
+	exec, err := jsonArray(i.Exec)
+	if err != nil {
+		return "", fmt.Errorf("ENTRYPOINT: %w", err)
+	}
+	return "ENTRYPOINT " + exec, nil
+}
+
+// USER instruction, User may carry a group as in user:group
+type UserInstruction struct {
+	User string
+}
+
+func (i UserInstruction) Emit() (string, error) {
+	err := checkWord("USER", i.User)
+	if err != nil {
+		return "", err
+	}
+	return "USER " + i.User, nil
+}
+
+// VOLUME instruction, always written in the exec form
+type VolumeInstruction struct {
+	Paths []string
+}
+
+func (i VolumeInstruction) Emit() (string, error) {
+	paths, err := jsonArray(i.Paths)
+	if err != nil {
+		return "", fmt.Errorf("VOLUME: %w", err)
+	}
+	return "VOLUME " + paths, nil
+}
+
+// HEALTHCHECK instruction, Disable writes HEALTHCHECK NONE, disabling
+// the health check inherited from the base image
+type HealthcheckInstruction struct {
+	Test        []string
+	Interval    string
+	Timeout     string
+	StartPeriod string
+	Retries     int
+	Disable     bool
+}
+
+func (i HealthcheckInstruction) Emit() (string, error) {
+	if i.Disable {
+		return "HEALTHCHECK NONE", nil
+	}
+
+	parts := []string{"HEALTHCHECK"}
+	for _, option := range []struct{ name, value string }{
+		{"interval", i.Interval},
+		{"timeout", i.Timeout},
+		{"start-period", i.StartPeriod},
+	} {
+		if option.value == "" {
+			continue
+		}
+		err := checkWord("HEALTHCHECK --"+option.name, option.value)
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, fmt.Sprintf("--%s=%s", option.name, option.value))
+	}
+	if i.Retries < 0 {
+		return "", fmt.Errorf("HEALTHCHECK: invalid retries %d", i.Retries)
+	}
+	if i.Retries > 0 {
+		parts = append(parts, fmt.Sprintf("--retries=%d", i.Retries))
+	}
+
+	test, err := jsonArray(i.Test)
+	if err != nil {
+		return "", fmt.Errorf("HEALTHCHECK: %w", err)
+	}
+	return strings.Join(append(parts, "CMD", test), " "), nil
+}
+
+// SHELL instruction, the shell running the following RUN instructions
+type ShellInstruction struct {
+	Exec []string
+}
+
+func (i ShellInstruction) Emit() (string, error) {
+	exec, err := jsonArray(i.Exec)
+	if err != nil {
+		return "", fmt.Errorf("SHELL: %w", err)
+	}
+	return "SHELL " + exec, nil
+}
+
+// STOPSIGNAL instruction, as a signal name or number
+type StopSignalInstruction struct {
+	Signal string
+}
+
+func (i StopSignalInstruction) Emit() (string, error) {
+	err := checkWord("STOPSIGNAL", i.Signal)
+	if err != nil {
+		return "", err
+	}
+	return "STOPSIGNAL " + i.Signal, nil
+}
+
+// Instructions written as they are, as returned by plugins producing
+// their own Containerfile instructions
+type RawInstruction struct {
+	Text string
+}
+
+func (i RawInstruction) Emit() (string, error) {
+	return strings.TrimRight(i.Text, "\n"), nil
+}
+
+// emitFileInstruction writes COPY and ADD, in the exec form when one
+// of the paths would not survive the shell-like form
+func emitFileInstruction(name string, flags []string, sources []string, dest string) (string, error) {
+	if len(sources) == 0 || dest == "" {
+		return "", fmt.Errorf("%s: missing source or destination", name)
+	}
+
+	paths := append(append([]string{}, sources...), dest)
+	parts := append([]string{name}, flags...)
+
+	plain := true
+	for _, path := range paths {
+		if path == "" || strings.ContainsAny(path, " \t\r\n\"'\\") {
+			plain = false
+			break
+		}
+	}
+	if plain {
+		return strings.Join(append(parts, paths...), " "), nil
+	}
+
+	exec, err := jsonArray(paths)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", name, err)
+	}
+	return strings.Join(append(parts, exec), " "), nil
+}
+
+// quoteValue double quotes a value of ENV or ARG. Variables are
+// still expanded by the builder, as they are in the Containerfile syntax
+func quoteValue(context string, value string) (string, error) {
+	if strings.ContainsAny(value, "\r\n") {
+		return "", fmt.Errorf("%s: value %q cannot span several lines", context, value)
+	}
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `"`, `\"`)
+	return `"` + value + `"`, nil
+}
+
+// quoteLiteral double quotes a value like quoteValue, escaping $ so the
+// builder does not expand variables. LABEL values have always been
+// written single quoted, hence literal, and recipes rely on it
+func quoteLiteral(context string, value string) (string, error) {
+	quoted, err := quoteValue(context, value)
+	if err != nil {
+		return "", err
+	}
+	return strings.ReplaceAll(quoted, "$", `\$`), nil
+}
+
+// ENV and ARG names, as accepted by the shells running the commands
+var variableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func checkVariableName(context string, name string) error {
+	if !variableName.MatchString(name) {
+		return fmt.Errorf("%s: invalid variable name %q", context, name)
+	}
+	return nil
+}
+
+// checkWord fails on values which would be split or continued when
+// written unquoted
+func checkWord(context string, word string) error {
+	if word == "" || strings.ContainsAny(word, " \t\r\n") || strings.HasSuffix(word, "\\") {
+		return fmt.Errorf("%s: invalid value %q", context, word)
+	}
+	return nil
+}
+
+// jsonArray writes values as a JSON array, as used by the exec form
+func jsonArray(values []string) (string, error) {
+	if len(values) == 0 {
+		return "", fmt.Errorf("empty exec form")
+	}
+	var encoded strings.Builder
+	encoder := json.NewEncoder(&encoded)
+	encoder.SetEscapeHTML(false)
+	err := encoder.Encode(values)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(encoded.String(), "\n"), nil
+}
+
+// heredocDelimiter picks a delimiter which does not appear as a line of
+// the heredoc body
+func heredocDelimiter(body string) string {
+	lines := map[string]bool{}
+	for _, line := range strings.Split(body, "\n") {
+		lines[strings.TrimSpace(line)] = true
+	}
+	delimiter := "EOF"
+	for n := 1; lines[delimiter]; n++ {
+		delimiter = fmt.Sprintf("EOF_%d", n)
+	}
+	return delimiter
+}
+
+// SourcesMount returns the RUN flag mounting the sources of a module
+// at /sources/<module name>
+func SourcesMount(moduleName string) string {
+	return fmt.Sprintf("--mount=source=sources/%s,target=/sources/%s,rw", moduleName, moduleName)
+}
+
+// AddRunFlags adds flags to an instruction written by a plugin, if it is
+// a RUN instruction, such as the secret mounts of the module
+func AddRunFlags(instruction string, flags []string) string {
+	trimmed := strings.TrimLeft(instruction, " \t")
+	if len(flags) == 0 || len(trimmed) < 4 || !strings.EqualFold(trimmed[:4], "RUN ") {
+		return instruction
+	}
+	return trimmed[:4] + strings.Join(flags, " ") + " " + strings.TrimLeft(trimmed[4:], " \t")
+}
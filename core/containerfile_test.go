@@ -0,0 +1,122 @@
+package core_test
+
+import (
+	"testing"
+
+	"github.com/vanilla-os/vib/core"
+)
+
+// Test the quoting of instructions with values that are awkward to write
+// in a Containerfile
+func TestContainerfileQuoting(t *testing.T) {
+	cases := []struct {
+		instruction core.Instruction
+		expected    string
+	}{
+		{core.LabelInstruction{Key: "org.opencontainers.image.title", Value: "Vib"}, `LABEL org.opencontainers.image.title="Vib"`},
+		{core.LabelInstruction{Key: "description", Value: `say "hi" to C:\vib`}, `LABEL description="say \"hi\" to C:\\vib"`},
+		{core.LabelInstruction{Key: "my label", Value: "it's"}, `LABEL "my label"="it's"`},
+		{core.LabelInstruction{Key: "price", Value: "$5 or ${PRICE}"}, `LABEL price="\$5 or \${PRICE}"`},
+		{core.EnvInstruction{Key: "GREETING", Value: "hello world"}, `ENV GREETING="hello world"`},
+		{core.EnvInstruction{Key: "PATH", Value: "$PATH:/opt/bin"}, `ENV PATH="$PATH:/opt/bin"`},
+		{core.ArgInstruction{Key: "VERSION"}, `ARG VERSION`},
+		{core.ArgInstruction{Key: "VERSION", Value: "1.0"}, `ARG VERSION="1.0"`},
+		{core.CmdInstruction{Exec: []string{"sh", "-c", `echo "a\b" > /tmp/<out>`}}, `CMD ["sh","-c","echo \"a\\b\" > /tmp/<out>"]`},
+		{core.EntrypointInstruction{Exec: []string{"/usr/bin/app"}}, `ENTRYPOINT ["/usr/bin/app"]`},
+		{core.CopyInstruction{From: "build", Sources: []string{"/out"}, Dest: "/app"}, `COPY --from=build /out /app`},
+		{core.CopyInstruction{Sources: []string{"my file"}, Dest: "/opt/my dir/"}, `COPY ["my file","/opt/my dir/"]`},
+		{core.AddInstruction{Sources: []string{"includes.container"}, Dest: "/"}, `ADD includes.container /`},
+		{core.RunInstruction{Flags: []string{core.SourcesMount("hello")}, Command: "echo hello"}, `RUN --mount=source=sources/hello,target=/sources/hello,rw echo hello`},
+		{core.RunInstruction{Command: "echo one\necho two"}, "RUN <<'EOF'\necho one\necho two\nEOF"},
+		{core.RunInstruction{Command: "cat <<EOF\nhi\nEOF"}, "RUN <<'EOF_1'\ncat <<EOF\nhi\nEOF\nEOF_1"},
+		{core.RunInstruction{Command: `echo trailing \`}, "RUN <<'EOF'\necho trailing \\\nEOF"},
+		{core.CommentInstruction{Text: "first\nsecond"}, "# first\n# second"},
+		{core.UserInstruction{User: "1000:1000"}, `USER 1000:1000`},
+		{core.VolumeInstruction{Paths: []string{"/data", "/my data"}}, `VOLUME ["/data","/my data"]`},
+		{core.HealthcheckInstruction{Test: []string{"sh", "-c", `test -f "/ready"`}, Timeout: "5s", StartPeriod: "10s"}, `HEALTHCHECK --timeout=5s --start-period=10s CMD ["sh","-c","test -f \"/ready\""]`},
+		{core.HealthcheckInstruction{Disable: true}, `HEALTHCHECK NONE`},
+		{core.ShellInstruction{Exec: []string{"/bin/bash", "-o", "pipefail", "-c"}}, `SHELL ["/bin/bash","-o","pipefail","-c"]`},
+		{core.StopSignalInstruction{Signal: "9"}, `STOPSIGNAL 9`},
+	}
+
+	for _, c := range cases {
+		line, err := c.instruction.Emit()
+		if err != nil {
+			t.Errorf("%#v returned an error: %v", c.instruction, err)
+			continue
+		}
+		if line != c.expected {
+			t.Errorf("%#v: expected %q, got %q", c.instruction, c.expected, line)
+		}
+	}
+}
+
+// Test that values the Containerfile syntax cannot represent are rejected
+func TestContainerfileInvalidValues(t *testing.T) {
+	for _, instruction := range []core.Instruction{
+		core.LabelInstruction{Key: "description", Value: "first\nsecond"},
+		core.EnvInstruction{Key: "MY-VAR", Value: "x"},
+		core.EnvInstruction{Key: "1VAR", Value: "x"},
+		core.ArgInstruction{Key: "A B", Value: "x"},
+		core.FromInstruction{Image: "debian sid"},
+		core.ExposeInstruction{Port: "80\n"},
+		core.WorkdirInstruction{Path: "/a\n/b"},
+		core.RunInstruction{Command: "  "},
+		core.CmdInstruction{},
+		core.CopyInstruction{Sources: []string{"/a"}},
+		core.UserInstruction{User: "my user"},
+		core.HealthcheckInstruction{Interval: "30s"},
+		core.HealthcheckInstruction{Test: []string{"true"}, Retries: -1},
+		core.ShellInstruction{},
+	} {
+		if line, err := instruction.Emit(); err == nil {
+			t.Errorf("expected %#v to be rejected, got %q", instruction, line)
+		}
+	}
+}
+
+// Test that the Containerfile stops at the first invalid instruction
+func TestContainerfileEmit(t *testing.T) {
+	containerfile := core.Containerfile{}
+	containerfile.Add(
+		core.FromInstruction{Image: "debian:sid-slim", Name: "build"},
+		core.BlankLine{},
+		core.EnvInstruction{Key: "A", Value: "b"},
+	)
+	content, err := containerfile.Emit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "FROM debian:sid-slim AS build\n\nENV A=\"b\"\n"
+	if content != expected {
+		t.Errorf("expected %q, got %q", expected, content)
+	}
+
+	containerfile.Add(core.LabelInstruction{Key: "broken", Value: "\n"})
+	if _, err := containerfile.Emit(); err == nil {
+		t.Error("expected an error for the invalid LABEL")
+	}
+}
+
+// Test that the flags are added to the RUN instructions written by the
+// plugins only
+func TestAddRunFlags(t *testing.T) {
+	flags := []string{"--mount=type=secret,id=token"}
+	cases := []struct {
+		instruction string
+		flags       []string
+		expected    string
+	}{
+		{"RUN make install", flags, "RUN --mount=type=secret,id=token make install"},
+		{"run  make install", flags, "run --mount=type=secret,id=token make install"},
+		{"RUN --network=none make", flags, "RUN --mount=type=secret,id=token --network=none make"},
+		{"COPY app /app", flags, "COPY app /app"},
+		{"RUNTIME=1", flags, "RUNTIME=1"},
+		{"RUN make install", nil, "RUN make install"},
+	}
+	for _, c := range cases {
+		if got := core.AddRunFlags(c.instruction, c.flags); got != c.expected {
+			t.Errorf("%q: expected %q, got %q", c.instruction, c.expected, got)
+		}
+	}
+}
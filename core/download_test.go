@@ -0,0 +1,190 @@
+package core_test
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/vanilla-os/vib/api"
+	"github.com/vanilla-os/vib/core"
+)
+
+// Test that a git source pinned to a commit is stored in the download
+// cache, downloaded again when its cache entry is damaged and restored
+// from the cache once its repository is gone, and that pruning removes it
+func TestSourceCache(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	repo := t.TempDir()
+	for _, args := range [][]string{
+		{"init", "-q", "-b", "main"},
+		{"-c", "user.name=vib", "-c", "user.email=vib@localhost", "commit", "-q", "--allow-empty", "-m", "initial"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repo
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %s: %s", args[0], out)
+		}
+	}
+	head, err := exec.Command("git", "-C", repo, "rev-parse", "HEAD").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]string{
+		"recipe.yml": `name: Test
+id: test
+vibversion: 1.0.0
+stages:
+  - id: build
+    base: debian:sid-slim
+    modules:
+      - name: app
+        type: shell
+        sources:
+          - type: git
+            url: ` + repo + `
+            branch: main
+            commit: ` + strings.TrimSpace(string(head)) + `
+            path: repo
+        commands:
+          - ls /sources/app/repo
+`,
+	}
+	_, err = core.BuildRecipe(writeRecipeFiles(t, files), "amd64", core.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := api.ListCache()
+	if err != nil || len(entries) != 1 || entries[0].Ref != strings.TrimSpace(string(head)) {
+		t.Fatalf("expected the source in the cache, got %+v, %v", entries, err)
+	}
+
+	// a damaged cache entry is dropped and the source downloaded again
+	cacheDir, err := api.GetCacheDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := filepath.Join(cacheDir, "sources", entries[0].Key, "content")
+	err = os.RemoveAll(filepath.Join(content, ".git"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = core.BuildRecipe(writeRecipeFiles(t, files), "amd64", core.BuildOptions{})
+	if err != nil {
+		t.Fatalf("expected the damaged cached source to be downloaded again, got %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(content, ".git")); err != nil {
+		t.Errorf("expected the source stored again in the cache: %v", err)
+	}
+
+	err = os.RemoveAll(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := writeRecipeFiles(t, files)
+	_, err = core.BuildRecipe(path, "amd64", core.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(path), "sources", "app", "repo", ".git")); err != nil {
+		t.Errorf("expected the source restored from the cache: %v", err)
+	}
+
+	removed, err := api.PruneCache(1, 0)
+	if err != nil || len(removed) != 1 {
+		t.Errorf("expected the source pruned, got %+v, %v", removed, err)
+	}
+}
+
+// Test that local sources are checked against their tree hash and that
+// git tags are checked against their declared commit
+func TestSourceVerification(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	local := t.TempDir()
+	err := os.WriteFile(filepath.Join(local, "run.sh"), []byte("echo run\n"), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checksum, err := api.HashTree("blake2b", local)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo := t.TempDir()
+	for _, args := range [][]string{
+		{"init", "-q", "-b", "main"},
+		{"-c", "user.name=vib", "-c", "user.email=vib@localhost", "commit", "-q", "--allow-empty", "-m", "initial"},
+		{"tag", "v1"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repo
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %s: %s", args[0], out)
+		}
+	}
+	head, err := exec.Command("git", "-C", repo, "rev-parse", "HEAD").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	build := func(source string) error {
+		path := writeRecipeFiles(t, map[string]string{
+			"recipe.yml": `name: Test
+id: test
+vibversion: 1.0.0
+stages:
+  - id: build
+    base: debian:sid-slim
+    modules:
+      - name: app
+        type: shell
+        sources:
+          - ` + source + `
+        commands:
+          - ls /sources/app
+`,
+		})
+		_, err := core.BuildRecipe(path, "amd64", core.BuildOptions{})
+		return err
+	}
+
+	localSource := "type: local\n            url: " + local + "\n            checksum: blake2b:" + checksum
+	if err := build(localSource); err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chmod(filepath.Join(local, "run.sh"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := build(localSource); err == nil || !strings.Contains(err.Error(), "checksum doesn't match") {
+		t.Errorf("expected a checksum mismatch once the local source changed, got %v", err)
+	}
+
+	gitSource := "type: git\n            url: " + repo + "\n            tag: v1\n            commit: "
+	if err := build(gitSource + strings.TrimSpace(string(head))); err != nil {
+		t.Fatal(err)
+	}
+	if err := build(gitSource + strings.Repeat("ab", 20)); err == nil || !strings.Contains(err.Error(), "checked out commit") {
+		t.Errorf("expected the tag to mismatch its commit, got %v", err)
+	}
+	if err := build(gitSource + "'" + string(head[:7]) + "'"); err == nil || !strings.Contains(err.Error(), "full commit hash") {
+		t.Errorf("expected an abbreviated commit to be rejected along with a tag, got %v", err)
+	}
+
+	// without a tag, an abbreviated commit is checked against HEAD
+	gitSource = "type: git\n            url: " + repo + "\n            branch: main\n            commit: "
+	if err := build(gitSource + "'" + string(head[:7]) + "'"); err != nil {
+		t.Errorf("expected the abbreviated commit of HEAD to be accepted, got %v", err)
+	}
+	if err := build(gitSource + "main"); err == nil || !strings.Contains(err.Error(), "commit main is not a commit hash") {
+		t.Errorf("expected a commit which is not a hash to be rejected, got %v", err)
+	}
+
+	for _, invalid := range []string{"md5:d41d8cd98f00b204e9800998ecf8427e", "sha512:" + checksum[:64], "sha256:xyz"} {
+		if _, _, err := api.ParseChecksum(invalid); err == nil {
+			t.Errorf("expected checksum %s to be invalid", invalid)
+		}
+	}
+}
@@ -0,0 +1,10 @@
+package core
+
+// Internal builders, exported to the tests of the core_test package
+var (
+	ResolveCaches = resolveCaches
+	CleanupSuffix = cleanupSuffix
+	SecretMounts  = secretMounts
+	SecretFlags   = secretFlags
+	ShellScript   = shellScript
+)
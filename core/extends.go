@@ -0,0 +1,410 @@
+package core
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// YAML tree of a recipe once the recipes it extends are merged into it
+// and its variables are interpolated. Since the tree is made of nodes
+// read from several files, the file of each node is tracked as well
+type recipeTree struct {
+	root  *yaml.Node
+	files map[*yaml.Node]string
+	vars  map[string]string
+	// SHA-256 of the remote base recipes, by URL
+	remotes map[string]string
+}
+
+// fileOf returns the file the given node was read from
+func (t *recipeTree) fileOf(node *yaml.Node) string {
+	return t.files[node]
+}
+
+// loadRecipeTree parses the recipe at path, merges the chain of recipes
+// it extends and interpolates the variables, overridden by the given ones
+func loadRecipeTree(path string, overrides map[string]string) (*recipeTree, error) {
+	recipePath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	topDir := filepath.Dir(recipePath)
+	tree := &recipeTree{files: map[*yaml.Node]string{}, remotes: map[string]string{}}
+	tree.root, err = tree.loadExtended(recipePath, relativeTo(topDir, recipePath), topDir, overrides, []string{})
+	if err != nil {
+		return nil, err
+	}
+
+	// variables are interpolated before decoding, so the stages,
+	// the modules and the plugins only ever see resolved values
+	tree.vars, err = ResolveVars(tree.root, overrides)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	interpolateRecipe(tree.root, tree.vars)
+
+	return tree, nil
+}
+
+// loadExtended parses the recipe at recipePath and, if it declares a
+// base recipe with extends, merges it on top of the base one. The chain
+// of recipes being loaded is used to detect recipes extending themselves
+func (t *recipeTree) loadExtended(recipePath string, file string, topDir string, overrides map[string]string, chain []string) (*yaml.Node, error) {
+	// remote recipes are downloaded to a new temporary file every
+	// time, so they are told apart by their location instead
+	remote := isRemoteRecipe(file)
+	identity := recipePath
+	if remote {
+		identity = file
+	}
+	for _, visited := range chain {
+		if visited == identity {
+			return nil, fmt.Errorf("recipe extends itself: %s", strings.Join(append(chain, identity), " → "))
+		}
+	}
+	chain = append(chain, identity)
+
+	root, err := parseYAMLFile(recipePath)
+	if err != nil {
+		return nil, err
+	}
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("%s:%d:%d: a recipe must be a map", file, root.Line, root.Column)
+	}
+	t.recordFile(root, file)
+
+	// local includes are resolved relative to the extending recipe,
+	// those of a base recipe are rewritten to keep pointing at the
+	// files next to it
+	if !remote {
+		rebaseIncludes(root, filepath.Dir(recipePath), topDir)
+	} else {
+		err = rebaseRemoteIncludes(root, file)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	extendsIndex := mappingIndex(root, "extends", false)
+	if extendsIndex < 0 {
+		return root, nil
+	}
+	extendsNode := resolveAlias(root.Content[extendsIndex+1])
+	root.Content = append(root.Content[:extendsIndex], root.Content[extendsIndex+2:]...)
+
+	// the base recipe can be chosen through variables, which can
+	// only come from the extending recipe at this point
+	vars, err := ResolveVars(root, overrides)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	extends := Interpolate(extendsNode.Value, vars)
+
+	// a relative base of a remote recipe lives next to it, not next
+	// to the temporary file it was downloaded to
+	if remote && !isRemoteRecipe(extends) {
+		extends, err = resolveRemoteRecipe(file, extends)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d:%d: cannot load base recipe %s: %w", file, extendsNode.Line, extendsNode.Column, extendsNode.Value, err)
+		}
+	}
+
+	var basePath, baseFile string
+	if strings.HasPrefix(extends, "http") {
+		fmt.Printf("Downloading base recipe from %s\n", extends)
+		basePath, err = downloadRecipe(extends)
+		baseFile = extends
+	} else if followsGhPattern(extends) {
+		fmt.Printf("Downloading base recipe from %s\n", extends)
+		basePath, err = downloadGhRecipe(extends)
+		baseFile = extends
+	} else {
+		basePath = filepath.Join(filepath.Dir(recipePath), extends)
+		baseFile = relativeTo(topDir, basePath)
+		_, err = os.Stat(basePath)
+	}
+	if err == nil && baseFile == extends {
+		t.remotes[extends], err = hashFile(basePath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s:%d:%d: cannot load base recipe %s: %w", file, extendsNode.Line, extendsNode.Column, extends, err)
+	}
+
+	base, err := t.loadExtended(basePath, baseFile, topDir, overrides, chain)
+	if err != nil {
+		return nil, err
+	}
+
+	err = t.mergeRecipe(base, root, file)
+	if err != nil {
+		return nil, err
+	}
+	return base, nil
+}
+
+// isRemoteRecipe reports whether a recipe is downloaded from a URL or
+// from a github repository rather than read from disk
+func isRemoteRecipe(location string) bool {
+	return strings.HasPrefix(location, "http") || followsGhPattern(location)
+}
+
+// resolveRemoteRecipe resolves the path of a recipe relative to the
+// remote recipe at base
+func resolveRemoteRecipe(base string, relative string) (string, error) {
+	if followsGhPattern(base) {
+		if path.IsAbs(relative) {
+			return "", fmt.Errorf("absolute paths cannot be resolved against %s", base)
+		}
+		parts := strings.Split(base, ":")
+		parts[3] = path.Join(path.Dir(parts[3]), relative)
+		return strings.Join(parts, ":"), nil
+	}
+
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+	relativeURL, err := url.Parse(relative)
+	if err != nil {
+		return "", err
+	}
+	return baseURL.ResolveReference(relativeURL).String(), nil
+}
+
+// recordFile records the file of every node of a tree
+func (t *recipeTree) recordFile(node *yaml.Node, file string) {
+	t.files[node] = file
+	for _, child := range node.Content {
+		t.recordFile(child, file)
+	}
+}
+
+// mergeRecipe merges an extending recipe into its base: stages are
+// merged by id, vars by key and any other key replaces the base one
+func (t *recipeTree) mergeRecipe(base *yaml.Node, child *yaml.Node, file string) error {
+	for i := 0; i+1 < len(child.Content); i += 2 {
+		key := child.Content[i]
+		value := resolveAlias(child.Content[i+1])
+		baseValue := mappingValue(base, key.Value, false)
+
+		switch {
+		case key.Value == "stages" && isKind(baseValue, yaml.SequenceNode) && isKind(value, yaml.SequenceNode):
+			err := t.mergeStages(baseValue, value, file)
+			if err != nil {
+				return err
+			}
+		case key.Value == "vars" && isKind(baseValue, yaml.MappingNode) && isKind(value, yaml.MappingNode):
+			mergeMappings(baseValue, value)
+		default:
+			setMappingValue(base, key, value)
+		}
+	}
+	return nil
+}
+
+// mergeStages merges the stages of an extending recipe into the base
+// ones with the same id, stages with a new id are appended
+func (t *recipeTree) mergeStages(base *yaml.Node, child *yaml.Node, file string) error {
+	for _, stage := range child.Content {
+		stage = resolveAlias(stage)
+		id := mappingValue(stage, "id", false)
+
+		var baseStage *yaml.Node
+		if id != nil && id.Value != "" {
+			for _, candidate := range base.Content {
+				candidate = resolveAlias(candidate)
+				candidateId := mappingValue(candidate, "id", false)
+				if candidateId != nil && candidateId.Value == id.Value {
+					baseStage = candidate
+					break
+				}
+			}
+		}
+		if baseStage == nil || !isKind(stage, yaml.MappingNode) {
+			// a new stage has no base modules to remove
+			modules := mappingValue(stage, "modules", false)
+			if isKind(modules, yaml.SequenceNode) {
+				kept := &yaml.Node{Kind: yaml.SequenceNode}
+				err := mergeModules(kept, modules, file)
+				if err != nil {
+					return err
+				}
+			}
+			base.Content = append(base.Content, stage)
+			continue
+		}
+
+		for i := 0; i+1 < len(stage.Content); i += 2 {
+			key := stage.Content[i]
+			value := resolveAlias(stage.Content[i+1])
+			baseValue := mappingValue(baseStage, key.Value, false)
+
+			switch {
+			case (key.Value == "labels" || key.Value == "env" || key.Value == "args" || key.Value == "expose") &&
+				isKind(baseValue, yaml.MappingNode) && isKind(value, yaml.MappingNode):
+				mergeMappings(baseValue, value)
+			case key.Value == "modules" && isKind(baseValue, yaml.SequenceNode) && isKind(value, yaml.SequenceNode):
+				err := mergeModules(baseValue, value, file)
+				if err != nil {
+					return err
+				}
+			default:
+				setMappingValue(baseStage, key, value)
+			}
+		}
+	}
+	return nil
+}
+
+// mergeModules merges the modules of an extending stage into the base
+// ones: a module replaces the base module with the same name, a module
+// with remove: true removes it and any other module is appended
+func mergeModules(base *yaml.Node, child *yaml.Node, file string) error {
+	for _, module := range child.Content {
+		module = resolveAlias(module)
+		name := mappingValue(module, "name", true)
+
+		baseIndex := -1
+		if name != nil {
+			for i, candidate := range base.Content {
+				candidateName := mappingValue(resolveAlias(candidate), "name", true)
+				if candidateName != nil && candidateName.Value == name.Value {
+					baseIndex = i
+					break
+				}
+			}
+		}
+
+		remove := mappingValue(module, "remove", true)
+		if remove != nil && remove.Value == "true" {
+			if name == nil {
+				return fmt.Errorf("%s:%d:%d: cannot remove a module without a name", file, module.Line, module.Column)
+			}
+			if baseIndex < 0 {
+				return fmt.Errorf("%s:%d:%d: cannot remove module %s, it is not declared in the base recipe", file, module.Line, module.Column, name.Value)
+			}
+			base.Content = append(base.Content[:baseIndex], base.Content[baseIndex+1:]...)
+			continue
+		}
+
+		if baseIndex < 0 {
+			base.Content = append(base.Content, module)
+		} else {
+			base.Content[baseIndex] = module
+		}
+	}
+	return nil
+}
+
+// mergeMappings sets every key of child into base, keeping the order
+// of the keys already present in base
+func mergeMappings(base *yaml.Node, child *yaml.Node) {
+	for i := 0; i+1 < len(child.Content); i += 2 {
+		setMappingValue(base, child.Content[i], child.Content[i+1])
+	}
+}
+
+// setMappingValue replaces the value of key in a mapping node, or
+// appends the key if it is not there yet
+func setMappingValue(node *yaml.Node, key *yaml.Node, value *yaml.Node) {
+	index := mappingIndex(node, key.Value, false)
+	if index < 0 {
+		node.Content = append(node.Content, key, value)
+		return
+	}
+	node.Content[index+1] = value
+}
+
+// mappingIndex returns the index of key in the content of a mapping
+// node, or -1 if the key is missing
+func mappingIndex(node *yaml.Node, key string, fold bool) int {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return -1
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if keyMatches(node.Content[i].Value, key, fold) {
+			return i
+		}
+	}
+	return -1
+}
+
+func isKind(node *yaml.Node, kind yaml.Kind) bool {
+	return node != nil && node.Kind == kind
+}
+
+// rebaseIncludes rewrites the local includes of a recipe found in dir
+// so they are relative to topDir
+func rebaseIncludes(root *yaml.Node, dir string, topDir string) {
+	if dir == topDir {
+		return
+	}
+	rebased := map[*yaml.Node]bool{}
+	for _, include := range findLocalIncludes(root) {
+		include.node.Value = relativeTo(topDir, filepath.Join(dir, include.node.Value))
+		// exclude patterns holding a path are relative to the recipe
+		// as well, plain file name patterns are left as they are
+		for _, pattern := range include.exclude {
+			if !rebased[pattern] && strings.Contains(pattern.Value, "/") {
+				pattern.Value = relativeTo(topDir, filepath.Join(dir, pattern.Value))
+			}
+			rebased[pattern] = true
+		}
+	}
+}
+
+// rebaseRemoteIncludes rewrites the local includes of the remote recipe
+// at base so they point at the files next to it. Directories and glob
+// patterns cannot be listed remotely, so they are rejected
+func rebaseRemoteIncludes(root *yaml.Node, base string) error {
+	for _, include := range findLocalIncludes(root) {
+		if strings.ContainsAny(include.node.Value, "*?[") || len(include.exclude) > 0 {
+			return fmt.Errorf("%s:%d:%d: include %s of a remote recipe must be a single file", base, include.node.Line, include.node.Column, include.node.Value)
+		}
+		remote, err := resolveRemoteRecipe(base, include.node.Value)
+		if err != nil {
+			return fmt.Errorf("%s:%d:%d: cannot resolve include %s: %w", base, include.node.Line, include.node.Column, include.node.Value, err)
+		}
+		include.node.Value = remote
+	}
+	return nil
+}
+
+// relativeTo returns path relative to dir when possible
+func relativeTo(dir string, path string) string {
+	relative, err := filepath.Rel(dir, path)
+	if err != nil {
+		return path
+	}
+	return relative
+}
+
+// FlattenRecipe returns the recipe at path as YAML, with the recipes it
+// extends merged into it and its variables interpolated
+func FlattenRecipe(path string, vars map[string]string) ([]byte, error) {
+	tree, err := loadRecipeTree(path, vars)
+	if err != nil {
+		return nil, err
+	}
+
+	var flattened strings.Builder
+	encoder := yaml.NewEncoder(&flattened)
+	encoder.SetIndent(2)
+	err = encoder.Encode(tree.root)
+	if err != nil {
+		return nil, err
+	}
+	err = encoder.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(flattened.String()), nil
+}
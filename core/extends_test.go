@@ -0,0 +1,188 @@
+package core_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/vanilla-os/vib/core"
+)
+
+// Test that an extending recipe is merged into its base recipe
+func TestLoadRecipeExtends(t *testing.T) {
+	path := writeRecipeFiles(t, map[string]string{
+		"base/recipe.yml": `name: Base
+id: base
+vibversion: 1.0.0
+vars:
+  edition: desktop
+stages:
+  - id: build
+    base: debian:sid-slim
+    labels:
+      maintainer: Vanilla OS
+      edition: ${edition}
+    modules:
+      - name: update
+        type: shell
+        commands:
+          - apt-get update
+      - name: desktop
+        type: shell
+        commands:
+          - apt-get install -y gnome
+      - name: shared
+        type: includes
+        includes:
+          - modules/shared.yml
+`,
+		"recipe.yml": `extends: base/recipe.yml
+id: server
+vars:
+  edition: server
+stages:
+  - id: build
+    labels:
+      tier: server
+    modules:
+      - name: update
+        type: shell
+        commands:
+          - apt-get update -q
+      - name: desktop
+        remove: true
+      - name: ssh
+        type: shell
+        commands:
+          - apt-get install -y openssh-server
+  - id: dist
+    base: build
+`,
+	})
+
+	recipe, err := core.LoadRecipe(path, nil)
+	if err != nil {
+		t.Fatalf("LoadRecipe returned an error: %v", err)
+	}
+
+	if recipe.Id != "server" || recipe.Name != "Base" {
+		t.Errorf("expected id server and name Base, got %s and %s", recipe.Id, recipe.Name)
+	}
+	if len(recipe.Stages) != 2 {
+		t.Fatalf("expected 2 stages, got %d", len(recipe.Stages))
+	}
+
+	build := recipe.Stages[0]
+	if build.Base != "debian:sid-slim" {
+		t.Errorf("expected the base of the build stage to be kept, got %s", build.Base)
+	}
+	if build.Labels["maintainer"] != "Vanilla OS" || build.Labels["edition"] != "server" || build.Labels["tier"] != "server" {
+		t.Errorf("expected labels to be merged by key, got %v", build.Labels)
+	}
+
+	names := []string{}
+	for _, module := range build.Modules {
+		names = append(names, module.(map[string]interface{})["name"].(string))
+	}
+	if strings.Join(names, ",") != "update,shared,ssh" {
+		t.Errorf("expected modules update,shared,ssh, got %s", strings.Join(names, ","))
+	}
+
+	update := build.Modules[0].(map[string]interface{})
+	if update["commands"].([]interface{})[0] != "apt-get update -q" {
+		t.Errorf("expected the update module to be replaced, got %v", update)
+	}
+	shared := build.Modules[1].(map[string]interface{})
+	if shared["includes"].([]interface{})[0] != "base/modules/shared.yml" {
+		t.Errorf("expected includes of the base recipe to be rebased, got %v", shared["includes"])
+	}
+}
+
+// Test that a recipe extending itself is rejected
+func TestLoadRecipeExtendsCycle(t *testing.T) {
+	path := writeRecipeFiles(t, map[string]string{
+		"recipe.yml": "extends: other.yml\n",
+		"other.yml":  "extends: recipe.yml\n",
+	})
+
+	_, err := core.LoadRecipe(path, nil)
+	if err == nil || !strings.Contains(err.Error(), "recipe extends itself") {
+		t.Errorf("expected a cycle error, got %v", err)
+	}
+}
+
+// Test that the relative base of a remote recipe is downloaded from
+// next to it rather than read from disk
+func TestLoadRecipeExtendsRemoteChain(t *testing.T) {
+	recipes := map[string]string{
+		"/recipes/desktop/recipe.yml": "extends: ../base.yml\nid: desktop\n",
+		"/recipes/base.yml": `name: Base
+id: base
+vibversion: 1.0.0
+stages:
+  - id: build
+    base: debian:sid-slim
+    modules:
+      - name: shared
+        type: includes
+        includes:
+          - modules/shared.yml
+`,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recipe, ok := recipes[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(recipe))
+	}))
+	defer server.Close()
+
+	path := writeRecipeFiles(t, map[string]string{
+		"recipe.yml": "extends: " + server.URL + "/recipes/desktop/recipe.yml\nid: server\n",
+	})
+
+	recipe, err := core.LoadRecipe(path, nil)
+	if err != nil {
+		t.Fatalf("LoadRecipe returned an error: %v", err)
+	}
+	if recipe.Id != "server" || recipe.Name != "Base" {
+		t.Errorf("expected id server and name Base, got %s and %s", recipe.Id, recipe.Name)
+	}
+	if len(recipe.Stages) != 1 || recipe.Stages[0].Base != "debian:sid-slim" {
+		t.Fatalf("expected the stages of the remote base recipe, got %v", recipe.Stages)
+	}
+	shared := recipe.Stages[0].Modules[0].(map[string]interface{})
+	if include := shared["includes"].([]interface{})[0]; include != server.URL+"/recipes/modules/shared.yml" {
+		t.Errorf("expected the include of the remote base recipe to point next to it, got %v", include)
+	}
+}
+
+// Test that removing a module of a stage the base recipe does not have
+// is rejected
+func TestLoadRecipeExtendsRemoveInNewStage(t *testing.T) {
+	path := writeRecipeFiles(t, map[string]string{
+		"base.yml": `name: Base
+id: base
+vibversion: 1.0.0
+stages:
+  - id: build
+    base: debian:sid-slim
+`,
+		"recipe.yml": `extends: base.yml
+stages:
+  - id: dist
+    base: build
+    modules:
+      - name: desktop
+        remove: true
+`,
+	})
+
+	_, err := core.LoadRecipe(path, nil)
+	if err == nil || !strings.Contains(err.Error(), "recipe.yml:6:9: cannot remove module desktop, it is not declared in the base recipe") {
+		t.Errorf("expected an error for the removed module, got %v", err)
+	}
+}
@@ -0,0 +1,259 @@
+package core
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/vanilla-os/vib/api"
+)
+
+// Prefix of the includes pointing at a file in a git repository, in the
+// git+https://host/repo.git@ref#path form
+const gitIncludePrefix = "git+"
+
+// Include of a file from a git repository, checked out at ref or at the
+// default branch when ref is empty
+type GitInclude struct {
+	Git  string `json:"git"`
+	Ref  string `json:"ref"`
+	Path string `json:"path"`
+}
+
+// String returns the include in its git+url@ref#path form
+func (g GitInclude) String() string {
+	include := gitIncludePrefix + g.Git
+	if g.Ref != "" {
+		include += "@" + g.Ref
+	}
+	return include + "#" + g.Path
+}
+
+// isRemoteInclude reports whether an include is fetched from a remote
+// location rather than read next to the recipe
+func isRemoteInclude(include string) bool {
+	return strings.HasPrefix(include, "http") || followsGhPattern(include) || strings.HasPrefix(include, gitIncludePrefix)
+}
+
+// parseGitInclude parses an include in the git+url@ref#path form
+func parseGitInclude(include string) (GitInclude, error) {
+	url, path, found := strings.Cut(strings.TrimPrefix(include, gitIncludePrefix), "#")
+	if !found || path == "" {
+		return GitInclude{}, fmt.Errorf("git include %s is missing the path of the file, as in %s#path/to/module.yml", include, include)
+	}
+
+	// the ref follows the last @ of the url, as long as it is not
+	// the one separating the user from the host
+	var ref string
+	hostStart := strings.Index(url, "://") + len("://")
+	pathStart := strings.Index(url[hostStart:], "/")
+	if at := strings.LastIndex(url, "@"); at > hostStart && pathStart >= 0 && at > hostStart+pathStart {
+		url, ref = url[:at], url[at+1:]
+	}
+
+	return GitInclude{Git: url, Ref: ref, Path: path}, nil
+}
+
+// decodeInclude returns an entry of an includes module as a string, in
+// the git+url@ref#path form for the structured git includes
+func decodeInclude(entry interface{}) (string, error) {
+	switch include := entry.(type) {
+	case string:
+		return include, nil
+	case map[string]interface{}:
+		var git GitInclude
+		err := mapstructure.Decode(include, &git)
+		if err != nil {
+			return "", err
+		}
+		if git.Git == "" || git.Path == "" {
+			return "", fmt.Errorf("git includes must specify both git and path")
+		}
+		return git.String(), nil
+	default:
+		return "", fmt.Errorf("invalid include %v, expected a path, a URL or a git include", entry)
+	}
+}
+
+// includePath returns the path of the file of an include, downloading
+// or cloning it first when the include is remote. Remote includes are
+// downloaded once per recipe, so the build reads the files the prefetch
+// downloaded
+func includePath(recipe *api.Recipe, include string) (path string, remote bool, err error) {
+	if strings.HasPrefix(include, "http") || followsGhPattern(include) {
+		state := getBuildState(recipe)
+		if path, ok := state.remoteIncludes[include]; ok {
+			return path, true, nil
+		}
+
+		fmt.Printf("Downloading recipe from %s\n", include)
+		if strings.HasPrefix(include, "http") {
+			// in case of a remote include, we need to download the
+			// recipe before including it
+			path, err = downloadRecipe(include)
+		} else {
+			// if the include follows the github pattern, we need to
+			// download the recipe from the github repository
+			path, err = downloadGhRecipe(include)
+		}
+		if err != nil {
+			return "", true, err
+		}
+		if state.remoteIncludes == nil {
+			state.remoteIncludes = map[string]string{}
+		}
+		state.remoteIncludes[include] = path
+		return path, true, nil
+	}
+
+	// git includes are read from a checkout of their repository
+	if strings.HasPrefix(include, gitIncludePrefix) {
+		git, err := parseGitInclude(include)
+		if err != nil {
+			return "", true, err
+		}
+		path, err = gitIncludePath(recipe.DownloadsPath, git)
+		return path, true, err
+	}
+
+	return filepath.Join(recipe.ParentPath, include), false, nil
+}
+
+// gitIncludePath returns the path of the file of a git include. Each
+// repository and ref is cloned once in the downloads directory and
+// shared by all the includes pointing at it
+func gitIncludePath(downloadsPath string, git GitInclude) (string, error) {
+	dest := filepath.Join(downloadsPath, "includes", fmt.Sprintf("%x", sha256.Sum256([]byte(git.Git+"@"+git.Ref)))[:16])
+
+	if _, err := os.Stat(dest); os.IsNotExist(err) {
+		fmt.Printf("Cloning includes repository: %s\n", git.Git)
+		err := gitCloneInclude(git, dest)
+		if err != nil {
+			os.RemoveAll(dest)
+			return "", fmt.Errorf("cannot clone %s: %w", git.Git, err)
+		}
+	}
+
+	path := filepath.Join(dest, git.Path)
+	if !strings.HasPrefix(path, dest+string(filepath.Separator)) {
+		return "", fmt.Errorf("git include path %s is outside of the repository", git.Path)
+	}
+	return path, nil
+}
+
+func gitCloneInclude(git GitInclude, dest string) error {
+	out, err := exec.Command("git", "clone", "--quiet", git.Git, dest).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s", strings.TrimSpace(string(out)))
+	}
+	if git.Ref == "" {
+		return nil
+	}
+
+	cmd := exec.Command("git", "checkout", "--quiet", git.Ref)
+	cmd.Dir = dest
+	out, err = cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s", strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// expandInclude returns the module files a local include refers to: the
+// file itself, the YAML files of a directory or the files matching a
+// glob pattern. Directories and patterns are expanded in lexical order,
+// without the files matching one of the exclude patterns
+func expandInclude(parentPath string, include string, exclude []string) ([]string, error) {
+	path := filepath.Join(parentPath, include)
+
+	var matches []string
+	if strings.ContainsAny(include, "*?[") {
+		globMatches, err := filepath.Glob(path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid include pattern %s: %w", include, err)
+		}
+		for _, match := range globMatches {
+			if info, err := os.Stat(match); err == nil && !info.IsDir() {
+				matches = append(matches, match)
+			}
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("include pattern %s matches no module", include)
+		}
+	} else if info, err := os.Stat(path); err == nil && info.IsDir() {
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			extension := filepath.Ext(entry.Name())
+			if !entry.IsDir() && (extension == ".yml" || extension == ".yaml") {
+				matches = append(matches, filepath.Join(path, entry.Name()))
+			}
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("included directory %s contains no module", include)
+		}
+	} else {
+		return []string{include}, nil
+	}
+	sort.Strings(matches)
+
+	files := []string{}
+	for _, match := range matches {
+		file := relativeTo(parentPath, match)
+		excluded, err := isExcluded(file, exclude)
+		if err != nil {
+			return nil, err
+		}
+		if !excluded {
+			files = append(files, file)
+		}
+	}
+	return files, nil
+}
+
+// isExcluded reports whether file, relative to the recipe, matches one
+// of the exclude patterns, either by its path or by its name
+func isExcluded(file string, exclude []string) (bool, error) {
+	for _, pattern := range exclude {
+		for _, name := range []string{file, filepath.Base(file)} {
+			matched, err := filepath.Match(pattern, name)
+			if err != nil {
+				return false, fmt.Errorf("invalid exclude pattern %s: %w", pattern, err)
+			}
+			if matched {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// resolveIncludes returns the entries of an includes module as a list
+// of includes, with the local directories and patterns expanded to the
+// module files they match
+func resolveIncludes(parentPath string, entries []interface{}, exclude []string) ([]string, error) {
+	includes := []string{}
+	for _, entry := range entries {
+		include, err := decodeInclude(entry)
+		if err != nil {
+			return nil, err
+		}
+		if isRemoteInclude(include) {
+			includes = append(includes, include)
+			continue
+		}
+		files, err := expandInclude(parentPath, include, exclude)
+		if err != nil {
+			return nil, err
+		}
+		includes = append(includes, files...)
+	}
+	return includes, nil
+}
@@ -0,0 +1,234 @@
+package core_test
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/vanilla-os/vib/core"
+)
+
+// Test that git includes are read from a single clone of their repository
+func TestBuildGitIncludes(t *testing.T) {
+	repo := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(repo, "modules"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for name, command := range map[string]string{"tool": "echo tool", "other": "echo other"} {
+		module := "name: " + name + "\ntype: shell\ncommands:\n  - " + command + "\n"
+		if err := os.WriteFile(filepath.Join(repo, "modules", name+".yml"), []byte(module), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, args := range [][]string{
+		{"init", "-q", "-b", "main"},
+		{"add", "."},
+		{"-c", "user.name=vib", "-c", "user.email=vib@localhost", "commit", "-q", "-m", "modules"},
+		{"tag", "v1"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repo
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %s: %s", args[0], out)
+		}
+	}
+
+	path := writeRecipeFiles(t, map[string]string{
+		"recipe.yml": `name: Test
+id: test
+vibversion: 1.0.0
+stages:
+  - id: build
+    base: debian:sid-slim
+    modules:
+      - name: library
+        type: includes
+        includes:
+          - git+file://` + repo + `@v1#modules/tool.yml
+          - git: file://` + repo + `
+            ref: v1
+            path: modules/other.yml
+`,
+	})
+
+	if errs, err := core.ValidateRecipeSchema(path, nil); err != nil || len(errs) > 0 {
+		t.Fatalf("unexpected schema errors %v %v", errs, err)
+	}
+
+	_, err := core.BuildRecipe(path, "amd64", core.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	containerfile, err := os.ReadFile(filepath.Join(filepath.Dir(path), "Containerfile"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, command := range []string{"echo tool", "echo other"} {
+		if !strings.Contains(string(containerfile), command) {
+			t.Errorf("expected the Containerfile to contain %q:\n%s", command, containerfile)
+		}
+	}
+
+	clones, err := os.ReadDir(filepath.Join(filepath.Dir(path), "downloads", "includes"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clones) != 1 {
+		t.Errorf("expected a single clone of the repository, got %d", len(clones))
+	}
+}
+
+// Test that directory and glob includes expand in lexical order, without the excluded files
+func TestBuildDirectoryIncludes(t *testing.T) {
+	module := func(command string) string {
+		return "name: " + command + "\ntype: shell\ncommands:\n  - echo " + command + "\n"
+	}
+	path := writeRecipeFiles(t, map[string]string{
+		"recipe.yml": `name: Test
+id: test
+vibversion: 1.0.0
+stages:
+  - id: build
+    base: debian:sid-slim
+    modules:
+      - name: base
+        type: includes
+        includes:
+          - modules/base
+      - name: extra
+        type: includes
+        includes:
+          - modules/extra/*.yml
+        exclude:
+          - 99-*.yml
+`,
+		"modules/base/10-second.yml":  module("second"),
+		"modules/base/00-first.yml":   module("first"),
+		"modules/base/README.md":      "not a module",
+		"modules/extra/20-third.yml":  module("third"),
+		"modules/extra/99-draft.yml":  module("draft"),
+		"modules/extra/30-fourth.yml": module("fourth"),
+	})
+
+	if errs, err := core.ValidateRecipeSchema(path, nil); err != nil || len(errs) > 0 {
+		t.Fatalf("unexpected schema errors %v %v", errs, err)
+	}
+
+	_, err := core.BuildRecipe(path, "amd64", core.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	containerfile, err := os.ReadFile(filepath.Join(filepath.Dir(path), "Containerfile"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(containerfile), "echo draft") {
+		t.Errorf("expected the excluded module to be skipped:\n%s", containerfile)
+	}
+	last := -1
+	for _, command := range []string{"echo first", "echo second", "echo third", "echo fourth"} {
+		index := strings.Index(string(containerfile), command)
+		if index < 0 || index < last {
+			t.Errorf("expected %q after the previous modules:\n%s", command, containerfile)
+		}
+		last = index
+	}
+}
+
+// Test that include cycles are reported with their path and that modules
+// included once are built once per stage, by the includes marked once
+func TestBuildIncludeCycleAndOnce(t *testing.T) {
+	path := writeRecipeFiles(t, map[string]string{
+		"recipe.yml": `name: Test
+id: test
+vibversion: 1.0.0
+stages:
+  - id: build
+    base: debian:sid-slim
+    modules:
+      - name: first
+        type: includes
+        includes:
+          - modules/a.yml
+`,
+		"modules/a.yml": `name: a
+type: includes
+includes:
+  - modules/b.yml
+`,
+		"modules/b.yml": `name: b
+type: includes
+includes:
+  - modules/a.yml
+`,
+	})
+
+	_, err := core.BuildRecipe(path, "amd64", core.BuildOptions{})
+	if err == nil || !strings.Contains(err.Error(), "include cycle: modules/a.yml -> modules/b.yml -> modules/a.yml") {
+		t.Fatalf("expected an error with the include cycle, got %v", err)
+	}
+
+	shared := `name: shared
+type: shell
+commands:
+  - echo shared
+`
+	path = writeRecipeFiles(t, map[string]string{
+		"recipe.yml": `name: Test
+id: test
+vibversion: 1.0.0
+stages:
+  - id: build
+    base: debian:sid-slim
+    modules:
+      - name: first
+        type: includes
+        includes:
+          - modules/shared.yml
+      - name: second
+        type: includes
+        once: true
+        includes:
+          - modules/shared.yml
+      - name: third
+        type: includes
+        once: true
+        includes:
+          - modules/shared.yml
+      - name: fourth
+        type: includes
+        includes:
+          - modules/shared.yml
+  - id: final
+    base: debian:sid-slim
+    modules:
+      - name: fifth
+        type: includes
+        once: true
+        includes:
+          - modules/shared.yml
+`,
+		"modules/shared.yml": shared,
+	})
+
+	_, err = core.BuildRecipe(path, "amd64", core.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(filepath.Join(filepath.Dir(path), "Containerfile"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the includes without once are always built, the third is
+	// skipped after the second and the fifth is in another stage
+	if count := strings.Count(string(content), "echo shared"); count != 4 {
+		t.Errorf("expected the shared module 4 times, got %d times:\n%s", count, content)
+	}
+	if count := strings.Count(string(content), "# Already included: modules/shared.yml\n"); count != 1 {
+		t.Errorf("expected a comment for the skipped include, got %d:\n%s", count, content)
+	}
+}
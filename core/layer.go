@@ -0,0 +1,154 @@
+package core
+
+import (
+	"strings"
+
+	"github.com/vanilla-os/vib/api"
+)
+
+// MergeModuleCommands writes the RUN instructions of the modules as a
+// single RUN, so they produce one layer. The commands are written as a
+// script keeping the begin and end comments of the modules, the cleanup
+// runs once at its end. Instructions which are not RUN, as produced by
+// plugins writing their own instructions, cannot be part of the script:
+// they end the layer and are returned as a command of their own
+func MergeModuleCommands(cmds []ModuleCommand, cleanup []string) []ModuleCommand {
+	layer := &layerScript{}
+	for _, cmd := range cmds {
+		layer.workdir = cmd.Workdir
+		for _, instruction := range cmd.Instructions {
+			switch instruction := instruction.(type) {
+			case BlankLine:
+			case CommentInstruction:
+				layer.comment(instruction.Text)
+			case RunInstruction:
+				layer.run(instruction)
+			default:
+				layer.flush()
+				layer.cmds = append(layer.cmds, ModuleCommand{
+					Name:         cmd.Name,
+					Instructions: []Instruction{instruction},
+					Workdir:      cmd.Workdir,
+				})
+			}
+		}
+		layer.leaveWorkdir()
+	}
+
+	if suffix := cleanupSuffix(cleanup, layer.caches); suffix != "" {
+		layer.lines = append(layer.lines, strings.TrimPrefix(suffix, " && "))
+		layer.hasRun = true
+	}
+	layer.flush()
+
+	return layer.cmds
+}
+
+// layerScript collects the commands of the RUN being merged
+type layerScript struct {
+	cmds      []ModuleCommand
+	flags     []string
+	caches    []api.Cache
+	lines     []string
+	hasRun    bool
+	workdir   string
+	inWorkdir bool
+}
+
+func (l *layerScript) comment(text string) {
+	for _, line := range strings.Split(strings.TrimRight(text, "\n"), "\n") {
+		l.lines = append(l.lines, strings.TrimRight("# "+line, " "))
+	}
+}
+
+func (l *layerScript) run(instruction RunInstruction) {
+	for _, flag := range instruction.Flags {
+		if !containsString(l.flags, flag) {
+			l.flags = append(l.flags, flag)
+		}
+	}
+	for _, cache := range instruction.Caches {
+		if !containsCache(l.caches, cache) {
+			l.caches = append(l.caches, cache)
+		}
+	}
+	// the commands of a module with a workdir run in a subshell, so the
+	// following modules start in the working directory of the stage
+	if l.workdir != "" && !l.inWorkdir {
+		dir := shellQuote(l.workdir)
+		l.lines = append(l.lines, "(", "mkdir -p "+dir+" && cd "+dir)
+		l.inWorkdir = true
+	}
+	// commands with variables run in a subshell of their own, so the
+	// variables do not reach the following commands, and commands with
+	// a shell are run by it. The names are checked when the module is built
+	command := strings.TrimRight(instruction.Command, "\n")
+	exports, _ := exportVariables(instruction.Env)
+	switch {
+	case instruction.Shell != "":
+		if exports != "" {
+			command = exports + "\n" + command
+		}
+		l.lines = append(l.lines, instruction.Shell+" -c "+shellQuote(command))
+	case exports != "":
+		l.lines = append(l.lines, "(", exports, command, ")")
+	default:
+		l.lines = append(l.lines, command)
+	}
+	l.hasRun = true
+}
+
+func (l *layerScript) leaveWorkdir() {
+	if l.inWorkdir {
+		l.lines = append(l.lines, ")")
+		l.inWorkdir = false
+	}
+}
+
+// flush adds the collected commands as a RUN, stopping at the first
+// failing command as separate RUN instructions would
+func (l *layerScript) flush() {
+	l.leaveWorkdir()
+	instructions := []Instruction{}
+	if l.hasRun {
+		instructions = append(instructions, RunInstruction{
+			Flags:   l.flags,
+			Caches:  l.caches,
+			Command: "set -e\n" + strings.Join(l.lines, "\n"),
+		})
+	} else {
+		for _, line := range l.lines {
+			instructions = append(instructions, RawInstruction{Text: line})
+		}
+	}
+	if len(instructions) > 0 {
+		l.cmds = append(l.cmds, ModuleCommand{Instructions: instructions})
+	}
+	l.flags = nil
+	l.caches = nil
+	l.lines = nil
+	l.hasRun = false
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func containsCache(caches []api.Cache, cache api.Cache) bool {
+	for _, c := range caches {
+		if c.Target == cache.Target {
+			return true
+		}
+	}
+	return false
+}
+
+// shellQuote single quotes a value for the shell running the commands
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
@@ -0,0 +1,79 @@
+package core_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/vanilla-os/vib/api"
+	"github.com/vanilla-os/vib/core"
+)
+
+// Test that the commands of consecutive modules are merged into a single
+// RUN, with their flags, caches, variables and working directories, and
+// that other instructions end the RUN
+func TestMergeModuleCommands(t *testing.T) {
+	apt := api.Cache{Target: "/var/cache/apt", Id: "apt"}
+	cmds := []core.ModuleCommand{
+		{
+			Name: "deps",
+			Instructions: []core.Instruction{
+				core.BlankLine{},
+				core.CommentInstruction{Text: "Begin Module deps - shell"},
+				core.RunInstruction{Flags: []string{core.SourcesMount("deps")}, Caches: []api.Cache{apt}, Command: "apt-get install -y curl"},
+			},
+		},
+		{
+			Name:    "app",
+			Workdir: "/opt/app",
+			Instructions: []core.Instruction{
+				core.RunInstruction{Flags: []string{core.SourcesMount("app")}, Caches: []api.Cache{apt}, Env: []core.RunVariable{{Key: "MODE", Value: "release"}}, Command: "make"},
+				core.RunInstruction{Shell: "/bin/bash", Command: "echo done"},
+			},
+		},
+		{
+			Name:         "config",
+			Instructions: []core.Instruction{core.RawInstruction{Text: "COPY app.conf /etc/app.conf"}},
+		},
+		{
+			Name:         "post",
+			Instructions: []core.Instruction{core.RunInstruction{Command: "ldconfig"}},
+		},
+	}
+
+	merged := core.MergeModuleCommands(cmds, []string{"/tmp/build"})
+	emitted := []string{}
+	for _, cmd := range merged {
+		for _, instruction := range cmd.Instructions {
+			text, err := instruction.Emit()
+			if err != nil {
+				t.Fatal(err)
+			}
+			emitted = append(emitted, text)
+		}
+	}
+
+	expected := []string{
+		`RUN --mount=source=sources/deps,target=/sources/deps,rw --mount=source=sources/app,target=/sources/app,rw --mount=type=cache,target=/var/cache/apt,id=apt <<'EOF'
+set -e
+# Begin Module deps - shell
+apt-get install -y curl
+(
+mkdir -p '/opt/app' && cd '/opt/app'
+(
+export MODE='release'
+make
+)
+/bin/bash -c 'echo done'
+)
+EOF`,
+		"COPY app.conf /etc/app.conf",
+		`RUN <<'EOF'
+set -e
+ldconfig
+rm -rf /tmp/build
+EOF`,
+	}
+	if strings.Join(emitted, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(emitted, "\n"))
+	}
+}
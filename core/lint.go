@@ -0,0 +1,447 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/vanilla-os/vib/api"
+	"gopkg.in/yaml.v3"
+)
+
+// Name of the lint configuration file, looked up next to the recipe
+const LintConfigFileName = ".vib-lint.yml"
+
+// Severities of the lint rules, a rule set to LintOff is not checked
+const (
+	LintError   = "error"
+	LintWarning = "warning"
+	LintInfo    = "info"
+	LintOff     = "off"
+)
+
+// A check vib lint runs on recipes, along with its default severity
+type LintRule struct {
+	Id          string
+	Severity    string
+	Description string
+}
+
+// The rules vib lint checks
+var LintRules = []LintRule{
+	{"apt-update", LintWarning, "apt modules must be preceded by an apt-get update in the same stage"},
+	{"source-checksum", LintError, "tar and file sources must declare a checksum, and checksums must be valid"},
+	{"git-branch-pin", LintWarning, "git sources should be pinned to a commit or a tag rather than a branch"},
+	{"duplicate-module-name", LintError, "module names must be unique, since each module owns sources/<name>"},
+	{"copy-from-unknown-stage", LintError, "copy.from must reference a stage declared earlier in the recipe"},
+	{"cleanup-prefix", LintWarning, "cleanup paths must be under one of the expected prefixes"},
+}
+
+// Paths cleanup is expected to remove, unless configured otherwise
+var DefaultCleanupPrefixes = []string{
+	"/tmp/",
+	"/var/tmp/",
+	"/var/cache/",
+	"/var/lib/apt/lists/",
+	"/var/log/",
+	"/root/.cache/",
+	"/usr/share/doc/",
+	"/usr/share/man/",
+	"/sources/",
+}
+
+// Configuration of vib lint, the severity of each rule can be changed
+// or set to off to disable it
+type LintConfig struct {
+	Rules           map[string]string `yaml:"rules"`
+	CleanupPrefixes []string          `yaml:"cleanup-prefixes"`
+}
+
+// A single finding of vib lint
+type LintIssue struct {
+	Rule     string `json:"rule"`
+	Severity string `json:"severity"`
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+	Column   int    `json:"column"`
+	Path     string `json:"path,omitempty"`
+	Message  string `json:"message"`
+}
+
+func (i LintIssue) String() string {
+	location := Location{File: i.File, Line: i.Line, Column: i.Column}
+	if i.Path != "" {
+		return fmt.Sprintf("%s: %s: %s: %s [%s]", location, i.Path, i.Severity, i.Message, i.Rule)
+	}
+	return fmt.Sprintf("%s: %s: %s [%s]", location, i.Severity, i.Message, i.Rule)
+}
+
+// LoadLintConfig reads the lint configuration at path, a missing file
+// results in the default configuration
+func LoadLintConfig(path string) (*LintConfig, error) {
+	config := &LintConfig{}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return config, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = yaml.Unmarshal(data, config)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for rule, severity := range config.Rules {
+		if findLintRule(rule) == nil {
+			return nil, fmt.Errorf("%s: unknown lint rule %s", path, rule)
+		}
+		switch severity {
+		case LintError, LintWarning, LintInfo, LintOff:
+		default:
+			return nil, fmt.Errorf("%s: invalid severity %s for rule %s, expected error, warning, info or off", path, severity, rule)
+		}
+	}
+	return config, nil
+}
+
+func findLintRule(id string) *LintRule {
+	for i := range LintRules {
+		if LintRules[i].Id == id {
+			return &LintRules[i]
+		}
+	}
+	return nil
+}
+
+// severity returns the severity of a rule with the configuration applied
+func (c *LintConfig) severity(rule string) string {
+	if severity, ok := c.Rules[rule]; ok {
+		return severity
+	}
+	return findLintRule(rule).Severity
+}
+
+// LintRecipe runs the lint rules on the recipe at path and on the local
+// modules it includes. Issues suppressed by a vib-lint-ignore comment
+// and rules turned off in the configuration are not reported
+func LintRecipe(path string, vars map[string]string, config *LintConfig) ([]LintIssue, error) {
+	if config == nil {
+		config = &LintConfig{}
+	}
+
+	tree, err := loadRecipeTree(path, vars)
+	if err != nil {
+		return nil, err
+	}
+	recipe := &api.Recipe{}
+	err = tree.root.Decode(recipe)
+	if err != nil {
+		return nil, err
+	}
+	recipePath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	recipe.Path = recipePath
+	recipe.ParentPath = filepath.Dir(recipePath)
+	recipe.Vars = tree.vars
+	registerRecipeLocations(recipe, tree)
+
+	l := &linter{
+		recipe:      recipe,
+		config:      config,
+		moduleNames: map[string]Location{},
+		visited:     map[string]bool{},
+		suppressed:  map[string]*lintSuppressions{},
+	}
+	for i, stage := range recipe.Stages {
+		err = l.lintStage(i, stage)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return l.issues, nil
+}
+
+// matches the commands refreshing the apt package lists
+var aptUpdatePattern = regexp.MustCompile(`\bapt(-get)?\s+(-\S+\s+)*update\b`)
+
+// state of vib lint while walking a recipe
+type linter struct {
+	recipe      *api.Recipe
+	config      *LintConfig
+	issues      []LintIssue
+	moduleNames map[string]Location
+	visited     map[string]bool
+	suppressed  map[string]*lintSuppressions
+	aptUpdated  bool
+}
+
+// report records an issue at the given location, unless the rule is
+// off or the issue is suppressed
+func (l *linter) report(rule string, location Location, format string, args ...interface{}) {
+	severity := l.config.severity(rule)
+	if severity == LintOff || l.isSuppressed(rule, location) {
+		return
+	}
+	l.issues = append(l.issues, LintIssue{
+		Rule:     rule,
+		Severity: severity,
+		File:     location.File,
+		Line:     location.Line,
+		Column:   location.Column,
+		Path:     strings.Join(location.Path, " → "),
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+func (l *linter) lintStage(index int, stage api.Stage) error {
+	location, _ := StageLocation(l.recipe, index)
+
+	ids := stageIndexes(l.recipe)
+	for _, copy := range stage.Copy {
+		if copy.From == "" {
+			continue
+		}
+		declared, err := copyFromStage(ids, index, copy.From)
+		if err == nil && declared > index {
+			err = laterStageError(copy.From)
+		}
+		if err != nil {
+			l.report("copy-from-unknown-stage", location, "%s", err)
+		}
+	}
+
+	l.lintCleanup(stage.Cleanup, location)
+
+	l.aptUpdated = false
+	for _, command := range stage.Runs.Commands {
+		if aptUpdatePattern.MatchString(command) {
+			l.aptUpdated = true
+		}
+	}
+
+	for _, moduleInterface := range stage.Modules {
+		err := l.lintModule(moduleInterface)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lintModule checks a module after its nested modules, following the
+// order the modules are built in
+func (l *linter) lintModule(moduleInterface interface{}) error {
+	location, _ := ModuleLocation(l.recipe, moduleInterface)
+	name, _ := lookupKey(moduleInterface, "name").(string)
+	moduleType, _ := lookupKey(moduleInterface, "type").(string)
+
+	for _, nested := range nestedModules(moduleInterface) {
+		err := l.lintModule(nested)
+		if err != nil {
+			return err
+		}
+	}
+
+	if name != "" {
+		if previous, ok := l.moduleNames[name]; ok {
+			l.report("duplicate-module-name", location, "module name %s is already used at %s:%d:%d, both modules share sources/%s", name, previous.File, previous.Line, previous.Column, name)
+		} else {
+			l.moduleNames[name] = location
+		}
+	}
+
+	switch moduleType {
+	case "shell":
+		commands, _ := lookupKey(moduleInterface, "commands").([]interface{})
+		for _, command := range commands {
+			if command, ok := command.(string); ok && aptUpdatePattern.MatchString(command) {
+				l.aptUpdated = true
+			}
+		}
+	case "apt":
+		if !l.aptUpdated {
+			l.report("apt-update", location, "apt module %s is not preceded by apt-get update in this stage", name)
+		}
+	}
+
+	sources, err := moduleSources(moduleInterface)
+	if err != nil {
+		return locateError(location, err)
+	}
+	for _, source := range sources {
+		if strings.TrimSpace(source.Checksum) != "" {
+			if _, _, err := api.ParseChecksum(source.Checksum); err != nil {
+				l.report("source-checksum", location, "%s source %s: %s", source.Type, source.URL, err.Error())
+			}
+		}
+		switch source.Type {
+		case "tar", "file":
+			if strings.TrimSpace(source.Checksum) == "" {
+				l.report("source-checksum", location, "%s source %s has no checksum", source.Type, source.URL)
+			}
+		case "git":
+			if source.Tag == "" && (strings.TrimSpace(source.Commit) == "" || strings.EqualFold(source.Commit, "latest")) {
+				l.report("git-branch-pin", location, "git source %s is only pinned to branch %s", source.URL, source.Branch)
+			}
+		}
+	}
+
+	if cleanup, ok := lookupKey(moduleInterface, "cleanup").([]interface{}); ok {
+		paths := []string{}
+		for _, path := range cleanup {
+			if path, ok := path.(string); ok {
+				paths = append(paths, path)
+			}
+		}
+		l.lintCleanup(paths, location)
+	}
+
+	if moduleType == "includes" {
+		return l.lintIncludes(moduleInterface, location)
+	}
+	return nil
+}
+
+// lintIncludes checks the local modules of an includes module, remote
+// includes are not fetched
+func (l *linter) lintIncludes(moduleInterface interface{}, location Location) error {
+	var module IncludesModule
+	err := mapstructure.Decode(moduleInterface, &module)
+	if err != nil {
+		return locateError(location, err)
+	}
+	includes, err := resolveIncludes(l.recipe.ParentPath, module.Includes, module.Exclude)
+	if err != nil {
+		return locateError(location, err)
+	}
+
+	for _, include := range includes {
+		if isRemoteInclude(include) || l.visited[include] {
+			continue
+		}
+		l.visited[include] = true
+
+		modulePath := filepath.Join(l.recipe.ParentPath, include)
+		file := displayPath(l.recipe, modulePath)
+		includeModule, includeNode, err := genModule(modulePath, l.recipe.Vars)
+		if err != nil {
+			return locateError(location, fmt.Errorf("%s: %w", file, err))
+		}
+		registerModuleLocation(l.recipe, func(*yaml.Node) string { return file }, includeNode, includeModule, location.Path)
+
+		err = l.lintModule(includeModule)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *linter) lintCleanup(paths []string, location Location) {
+	prefixes := l.config.CleanupPrefixes
+	if len(prefixes) == 0 {
+		prefixes = DefaultCleanupPrefixes
+	}
+
+	for _, path := range paths {
+		expected := false
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(path, prefix) || path == strings.TrimSuffix(prefix, "/") {
+				expected = true
+				break
+			}
+		}
+		if !expected {
+			l.report("cleanup-prefix", location, "cleanup path %s is outside of the expected prefixes %s", path, strings.Join(prefixes, ", "))
+		}
+	}
+}
+
+// Rules suppressed in a file: by line, where an empty rule list
+// suppresses every rule, and for the whole file
+type lintSuppressions struct {
+	lines map[int][]string
+	file  []string
+}
+
+// matches # vib-lint-ignore and # vib-lint-ignore-file comments,
+// optionally followed by a list of rule ids
+var lintIgnorePattern = regexp.MustCompile(`#\s*vib-lint-ignore(-file)?\b:?\s*([A-Za-z0-9_,\s-]*)`)
+
+// isSuppressed reports whether a vib-lint-ignore comment on the line of
+// the location or on the line before it, or a vib-lint-ignore-file
+// comment anywhere in its file, suppresses the rule
+func (l *linter) isSuppressed(rule string, location Location) bool {
+	suppressions := l.suppressions(location.File)
+	if suppressions == nil {
+		return false
+	}
+	if suppressions.file != nil && ruleListed(rule, suppressions.file) {
+		return true
+	}
+	for _, line := range []int{location.Line, location.Line - 1} {
+		if rules, ok := suppressions.lines[line]; ok && ruleListed(rule, rules) {
+			return true
+		}
+	}
+	return false
+}
+
+// suppressions parses the suppression comments of a local file once
+func (l *linter) suppressions(file string) *lintSuppressions {
+	if suppressions, ok := l.suppressed[file]; ok {
+		return suppressions
+	}
+	l.suppressed[file] = nil
+
+	path := file
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(l.recipe.ParentPath, file)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+
+	suppressions := &lintSuppressions{lines: map[int][]string{}}
+	for i, line := range strings.Split(string(content), "\n") {
+		match := lintIgnorePattern.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		rules := strings.FieldsFunc(match[2], func(r rune) bool { return r == ',' || r == ' ' || r == '\t' })
+		if match[1] != "" {
+			suppressions.file = append(suppressions.file, rules...)
+			if len(rules) == 0 {
+				suppressions.file = append(suppressions.file, "*")
+			}
+			continue
+		}
+		suppressions.lines[i+1] = rules
+	}
+	l.suppressed[file] = suppressions
+	return suppressions
+}
+
+// ruleListed reports whether rule is in rules, an empty list or a *
+// stands for every rule
+func ruleListed(rule string, rules []string) bool {
+	if len(rules) == 0 {
+		return true
+	}
+	for _, listed := range rules {
+		if listed == rule || listed == "*" {
+			return true
+		}
+	}
+	return false
+}
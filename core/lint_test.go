@@ -0,0 +1,153 @@
+package core_test
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/vanilla-os/vib/core"
+)
+
+// Test that every lint rule reports its issue and that suppression
+// comments and the configuration silence them
+func TestLintRecipe(t *testing.T) {
+	path := writeRecipeFiles(t, map[string]string{
+		"recipe.yml": `name: Test
+id: test
+vibversion: 1.0.0
+stages:
+  - id: build
+    base: debian:sid-slim
+    copy:
+      - from: dist
+        srcdst:
+          /a: /a
+      - from: docker.io/library/alpine:latest
+        srcdst:
+          /b: /b
+    cleanup:
+      - /etc/passwd
+    modules:
+      - name: packages
+        type: apt
+        sources:
+          - packages:
+              - curl
+      - name: app
+        type: make
+        sources:
+          - type: tar
+            url: https://example.com/app.tar.gz
+          - type: git
+            url: https://example.com/app.git
+            branch: main
+      # vib-lint-ignore: apt-update
+      - name: ignored
+        type: apt
+        sources:
+          - packages:
+              - vim
+      - name: more
+        type: includes
+        includes:
+          - modules/more.yml
+  - id: dist
+    base: debian:sid-slim
+    modules:
+      - name: update
+        type: shell
+        commands:
+          - apt-get -q update
+      - name: tools
+        type: apt
+        sources:
+          - packages:
+              - git
+`,
+		"modules/more.yml": `name: app
+type: shell
+commands:
+  - echo app
+cleanup:
+  - /var/cache/apt
+`,
+	})
+
+	issues, err := core.LintRecipe(path, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rules := []string{}
+	for _, issue := range issues {
+		rules = append(rules, issue.Rule)
+	}
+	sort.Strings(rules)
+	expected := []string{"apt-update", "cleanup-prefix", "copy-from-unknown-stage", "duplicate-module-name", "git-branch-pin", "source-checksum"}
+	if strings.Join(rules, " ") != strings.Join(expected, " ") {
+		t.Fatalf("expected issues %v, got %v", expected, issues)
+	}
+
+	for _, issue := range issues {
+		if issue.Rule == "duplicate-module-name" && (issue.File != "modules/more.yml" || issue.Line != 1) {
+			t.Errorf("expected the duplicate module to be reported in modules/more.yml:1, got %s", issue)
+		}
+	}
+
+	config := &core.LintConfig{Rules: map[string]string{"git-branch-pin": core.LintOff, "apt-update": core.LintError}}
+	issues, err = core.LintRecipe(path, nil, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, issue := range issues {
+		if issue.Rule == "git-branch-pin" {
+			t.Errorf("expected git-branch-pin to be off, got %s", issue)
+		}
+		if issue.Rule == "apt-update" && issue.Severity != core.LintError {
+			t.Errorf("expected apt-update to be an error, got %s", issue)
+		}
+	}
+}
+
+// Test that vib lint diagnoses copy.from references as the build does
+func TestLintCopyFrom(t *testing.T) {
+	path := writeRecipeFiles(t, map[string]string{
+		"recipe.yml": `name: Test
+id: test
+vibversion: 1.0.0
+stages:
+  - id: build
+    base: debian:sid-slim
+    copy:
+      - from: build
+        srcdst:
+          /a: /a
+      - from: dist
+        srcdst:
+          /b: /b
+      - from: missing
+        srcdst:
+          /c: /c
+  - id: dist
+    base: debian:sid-slim
+`,
+	})
+
+	issues, err := core.LintRecipe(path, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages := []string{}
+	for _, issue := range issues {
+		messages = append(messages, issue.Message)
+	}
+	expected := []string{
+		"copy.from references stage build itself, a stage cannot copy from its own output",
+		"references stage dist, which is declared after it",
+		"copy.from references unknown stage missing",
+	}
+	if strings.Join(messages, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected messages %q, got %q", expected, messages)
+	}
+}
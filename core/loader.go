@@ -18,8 +18,16 @@ var Min_Recipe_Version = []uint8{1, 0, 0}
 
 // LoadRecipe loads a recipe from a file and returns a Recipe
 // Does not validate the recipe but it will catch some errors
-// a proper validation will be done in the future
-func LoadRecipe(path string) (*api.Recipe, error) {
+// a proper validation will be done in the future. The given
+// variables override the ones declared in the recipe
+func LoadRecipe(path string, vars map[string]string) (*api.Recipe, error) {
+	return loadRecipe(path, vars, true)
+}
+
+// loadRecipe loads a recipe as LoadRecipe does. Unless resetSources is
+// set, the sources and downloads directories next to the recipe are
+// left untouched and their paths are left for the caller to set
+func loadRecipe(path string, vars map[string]string, resetSources bool) (*api.Recipe, error) {
 	recipe := &api.Recipe{}
 
 	// we use the absolute path to the recipe file as the
@@ -29,24 +37,21 @@ func LoadRecipe(path string) (*api.Recipe, error) {
 		return nil, err
 	}
 
-	// here we open the recipe file and unmarshal it into
-	// the Recipe struct, this is not a full validation
-	// but it will catch some errors
-	recipeFile, err := os.Open(recipePath)
-	if err != nil {
-		return nil, err
-	}
-	defer recipeFile.Close()
-
-	recipeYAML, err := io.ReadAll(recipeFile)
+	// here we load the recipe, merged with the recipes it extends,
+	// and unmarshal it into the Recipe struct, this is not a full
+	// validation but it will catch some errors. The YAML tree is
+	// used to track where each stage and module is declared, so
+	// errors can point at the right line
+	tree, err := loadRecipeTree(recipePath, vars)
 	if err != nil {
 		return nil, err
 	}
 
-	err = yaml.Unmarshal(recipeYAML, recipe)
+	err = tree.root.Decode(recipe)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%s: %w", path, err)
 	}
+	recipe.Vars = tree.vars
 
 	if len(strings.TrimSpace(recipe.Vibversion)) <= 0 {
 		return nil, fmt.Errorf("version key not found in recipe file, assuming outdated recipe")
@@ -78,33 +83,49 @@ func LoadRecipe(path string) (*api.Recipe, error) {
 	// for convenience
 	recipe.Path = recipePath
 	recipe.ParentPath = filepath.Dir(recipePath)
+	registerRecipeLocations(recipe, tree)
 
-	// we create the sources directory which is the place where
-	// all the sources will be stored and be available to all
-	// the modules
-	recipe.SourcesPath = filepath.Join(filepath.Dir(recipePath), "sources")
-	err = os.RemoveAll(recipe.SourcesPath)
+	// when the recipe comes with a lock file, the remote files and
+	// git sources it uses must match the recorded state
+	recipe.Lock, err = LoadLock(filepath.Join(recipe.ParentPath, LockFileName))
 	if err != nil {
 		return nil, err
 	}
-	err = os.MkdirAll(recipe.SourcesPath, 0755)
-	if err != nil {
-		return nil, err
+	for url, sum := range tree.remotes {
+		err = verifyLockedHash(recipe.Lock, url, sum)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	// the downloads directory is a transient directory, here all
-	// the downloaded sources will be stored before being moved
-	// to the sources directory. This is useful since some sources
-	// types need to be extracted, this way we can extract them
-	// directly to the sources directory after downloading them
-	recipe.DownloadsPath = filepath.Join(filepath.Dir(recipePath), "downloads")
-	err = os.RemoveAll(recipe.DownloadsPath)
-	if err != nil {
-		return nil, err
-	}
-	err = os.MkdirAll(recipe.DownloadsPath, 0755)
-	if err != nil {
-		return nil, err
+	if resetSources {
+		// we create the sources directory which is the place where
+		// all the sources will be stored and be available to all
+		// the modules
+		recipe.SourcesPath = filepath.Join(filepath.Dir(recipePath), "sources")
+		err = os.RemoveAll(recipe.SourcesPath)
+		if err != nil {
+			return nil, err
+		}
+		err = os.MkdirAll(recipe.SourcesPath, 0755)
+		if err != nil {
+			return nil, err
+		}
+
+		// the downloads directory is a transient directory, here all
+		// the downloaded sources will be stored before being moved
+		// to the sources directory. This is useful since some sources
+		// types need to be extracted, this way we can extract them
+		// directly to the sources directory after downloading them
+		recipe.DownloadsPath = filepath.Join(filepath.Dir(recipePath), "downloads")
+		err = os.RemoveAll(recipe.DownloadsPath)
+		if err != nil {
+			return nil, err
+		}
+		err = os.MkdirAll(recipe.DownloadsPath, 0755)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	// the plugins directory contains all plugins that vib can load
@@ -131,12 +152,13 @@ func LoadRecipe(path string) (*api.Recipe, error) {
 
 	for i, stage := range recipe.Stages {
 		// here we check if the extra Adds path exists
-		for _, add := range stage.Adds {
-			for src := range add.SrcDst {
+		for j, add := range stage.Adds {
+			for _, src := range stageKeys(recipe, i, fmt.Sprintf("adds.%d.srcdst", j), add.SrcDst) {
 				fullPath := filepath.Join(filepath.Dir(recipePath), src)
 				_, err = os.Stat(fullPath)
 				if os.IsNotExist(err) {
-					return nil, err
+					location, _ := StageLocation(recipe, i)
+					return nil, locateError(location, err)
 				}
 			}
 		}
@@ -199,30 +221,68 @@ func downloadGhRecipe(gh string) (path string, err error) {
 
 // GenModule generate a Module struct from a module path
 func GenModule(modulePath string) (map[string]interface{}, error) {
+	module, _, err := genModule(modulePath, nil)
+	return module, err
+}
+
+// genModule generates a module from a module path, interpolating the
+// given variables, and returns it along with its YAML tree, used to
+// locate the module and its nested modules
+func genModule(modulePath string, vars map[string]string) (map[string]interface{}, *yaml.Node, error) {
 	var module map[string]interface{}
 
 	moduleFile, err := os.Open(modulePath)
 	if err != nil {
-		return module, err
+		return module, nil, err
 	}
 	defer moduleFile.Close()
 
 	moduleYAML, err := io.ReadAll(moduleFile)
 	if err != nil {
-		return module, err
+		return module, nil, err
+	}
+
+	var document yaml.Node
+	err = yaml.Unmarshal(moduleYAML, &document)
+	if err != nil {
+		return module, nil, err
+	}
+	if len(document.Content) == 0 {
+		return module, nil, fmt.Errorf("empty module file")
 	}
 
-	err = yaml.Unmarshal(moduleYAML, &module)
+	root := resolveAlias(document.Content[0])
+	interpolateNode(root, vars)
+	err = root.Decode(&module)
 	if err != nil {
-		return module, err
+		return module, nil, err
 	}
 
-	return module, nil
+	return module, root, nil
 }
 
-// TestRecipe validates a recipe by loading it and checking for errors
-func TestRecipe(path string) (*api.Recipe, error) {
-	recipe, err := LoadRecipe(path)
+// TestRecipe validates a recipe by checking it against the recipe schema,
+// then loading it and checking for errors
+func TestRecipe(path string, vars map[string]string) (*api.Recipe, error) {
+	schemaErrors, err := ValidateRecipeSchema(path, vars)
+	if err != nil {
+		fmt.Printf("Error validating recipe: %s\n", err)
+		return nil, err
+	}
+	if len(schemaErrors) > 0 {
+		for _, schemaError := range schemaErrors {
+			fmt.Println(schemaError)
+		}
+		return nil, fmt.Errorf("recipe %s does not match the schema: %d errors found", path, len(schemaErrors))
+	}
+
+	recipe, err := LoadRecipe(path, vars)
+	if err != nil {
+		fmt.Printf("Error validating recipe: %s\n", err)
+		return nil, err
+	}
+
+	_, err = BuildStageGraph(recipe)
 	if err != nil {
 		fmt.Printf("Error validating recipe: %s\n", err)
 		return nil, err
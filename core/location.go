@@ -0,0 +1,208 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/vanilla-os/vib/api"
+	"gopkg.in/yaml.v3"
+)
+
+// Position of a stage or module in the file it was declared in, along
+// with the chain of stage and module names leading to it
+type Location struct {
+	File   string
+	Line   int
+	Column int
+	Path   []string
+}
+
+func (l Location) String() string {
+	position := fmt.Sprintf("%s:%d:%d", l.File, l.Line, l.Column)
+	if len(l.Path) == 0 {
+		return position
+	}
+	return fmt.Sprintf("%s: %s", position, strings.Join(l.Path, " → "))
+}
+
+// Error raised while loading or building a stage or module, reported
+// together with the location of the stage or module
+type LocatedError struct {
+	Location Location
+	Err      error
+}
+
+func (e *LocatedError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Location, e.Err)
+}
+
+func (e *LocatedError) Unwrap() error {
+	return e.Err
+}
+
+// locateError prefixes err with the given location, unless it already
+// carries a more precise one
+func locateError(location Location, err error) error {
+	var located *LocatedError
+	if err == nil || errors.As(err, &located) {
+		return err
+	}
+	return &LocatedError{Location: location, Err: err}
+}
+
+// Location of a module, along with the module itself so that its map,
+// whose address is the key of the location, is not reused meanwhile, and
+// the YAML node it was decoded from, nil for modules built from code
+type moduleLocation struct {
+	module   interface{}
+	location Location
+	node     *yaml.Node
+}
+
+func moduleKey(moduleInterface interface{}) (uintptr, bool) {
+	value := reflect.ValueOf(moduleInterface)
+	if value.Kind() != reflect.Map || value.IsNil() {
+		return 0, false
+	}
+	return value.Pointer(), true
+}
+
+// ModuleLocation returns the location of a module loaded from the recipe
+// or from an included file
+func ModuleLocation(recipe *api.Recipe, moduleInterface interface{}) (Location, bool) {
+	key, ok := moduleKey(moduleInterface)
+	if !ok {
+		return Location{}, false
+	}
+	location, ok := getBuildState(recipe).moduleLocations[key]
+	return location.location, ok
+}
+
+// moduleYAMLNode returns the YAML node a module was decoded from, if any
+func moduleYAMLNode(recipe *api.Recipe, moduleInterface interface{}) *yaml.Node {
+	key, ok := moduleKey(moduleInterface)
+	if !ok {
+		return nil
+	}
+	return getBuildState(recipe).moduleLocations[key].node
+}
+
+// StageLocation returns the location of the stage at the given index
+func StageLocation(recipe *api.Recipe, index int) (Location, bool) {
+	locations := getBuildState(recipe).stageLocations
+	if index < 0 || index >= len(locations) {
+		return Location{}, false
+	}
+	return locations[index], true
+}
+
+// displayPath returns path relative to the recipe directory when
+// possible, which is how users refer to files in their recipes
+func displayPath(recipe *api.Recipe, path string) string {
+	if recipe.ParentPath == "" || !filepath.IsAbs(path) {
+		return path
+	}
+	relative, err := filepath.Rel(recipe.ParentPath, path)
+	if err != nil || strings.HasPrefix(relative, "..") {
+		return path
+	}
+	return relative
+}
+
+func stageLabel(stage api.Stage, index int) string {
+	if stage.Id != "" {
+		return "stage " + stage.Id
+	}
+	return fmt.Sprintf("stage #%d", index)
+}
+
+func moduleLabel(moduleInterface interface{}) string {
+	name, _ := lookupKey(moduleInterface, "name").(string)
+	return "module " + name
+}
+
+// lookupKey returns the value stored under key in a module map, keys
+// are matched case-insensitively as mapstructure does
+func lookupKey(moduleInterface interface{}, key string) interface{} {
+	module, ok := moduleInterface.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	if value, ok := module[key]; ok {
+		return value
+	}
+	for name, value := range module {
+		if strings.EqualFold(name, key) {
+			return value
+		}
+	}
+	return nil
+}
+
+// nestedModules returns the nested modules of a module map as they were
+// loaded, mapstructure would copy them and lose track of their location
+func nestedModules(moduleInterface interface{}) []interface{} {
+	modules, _ := lookupKey(moduleInterface, "modules").([]interface{})
+	return modules
+}
+
+// registerRecipeLocations records the location of every stage and module
+// of a recipe, along with the order of the keys of the stage maps, by
+// walking its YAML tree alongside the decoded recipe
+func registerRecipeLocations(recipe *api.Recipe, tree *recipeTree) {
+	locations := make([]Location, len(recipe.Stages))
+	orders := make([]map[string][]string, len(recipe.Stages))
+	stagesNode := mappingValue(tree.root, "stages", false)
+
+	for i, stage := range recipe.Stages {
+		location := Location{File: tree.fileOf(tree.root), Path: []string{stageLabel(stage, i)}}
+		var stageNode *yaml.Node
+		if stagesNode != nil && stagesNode.Kind == yaml.SequenceNode && i < len(stagesNode.Content) {
+			stageNode = resolveAlias(stagesNode.Content[i])
+			location.File = tree.fileOf(stageNode)
+			location.Line = stageNode.Line
+			location.Column = stageNode.Column
+		}
+		locations[i] = location
+		orders[i] = registerStageKeyOrder(stageNode)
+
+		registerModulesLocations(recipe, tree.fileOf, mappingValue(stageNode, "modules", false), stage.Modules, location.Path)
+	}
+
+	getBuildState(recipe).stageLocations = locations
+	getBuildState(recipe).stageKeyOrders = orders
+}
+
+// registerModulesLocations records the location of a list of modules
+// and, recursively, of their nested modules
+func registerModulesLocations(recipe *api.Recipe, fileOf func(*yaml.Node) string, node *yaml.Node, modules []interface{}, parent []string) {
+	for i, moduleInterface := range modules {
+		var moduleNode *yaml.Node
+		if node != nil && node.Kind == yaml.SequenceNode && i < len(node.Content) {
+			moduleNode = resolveAlias(node.Content[i])
+		}
+		registerModuleLocation(recipe, fileOf, moduleNode, moduleInterface, parent)
+	}
+}
+
+// registerModuleLocation records the location of a single module and of
+// its nested modules, fileOf returns the file each node was read from
+func registerModuleLocation(recipe *api.Recipe, fileOf func(*yaml.Node) string, node *yaml.Node, moduleInterface interface{}, parent []string) {
+	key, ok := moduleKey(moduleInterface)
+	if !ok {
+		return
+	}
+
+	path := append(append([]string{}, parent...), moduleLabel(moduleInterface))
+	location := Location{File: fileOf(node), Path: path}
+	if node != nil {
+		location.Line = node.Line
+		location.Column = node.Column
+	}
+	getBuildState(recipe).moduleLocations[key] = moduleLocation{module: moduleInterface, location: location, node: node}
+
+	registerModulesLocations(recipe, fileOf, mappingValue(node, "modules", true), nestedModules(moduleInterface), path)
+}
@@ -0,0 +1,49 @@
+package core_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/vanilla-os/vib/core"
+)
+
+// Test that build errors point at the failing module, also across included files
+func TestBuildErrorLocation(t *testing.T) {
+	path := writeRecipeFiles(t, map[string]string{
+		"recipe.yml": `name: Test
+id: test
+vibversion: 1.0.0
+stages:
+  - id: build
+    base: debian:sid-slim
+    modules:
+      - name: outer
+        type: shell
+        commands:
+          - echo outer
+        modules:
+          - name: included
+            type: includes
+            includes:
+              - modules/broken.yml
+`,
+		"modules/broken.yml": `name: broken-parent
+type: shell
+commands:
+  - echo parent
+modules:
+  - name: broken
+    type: shell
+`,
+	})
+
+	_, err := core.BuildRecipe(path, "amd64", core.BuildOptions{})
+	if err == nil {
+		t.Fatal("expected BuildRecipe to fail")
+	}
+
+	expected := "modules/broken.yml:6:5: stage build → module outer → module included → module broken-parent → module broken: no commands specified"
+	if !strings.HasSuffix(err.Error(), expected) {
+		t.Errorf("expected error %q, got %q", expected, err.Error())
+	}
+}
@@ -0,0 +1,387 @@
+package core
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/vanilla-os/vib/api"
+	"gopkg.in/yaml.v3"
+)
+
+// Name of the lock file, stored next to the recipe
+const LockFileName = "vib.lock"
+
+const lockHeader = "# This file is generated by vib lock, do not edit it manually\n"
+
+// LoadLock reads the lock file at path, a missing lock file is not an
+// error and results in a nil lock
+func LoadLock(path string) (*api.Lock, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	lock := &api.Lock{}
+	err = yaml.Unmarshal(data, lock)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return lock, nil
+}
+
+// WriteLock writes the lock file at path, with its entries sorted so
+// that the file only changes when the resolved state does
+func WriteLock(path string, lock *api.Lock) error {
+	sortLock(lock)
+
+	var data strings.Builder
+	data.WriteString(lockHeader)
+	encoder := yaml.NewEncoder(&data)
+	encoder.SetIndent(2)
+	err := encoder.Encode(lock)
+	if err != nil {
+		return err
+	}
+	err = encoder.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, []byte(data.String()), 0644)
+}
+
+func sortLock(lock *api.Lock) {
+	sort.Slice(lock.Includes, func(i, j int) bool {
+		return lock.Includes[i].URL < lock.Includes[j].URL
+	})
+	sort.Slice(lock.Sources, func(i, j int) bool {
+		a, b := lock.Sources[i], lock.Sources[j]
+		if a.Module != b.Module {
+			return a.Module < b.Module
+		}
+		if a.URL != b.URL {
+			return a.URL < b.URL
+		}
+		return a.Ref < b.Ref
+	})
+}
+
+// DiffLock describes the entries that differ between two locks, an
+// empty result means the locks are equivalent
+func DiffLock(current *api.Lock, resolved *api.Lock) []string {
+	if current == nil {
+		current = &api.Lock{}
+	}
+
+	var changes []string
+	for _, include := range resolved.Includes {
+		locked, ok := current.Include(include.URL)
+		if !ok {
+			changes = append(changes, fmt.Sprintf("include %s is not locked", include.URL))
+		} else if locked.Sha256 != include.Sha256 {
+			changes = append(changes, fmt.Sprintf("include %s changed: sha256 %s → %s", include.URL, locked.Sha256, include.Sha256))
+		}
+	}
+	for _, source := range resolved.Sources {
+		locked, ok := findLockedSource(current, source)
+		if !ok {
+			changes = append(changes, fmt.Sprintf("git source %s (%s) of module %s is not locked", source.URL, source.Ref, source.Module))
+		} else if locked.Commit != source.Commit {
+			changes = append(changes, fmt.Sprintf("git source %s (%s) of module %s changed: commit %s → %s", source.URL, source.Ref, source.Module, locked.Commit, source.Commit))
+		}
+	}
+
+	resolvedIncludes := map[string]bool{}
+	for _, include := range resolved.Includes {
+		resolvedIncludes[include.URL] = true
+	}
+	for _, include := range current.Includes {
+		if !resolvedIncludes[include.URL] {
+			changes = append(changes, fmt.Sprintf("include %s is no longer used", include.URL))
+		}
+	}
+	for _, locked := range current.Sources {
+		if _, ok := findLockedSource(resolved, locked); !ok {
+			changes = append(changes, fmt.Sprintf("git source %s (%s) of module %s is no longer used", locked.URL, locked.Ref, locked.Module))
+		}
+	}
+
+	return changes
+}
+
+// findLockedSource finds the entry of lock locking the same module,
+// repository and reference as source
+func findLockedSource(lock *api.Lock, source api.LockedSource) (api.LockedSource, bool) {
+	for _, locked := range lock.Sources {
+		if locked.Module == source.Module && locked.URL == source.URL && locked.Ref == source.Ref {
+			return locked, true
+		}
+	}
+	return api.LockedSource{}, false
+}
+
+// ResolveLock resolves the remote includes and the git sources of the
+// recipe at path: remote files are downloaded and hashed, git references
+// are resolved to the commit they currently point to
+func ResolveLock(path string, vars map[string]string) (*api.Lock, error) {
+	tree, err := loadRecipeTree(path, vars)
+	if err != nil {
+		return nil, err
+	}
+
+	recipe := &api.Recipe{}
+	err = tree.root.Decode(recipe)
+	if err != nil {
+		return nil, err
+	}
+	recipePath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	recipe.ParentPath = filepath.Dir(recipePath)
+	recipe.Vars = tree.vars
+
+	// git includes are cloned in a throwaway downloads directory
+	recipe.DownloadsPath, err = os.MkdirTemp("", "vib-lock-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(recipe.DownloadsPath)
+
+	resolver := &lockResolver{
+		recipe:   recipe,
+		lock:     &api.Lock{},
+		includes: map[string]bool{},
+		visited:  map[string]bool{},
+	}
+	for url, sum := range tree.remotes {
+		resolver.addInclude(url, sum)
+	}
+	for _, stage := range recipe.Stages {
+		err = resolver.resolveModules(stage.Modules)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sortLock(resolver.lock)
+	return resolver.lock, nil
+}
+
+// state of the walk of the modules of a recipe done by ResolveLock
+type lockResolver struct {
+	recipe   *api.Recipe
+	lock     *api.Lock
+	includes map[string]bool
+	visited  map[string]bool
+}
+
+func (r *lockResolver) addInclude(url string, sum string) {
+	if r.includes[url] {
+		return
+	}
+	r.includes[url] = true
+	r.lock.Includes = append(r.lock.Includes, api.LockedInclude{URL: url, Sha256: sum})
+}
+
+func (r *lockResolver) resolveModules(modules []interface{}) error {
+	for _, moduleInterface := range modules {
+		err := r.resolveModule(moduleInterface)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolveModule records the git sources of a module and walks its
+// nested and included modules
+func (r *lockResolver) resolveModule(moduleInterface interface{}) error {
+	name, _ := lookupKey(moduleInterface, "name").(string)
+
+	sources, err := moduleSources(moduleInterface)
+	if err != nil {
+		return fmt.Errorf("module %s: %w", name, err)
+	}
+
+	for _, source := range sources {
+		if source.Type != "git" {
+			continue
+		}
+		if _, ok := r.lock.Source(source, name); ok {
+			continue
+		}
+		fmt.Printf("Resolving git source: %s (%s)\n", source.URL, api.GitRef(source))
+		commit, err := resolveGitCommit(source)
+		if err != nil {
+			return fmt.Errorf("module %s: cannot resolve %s (%s): %w", name, source.URL, api.GitRef(source), err)
+		}
+		r.lock.Sources = append(r.lock.Sources, api.LockedSource{
+			Module: name,
+			URL:    source.URL,
+			Ref:    api.GitRef(source),
+			Commit: commit,
+		})
+	}
+
+	err = r.resolveModules(nestedModules(moduleInterface))
+	if err != nil {
+		return err
+	}
+
+	moduleType, _ := lookupKey(moduleInterface, "type").(string)
+	if moduleType != "includes" {
+		return nil
+	}
+	var module IncludesModule
+	err = mapstructure.Decode(moduleInterface, &module)
+	if err != nil {
+		return fmt.Errorf("module %s: %w", name, err)
+	}
+	includes, err := resolveIncludes(r.recipe.ParentPath, module.Includes, module.Exclude)
+	if err != nil {
+		return fmt.Errorf("module %s: %w", name, err)
+	}
+	for _, include := range includes {
+		if r.visited[include] {
+			continue
+		}
+		r.visited[include] = true
+
+		modulePath, remote, err := includePath(r.recipe, include)
+		if err != nil {
+			return fmt.Errorf("module %s: %w", name, err)
+		}
+		if remote {
+			sum, err := hashFile(modulePath)
+			if err != nil {
+				return err
+			}
+			r.addInclude(include, sum)
+		}
+
+		includeModule, _, err := genModule(modulePath, r.recipe.Vars)
+		if err != nil {
+			return fmt.Errorf("%s: %w", include, err)
+		}
+		err = r.resolveModule(includeModule)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moduleSources returns the sources a module declares, either with the
+// source or with the sources key
+func moduleSources(moduleInterface interface{}) ([]api.Source, error) {
+	var sources []api.Source
+	if source := lookupKey(moduleInterface, "source"); source != nil {
+		var decoded api.Source
+		err := mapstructure.Decode(source, &decoded)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, decoded)
+	}
+	if list := lookupKey(moduleInterface, "sources"); list != nil {
+		var decoded []api.Source
+		err := mapstructure.Decode(list, &decoded)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, decoded...)
+	}
+	return sources, nil
+}
+
+// resolveGitCommit returns the commit a git source currently points to,
+// commits are recorded as they are declared
+func resolveGitCommit(source api.Source) (string, error) {
+	if len(strings.TrimSpace(source.Commit)) > 0 && !strings.EqualFold(source.Commit, "latest") && source.Tag == "" {
+		return source.Commit, nil
+	}
+
+	var refs []string
+	if source.Tag != "" {
+		// annotated tags are peeled to the commit they point to
+		refs = []string{"refs/tags/" + source.Tag + "^{}", "refs/tags/" + source.Tag}
+	} else {
+		refs = []string{"refs/heads/" + source.Branch}
+	}
+
+	out, err := exec.Command("git", append([]string{"ls-remote", source.URL}, refs...)...).Output()
+	if err != nil {
+		return "", err
+	}
+
+	commits := map[string]string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 {
+			commits[fields[1]] = fields[0]
+		}
+	}
+	for _, ref := range refs {
+		if commit, ok := commits[ref]; ok {
+			return commit, nil
+		}
+	}
+	return "", fmt.Errorf("reference not found")
+}
+
+// hashFile returns the hex encoded SHA-256 of the file at path
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
+
+// verifyLockedInclude checks that a downloaded include or base recipe
+// matches the hash recorded in the lock, if the recipe has one
+func verifyLockedInclude(lock *api.Lock, url string, path string) error {
+	if lock == nil {
+		return nil
+	}
+
+	sum, err := hashFile(path)
+	if err != nil {
+		return err
+	}
+	return verifyLockedHash(lock, url, sum)
+}
+
+func verifyLockedHash(lock *api.Lock, url string, sum string) error {
+	if lock == nil {
+		return nil
+	}
+
+	locked, ok := lock.Include(url)
+	if !ok {
+		return fmt.Errorf("remote file %s is not in the lock file, run vib lock --update", url)
+	}
+	if locked.Sha256 != sum {
+		return fmt.Errorf("remote file %s drifted from the lock file: expected sha256 %s, got %s, run vib lock --update to accept it", url, locked.Sha256, sum)
+	}
+	return nil
+}
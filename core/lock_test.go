@@ -0,0 +1,160 @@
+package core_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/vanilla-os/vib/core"
+)
+
+// Test that the lock records remote includes and git sources, and that
+// builds fail once a remote include drifts from it
+func TestLockRecipe(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	repo := t.TempDir()
+	for _, args := range [][]string{
+		{"init", "-q", "-b", "main"},
+		{"-c", "user.name=vib", "-c", "user.email=vib@localhost", "commit", "-q", "--allow-empty", "-m", "initial"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repo
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %s: %s", args[0], out)
+		}
+	}
+	head, err := exec.Command("git", "-C", repo, "rev-parse", "HEAD").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	remote := "name: remote\ntype: shell\ncommands:\n  - echo remote\n"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(remote))
+	}))
+	defer server.Close()
+
+	path := writeRecipeFiles(t, map[string]string{
+		"recipe.yml": `name: Test
+id: test
+vibversion: 1.0.0
+stages:
+  - id: build
+    base: debian:sid-slim
+    modules:
+      - name: app
+        type: shell
+        source:
+          type: git
+          url: ` + repo + `
+          branch: main
+        commands:
+          - echo app
+      - name: remote
+        type: includes
+        includes:
+          - ` + server.URL + `/remote.yml
+`,
+	})
+
+	lock, err := core.ResolveLock(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lock.Includes) != 1 || lock.Includes[0].URL != server.URL+"/remote.yml" {
+		t.Fatalf("unexpected locked includes %v", lock.Includes)
+	}
+	if len(lock.Sources) != 1 || lock.Sources[0].Commit != strings.TrimSpace(string(head)) {
+		t.Fatalf("unexpected locked sources %v", lock.Sources)
+	}
+
+	err = core.WriteLock(filepath.Join(filepath.Dir(path), core.LockFileName), lock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = core.BuildRecipe(path, "amd64", core.BuildOptions{})
+	if err != nil {
+		t.Fatalf("expected the locked recipe to build, got %s", err)
+	}
+
+	remote = "name: remote\ntype: shell\ncommands:\n  - echo changed\n"
+	_, err = core.BuildRecipe(path, "amd64", core.BuildOptions{})
+	if err == nil || !strings.Contains(err.Error(), "drifted from the lock file") {
+		t.Fatalf("expected a drift error, got %v", err)
+	}
+
+	resolved, err := core.ResolveLock(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changes := core.DiffLock(lock, resolved); len(changes) != 1 {
+		t.Errorf("expected one change, got %v", changes)
+	}
+}
+
+// Test that a locked git source is checked out at its locked commit once
+// the branch it follows has moved
+func TestLockRecipeMovedBranch(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	repo := t.TempDir()
+	git := func(args ...string) string {
+		t.Helper()
+		cmd := exec.Command("git", append([]string{"-c", "user.name=vib", "-c", "user.email=vib@localhost"}, args...)...)
+		cmd.Dir = repo
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %s: %s", args[0], out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	git("init", "-q", "-b", "main")
+	git("commit", "-q", "--allow-empty", "-m", "initial")
+	locked := git("rev-parse", "HEAD")
+
+	path := writeRecipeFiles(t, map[string]string{
+		"recipe.yml": `name: Test
+id: test
+vibversion: 1.0.0
+stages:
+  - id: build
+    base: debian:sid-slim
+    modules:
+      - name: app
+        type: shell
+        sources:
+          - type: git
+            url: ` + repo + `
+            branch: main
+        commands:
+          - echo app
+`,
+	})
+
+	lock, err := core.ResolveLock(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = core.WriteLock(filepath.Join(filepath.Dir(path), core.LockFileName), lock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	git("commit", "-q", "--allow-empty", "-m", "moved")
+	_, err = core.BuildRecipe(path, "amd64", core.BuildOptions{})
+	if err != nil {
+		t.Fatalf("expected the locked recipe to build once the branch moved, got %s", err)
+	}
+
+	cmd := exec.Command("git", "rev-parse", "HEAD")
+	cmd.Dir = filepath.Join(filepath.Dir(path), "sources", "app", filepath.Base(repo))
+	head, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(string(head)) != locked {
+		t.Errorf("expected the locked commit %s to be checked out, got %s", locked, head)
+	}
+}
@@ -0,0 +1,69 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/vanilla-os/vib/api"
+	"gopkg.in/yaml.v3"
+)
+
+// registerStageKeyOrder records the declared order of the keys of the
+// maps of a stage
+func registerStageKeyOrder(stageNode *yaml.Node) map[string][]string {
+	orders := map[string][]string{}
+	for _, field := range []string{"labels", "env", "args", "expose"} {
+		orders[field] = mappingKeys(mappingValue(stageNode, field, false))
+	}
+	for _, field := range []string{"copy", "adds"} {
+		list := mappingValue(stageNode, field, false)
+		if list == nil || list.Kind != yaml.SequenceNode {
+			continue
+		}
+		for i, item := range list.Content {
+			orders[fmt.Sprintf("%s.%d.srcdst", field, i)] = mappingKeys(mappingValue(resolveAlias(item), "srcdst", false))
+		}
+	}
+	return orders
+}
+
+// mappingKeys returns the keys of a mapping node in declared order
+func mappingKeys(node *yaml.Node) []string {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	keys := make([]string, 0, len(node.Content)/2)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		keys = append(keys, node.Content[i].Value)
+	}
+	return keys
+}
+
+// stageKeys returns the keys of a map of the stage at the given index,
+// in the order they are declared in. Keys with no recorded order, e.g.
+// for recipes built from code, follow in lexical order
+func stageKeys(recipe *api.Recipe, index int, field string, values map[string]string) []string {
+	var declared []string
+	if orders := getBuildState(recipe).stageKeyOrders; index < len(orders) {
+		declared = orders[index][field]
+	}
+
+	keys := make([]string, 0, len(values))
+	seen := map[string]bool{}
+	for _, key := range declared {
+		if _, ok := values[key]; ok && !seen[key] {
+			keys = append(keys, key)
+			seen[key] = true
+		}
+	}
+
+	rest := []string{}
+	for key := range values {
+		if !seen[key] {
+			rest = append(rest, key)
+		}
+	}
+	sort.Strings(rest)
+
+	return append(keys, rest...)
+}
@@ -0,0 +1,177 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/vanilla-os/vib/api"
+)
+
+// Plan of the build of a recipe: its stages, the tree of their modules
+// with the included ones, and the commands written for each of them
+type Plan struct {
+	Name          string       `json:"name"`
+	Id            string       `json:"id"`
+	Arch          string       `json:"arch"`
+	Target        string       `json:"target,omitempty"`
+	Stages        []*StagePlan `json:"stages"`
+	Containerfile string       `json:"containerfile"`
+}
+
+// Plan of a stage, stages whose condition is false are skipped
+type StagePlan struct {
+	Id        string        `json:"id"`
+	Base      string        `json:"base"`
+	Condition string        `json:"if,omitempty"`
+	Skipped   bool          `json:"skipped"`
+	Modules   []*ModulePlan `json:"modules"`
+}
+
+// Plan of a module. Handler is builtin for the modules built by vib
+// itself and plugin for the others, Commands are the instructions the
+// module writes, without those of its nested modules
+type ModulePlan struct {
+	Name      string        `json:"name"`
+	Type      string        `json:"type"`
+	Handler   string        `json:"handler"`
+	Location  string        `json:"location,omitempty"`
+	Condition string        `json:"if,omitempty"`
+	Skipped   bool          `json:"skipped"`
+	Workdir   string        `json:"workdir,omitempty"`
+	Sources   []api.Source  `json:"sources,omitempty"`
+	Commands  []string      `json:"commands"`
+	Modules   []*ModulePlan `json:"modules"`
+}
+
+// Plan being recorded for a recipe, kept in its build state as
+// BuildModule only gets the recipe and the module
+type planRecorder struct {
+	plan   *Plan
+	stage  *StagePlan
+	parent []*ModulePlan
+}
+
+// PlanRecipe returns the plan of the build of the recipe, generating the
+// Containerfile as vib build does without writing it. As for vib build,
+// the sources are fetched, since plugins read them to write their commands,
+// but in temporary directories, leaving those of the last build in place
+func PlanRecipe(recipePath string, arch string, options BuildOptions) (*Plan, error) {
+	recipe, err := loadRecipe(recipePath, options.Vars, false)
+	if err != nil {
+		return nil, err
+	}
+	recipe.Target = options.Target
+	getBuildState(recipe).prefetchJobs = options.PrefetchJobs()
+
+	recipe.SourcesPath, err = os.MkdirTemp("", "vib-plan-sources-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(recipe.SourcesPath)
+	recipe.DownloadsPath, err = os.MkdirTemp("", "vib-plan-downloads-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(recipe.DownloadsPath)
+
+	plan := &Plan{Name: recipe.Name, Id: recipe.Id, Arch: arch, Target: options.Target, Stages: []*StagePlan{}}
+	getBuildState(recipe).planRecorder = &planRecorder{plan: plan}
+
+	containerfile, err := GenerateContainerfile(recipe, arch)
+	if err != nil {
+		return nil, err
+	}
+	plan.Containerfile, err = containerfile.Emit()
+	if err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+// recordStage starts the plan of a stage
+func recordStage(recipe *api.Recipe, stage api.Stage, skipped bool) {
+	recorder := getBuildState(recipe).planRecorder
+	if recorder == nil {
+		return
+	}
+	recorder.stage = &StagePlan{Id: stage.Id, Base: stage.Base, Condition: stage.If, Skipped: skipped, Modules: []*ModulePlan{}}
+	recorder.plan.Stages = append(recorder.plan.Stages, recorder.stage)
+}
+
+// recordModule adds the plan of a module to its stage or to the module
+// being built, which becomes its parent until endModule
+func recordModule(recipe *api.Recipe, module Module, moduleInterface interface{}, location Location, condition string, skipped bool, arch string) *ModulePlan {
+	recorder := getBuildState(recipe).planRecorder
+	if recorder == nil || recorder.stage == nil {
+		return nil
+	}
+
+	handler := "plugin"
+	if module.Type == "shell" || module.Type == "includes" {
+		handler = "builtin"
+	}
+	modulePlan := &ModulePlan{
+		Name:      module.Name,
+		Type:      module.Type,
+		Handler:   handler,
+		Location:  fmt.Sprintf("%s:%d:%d", location.File, location.Line, location.Column),
+		Condition: condition,
+		Skipped:   skipped,
+		Workdir:   module.Workdir,
+		Commands:  []string{},
+		Modules:   []*ModulePlan{},
+	}
+	if location.Line == 0 {
+		modulePlan.Location = ""
+	}
+
+	// the sources fetched for the architecture, packages of the
+	// package managers are not fetched by vib
+	sources, _ := moduleSources(moduleInterface)
+	for _, source := range sources {
+		if strings.TrimSpace(source.Type) != "" && api.TestArch(source.OnlyArches, arch) {
+			modulePlan.Sources = append(modulePlan.Sources, source)
+		}
+	}
+
+	if len(recorder.parent) > 0 {
+		parent := recorder.parent[len(recorder.parent)-1]
+		parent.Modules = append(parent.Modules, modulePlan)
+	} else {
+		recorder.stage.Modules = append(recorder.stage.Modules, modulePlan)
+	}
+	if !skipped {
+		recorder.parent = append(recorder.parent, modulePlan)
+	}
+	return modulePlan
+}
+
+// endModule records the commands of a module, once it is built
+func endModule(recipe *api.Recipe, modulePlan *ModulePlan, instructions []Instruction) error {
+	recorder := getBuildState(recipe).planRecorder
+	if recorder == nil || modulePlan == nil {
+		return nil
+	}
+	if len(recorder.parent) > 0 && recorder.parent[len(recorder.parent)-1] == modulePlan {
+		recorder.parent = recorder.parent[:len(recorder.parent)-1]
+	}
+
+	// the instructions of an includes module are those of the included
+	// modules, already recorded as its nested modules
+	if modulePlan.Type == "includes" {
+		return nil
+	}
+	for _, instruction := range instructions {
+		switch instruction.(type) {
+		case BlankLine, CommentInstruction:
+			continue
+		}
+		command, err := instruction.Emit()
+		if err != nil {
+			return err
+		}
+		modulePlan.Commands = append(modulePlan.Commands, command)
+	}
+	return nil
+}
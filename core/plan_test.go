@@ -0,0 +1,101 @@
+package core_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/vanilla-os/vib/core"
+)
+
+// Test that the plan has the module tree, included modules and skipped
+// ones, and the same Containerfile as vib build
+func TestPlanRecipe(t *testing.T) {
+	path := writeRecipeFiles(t, map[string]string{
+		"recipe.yml": `name: Test
+id: test
+vibversion: 1.0.0
+stages:
+  - id: build
+    base: debian:sid-slim
+    modules:
+      - name: parent
+        type: shell
+        workdir: /src
+        commands:
+          - echo parent
+        modules:
+          - name: arm
+            type: shell
+            if: arch == "arm64"
+            commands:
+              - echo arm
+          - name: included
+            type: includes
+            includes:
+              - modules/server.yml
+  - id: extra
+    base: debian:sid-slim
+    if: arch == "arm64"
+`,
+		"modules/server.yml": `name: server
+type: shell
+commands:
+  - echo server
+`,
+	})
+
+	fetched := filepath.Join(filepath.Dir(path), "sources", "app", "main.c")
+	if err := os.MkdirAll(filepath.Dir(fetched), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(fetched, []byte("int main() {}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	plan, err := core.PlanRecipe(path, "amd64", core.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(path), "Containerfile")); err == nil {
+		t.Error("expected the plan not to write the Containerfile")
+	}
+	if _, err := os.Stat(fetched); err != nil {
+		t.Errorf("expected the plan to leave the fetched sources in place: %v", err)
+	}
+
+	if len(plan.Stages) != 2 || plan.Stages[0].Skipped || !plan.Stages[1].Skipped {
+		t.Fatalf("expected the build stage and the skipped extra stage, got %+v", plan.Stages)
+	}
+	modules := plan.Stages[0].Modules
+	if len(modules) != 1 || modules[0].Name != "parent" || modules[0].Handler != "builtin" || modules[0].Workdir != "/src" {
+		t.Fatalf("expected the parent module, got %+v", modules)
+	}
+	parent := modules[0]
+	if len(parent.Commands) != 1 || !strings.Contains(parent.Commands[0], "echo parent") {
+		t.Errorf("expected the commands of the parent module only, got %q", parent.Commands)
+	}
+	if !strings.HasSuffix(parent.Location, "recipe.yml:8:9") {
+		t.Errorf("expected the location of the parent module, got %s", parent.Location)
+	}
+	if len(parent.Modules) != 2 || !parent.Modules[0].Skipped || parent.Modules[1].Type != "includes" {
+		t.Fatalf("expected the skipped arm module and the includes module, got %+v", parent.Modules)
+	}
+	included := parent.Modules[1].Modules
+	if len(included) != 1 || included[0].Name != "server" || !strings.Contains(included[0].Commands[0], "echo server") {
+		t.Errorf("expected the included server module, got %+v", included)
+	}
+
+	_, err = core.BuildRecipe(path, "amd64", core.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(filepath.Join(filepath.Dir(path), "Containerfile"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.Containerfile != string(content) {
+		t.Errorf("expected the Containerfile of vib build, got:\n%s\nand:\n%s", plan.Containerfile, content)
+	}
+}
@@ -0,0 +1,181 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/vanilla-os/vib/api"
+)
+
+// Key holding the sources each module type downloads while it is built,
+// the modules of other types fetch their sources themselves, if any
+var prefetchedSourceKeys = map[string]string{
+	"shell":             "sources",
+	"make":              "sources",
+	"meson":             "sources",
+	"cmake":             "source",
+	"go":                "source",
+	"dpkg-buildpackage": "source",
+}
+
+// Source of a module, fetched ahead of the build
+type prefetchSource struct {
+	Module string
+	Source api.Source
+}
+
+// prefetchSources downloads the sources of the modules of the given
+// stages, all of them when stages is nil, with BuildOptions.PrefetchJobs workers.
+// Each source is moved to the sources directory and stamped, so the
+// modules find it there when they are built
+func prefetchSources(recipe *api.Recipe, arch string, stages []int) error {
+	sources := []prefetchSource{}
+	seen := map[string]bool{}
+	visitedIncludes := map[string]bool{}
+	for i, stage := range recipe.Stages {
+		if stages != nil && !containsInt(stages, i) {
+			continue
+		}
+		if stage.If != "" {
+			enabled, err := EvaluateCondition(stage.If, ConditionContext{Arch: arch, Vars: recipe.Vars})
+			if err != nil || !enabled {
+				continue
+			}
+		}
+		collectSources(recipe, stage.Modules, arch, visitedIncludes, func(source prefetchSource) {
+			// the sources of a previous architecture are fetched already
+			if api.IsSourceFetched(recipe.DownloadsPath, source.Source, source.Module) {
+				return
+			}
+			key := fmt.Sprintf("%s\n%+v", source.Module, source.Source)
+			if !seen[key] {
+				seen[key] = true
+				sources = append(sources, source)
+			}
+		})
+	}
+	if len(sources) == 0 {
+		return nil
+	}
+
+	jobs := getBuildState(recipe).prefetchJobs
+	if jobs < 1 {
+		jobs = 1
+	}
+	fmt.Printf("Fetching %d sources, %d at a time\n", len(sources), jobs)
+
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	var errs []error
+	done := 0
+	queue := make(chan prefetchSource)
+	for j := 0; j < jobs; j++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for source := range queue {
+				err := fetchSource(recipe, source)
+
+				mutex.Lock()
+				done++
+				if err != nil {
+					errs = append(errs, fmt.Errorf("module %s: source %s: %w", source.Module, source.Source.URL, err))
+					fmt.Printf("[%d/%d] Failed to fetch %s for module %s\n", done, len(sources), source.Source.URL, source.Module)
+				} else {
+					fmt.Printf("[%d/%d] Fetched %s for module %s\n", done, len(sources), source.Source.URL, source.Module)
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+	for _, source := range sources {
+		queue <- source
+	}
+	close(queue)
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+func fetchSource(recipe *api.Recipe, source prefetchSource) error {
+	err := api.DownloadSource(recipe, source.Source, source.Module)
+	if err != nil {
+		return err
+	}
+	err = api.MoveSource(recipe.DownloadsPath, recipe.SourcesPath, source.Source, source.Module)
+	if err != nil {
+		return err
+	}
+	return api.MarkSourceFetched(recipe.DownloadsPath, source.Source, source.Module)
+}
+
+// collectSources walks the modules, their nested modules and the modules
+// they include, passing the sources to fetch for the architecture to add.
+// Modules and includes which fail to load are left to the build, which
+// reports them
+func collectSources(recipe *api.Recipe, modules []interface{}, arch string, visitedIncludes map[string]bool, add func(prefetchSource)) {
+	for _, moduleInterface := range modules {
+		if skipped, _, err := skipModule(recipe, moduleInterface, arch); err != nil || skipped {
+			continue
+		}
+
+		var module Module
+		err := mapstructure.Decode(moduleInterface, &module)
+		if err != nil {
+			continue
+		}
+
+		if key, ok := prefetchedSourceKeys[module.Type]; ok {
+			var sources []api.Source
+			if key == "source" {
+				var source api.Source
+				err = mapstructure.Decode(lookupKey(moduleInterface, key), &source)
+				sources = append(sources, source)
+			} else {
+				err = mapstructure.Decode(lookupKey(moduleInterface, key), &sources)
+			}
+			if err != nil {
+				continue
+			}
+			for _, source := range sources {
+				if strings.TrimSpace(source.Type) != "" && api.TestArch(source.OnlyArches, arch) {
+					add(prefetchSource{Module: module.Name, Source: source})
+				}
+			}
+		}
+
+		collectSources(recipe, nestedModules(moduleInterface), arch, visitedIncludes, add)
+
+		if module.Type != "includes" {
+			continue
+		}
+		var includesModule IncludesModule
+		err = mapstructure.Decode(moduleInterface, &includesModule)
+		if err != nil {
+			continue
+		}
+		includes, err := resolveIncludes(recipe.ParentPath, includesModule.Includes, includesModule.Exclude)
+		if err != nil {
+			continue
+		}
+		for _, include := range includes {
+			if visitedIncludes[include] {
+				continue
+			}
+			visitedIncludes[include] = true
+
+			modulePath, _, err := includePath(recipe, include)
+			if err != nil {
+				continue
+			}
+			includeModule, _, err := genModule(modulePath, recipe.Vars)
+			if err != nil {
+				continue
+			}
+			collectSources(recipe, []interface{}{includeModule}, arch, visitedIncludes, add)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package core_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/vanilla-os/vib/api"
+	"github.com/vanilla-os/vib/core"
+)
+
+// Test that the sources are fetched once ahead of the build, including
+// those of included and nested modules, and that the modules find them
+func TestPrefetchSources(t *testing.T) {
+	repo := t.TempDir()
+	for _, args := range [][]string{
+		{"init", "-q", "-b", "main"},
+		{"-c", "user.name=vib", "-c", "user.email=vib@localhost", "commit", "-q", "--allow-empty", "-m", "initial"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repo
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %s: %s", args[0], out)
+		}
+	}
+
+	source := `
+        sources:
+          - type: git
+            url: ` + repo + `
+            branch: main
+            path: repo`
+	path := writeRecipeFiles(t, map[string]string{
+		"recipe.yml": `name: Test
+id: test
+vibversion: 1.0.0
+stages:
+  - id: build
+    base: debian:sid-slim
+    modules:
+      - name: first
+        type: shell` + source + `
+        commands:
+          - ls /sources/first/repo
+        modules:
+          - name: nested
+            type: shell` + strings.ReplaceAll(source, "\n", "\n    ") + `
+            commands:
+              - ls /sources/nested/repo
+      - name: shared
+        type: includes
+        includes:
+          - modules/shared.yml
+  - id: final
+    base: debian:sid-slim
+    modules:
+      - name: shared
+        type: includes
+        includes:
+          - modules/shared.yml
+`,
+		"modules/shared.yml": `name: shared-module
+type: shell
+sources:
+  - type: git
+    url: ` + repo + `
+    branch: main
+    path: repo
+commands:
+  - ls /sources/shared-module/repo
+`,
+	})
+
+	_, err := core.BuildRecipe(path, "amd64", core.BuildOptions{Jobs: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, module := range []string{"first", "nested", "shared-module"} {
+		if _, err := os.Stat(filepath.Join(filepath.Dir(path), "sources", module, "repo", ".git")); err != nil {
+			t.Errorf("expected the source of %s in the sources directory: %v", module, err)
+		}
+	}
+	stamps, err := os.ReadDir(filepath.Join(filepath.Dir(path), "downloads", ".stamps"))
+	if err != nil || len(stamps) != 3 {
+		t.Errorf("expected a stamp for each of the 3 sources, got %d, %v", len(stamps), err)
+	}
+}
+
+// Test that remote includes are downloaded once, the build reading the
+// files downloaded while collecting the sources to prefetch
+func TestPrefetchRemoteIncludes(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte("name: remote\ntype: shell\ncommands:\n  - echo remote\n"))
+	}))
+	defer server.Close()
+
+	path := writeRecipeFiles(t, map[string]string{
+		"recipe.yml": `name: Test
+id: test
+vibversion: 1.0.0
+stages:
+  - id: build
+    base: debian:sid-slim
+    modules:
+      - name: remote
+        type: includes
+        includes:
+          - ` + server.URL + `/remote.yml
+`,
+	})
+
+	_, err := core.BuildRecipe(path, "amd64", core.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests != 1 {
+		t.Errorf("expected the remote include to be downloaded once, got %d requests", requests)
+	}
+}
+
+// Test that the modules only read their sources from the sources
+// directory, failing on sources which were not prefetched
+func TestBuildShellModuleUnfetchedSource(t *testing.T) {
+	recipe := &api.Recipe{DownloadsPath: t.TempDir(), SourcesPath: t.TempDir()}
+	module := map[string]interface{}{
+		"name":     "app",
+		"type":     "shell",
+		"sources":  []interface{}{map[string]interface{}{"type": "git", "url": "https://example.com/app.git", "branch": "main"}},
+		"commands": []interface{}{"ls /sources/app"},
+	}
+	_, err := core.BuildShellModule(module, recipe, nil, nil, nil, "amd64")
+	if err == nil || err.Error() != "source https://example.com/app.git of module app was not fetched" {
+		t.Errorf("expected the unfetched source to be reported, got %v", err)
+	}
+}
@@ -0,0 +1,49 @@
+package core
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SourceDateEpoch returns the timestamp reproducible builds are pinned
+// to: SOURCE_DATE_EPOCH from the environment when set, otherwise the
+// date of the last commit of the recipe directory, or 0 outside of a
+// git repository
+func SourceDateEpoch(recipeDir string) (int64, error) {
+	if value := os.Getenv("SOURCE_DATE_EPOCH"); value != "" {
+		epoch, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid SOURCE_DATE_EPOCH %s: %w", value, err)
+		}
+		return epoch, nil
+	}
+
+	cmd := exec.Command("git", "log", "-1", "--format=%ct")
+	cmd.Dir = recipeDir
+	out, err := cmd.Output()
+	if err != nil || len(strings.TrimSpace(string(out))) == 0 {
+		return 0, nil
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+}
+
+// normalizeTimestamps sets the access and modification times of every
+// file and directory under dir to epoch, symbolic links are left as is
+func normalizeTimestamps(dir string, epoch int64) error {
+	timestamp := time.Unix(epoch, 0)
+	return filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.Type()&fs.ModeSymlink != 0 {
+			return nil
+		}
+		return os.Chtimes(path, timestamp, timestamp)
+	})
+}
@@ -17,7 +17,8 @@ func TestDownloadSource(t *testing.T) {
 		URL:      "https://github.com/Vanilla-OS/Vib/archive/refs/tags/v0.3.1.tar.gz",
 		Checksum: "d28ab888c7b30fd1cc01e0a581169ea52dfb5bfcefaca721497f82734b6a5a98",
 	}
-	err := api.DownloadSource(tmp, source, "test")
+	recipe := &api.Recipe{DownloadsPath: tmp, SourcesPath: t.TempDir()}
+	err := api.DownloadSource(recipe, source, "test")
 	if err != nil {
 		t.Errorf("DownloadSource returned an error: %v", err)
 	}
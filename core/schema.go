@@ -0,0 +1,618 @@
+package core
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The published JSON Schema for recipes. Only the subset of the
+// 2020-12 draft used by the schema itself is implemented by the
+// validator below, plus the x-case-insensitive extension which mirrors
+// the case-insensitive decoding vib applies to modules
+//
+//go:embed schema/recipe.schema.json
+var RecipeSchema []byte
+
+// A single violation of the recipe schema
+type SchemaError struct {
+	File    string
+	Line    int
+	Column  int
+	Path    string
+	Message string
+}
+
+func (e SchemaError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("%s:%d:%d: %s", e.File, e.Line, e.Column, e.Message)
+	}
+	return fmt.Sprintf("%s:%d:%d: %s: %s", e.File, e.Line, e.Column, e.Path, e.Message)
+}
+
+type schemaValidator struct {
+	root     map[string]interface{}
+	file     string
+	files    map[*yaml.Node]string
+	patterns map[string]*regexp.Regexp
+}
+
+func newSchemaValidator(file string) (*schemaValidator, error) {
+	var root map[string]interface{}
+	err := json.Unmarshal(RecipeSchema, &root)
+	if err != nil {
+		return nil, fmt.Errorf("invalid recipe schema: %w", err)
+	}
+
+	validator := &schemaValidator{
+		root:     root,
+		file:     file,
+		patterns: map[string]*regexp.Regexp{},
+	}
+	err = validator.checkRefs(root)
+	if err != nil {
+		return nil, fmt.Errorf("invalid recipe schema: %w", err)
+	}
+	return validator, nil
+}
+
+// ValidateRecipeSchema checks the recipe at the given path and every
+// local module file it includes against the recipe schema, after the
+// recipes it extends are merged and its variables interpolated. An
+// error is returned only when a file cannot be read or parsed, schema
+// violations are returned as a list so they can all be reported at once
+func ValidateRecipeSchema(path string, vars map[string]string) ([]SchemaError, error) {
+	tree, err := loadRecipeTree(path, vars)
+	if err != nil {
+		return nil, err
+	}
+
+	validator, err := newSchemaValidator(path)
+	if err != nil {
+		return nil, err
+	}
+	validator.files = tree.files
+	schemaErrors, _ := validator.validate(validator.root, tree.root, "", false)
+
+	visited := map[string]bool{}
+	for _, include := range findLocalIncludes(tree.root) {
+		includeErrors, err := validateIncludedModule(filepath.Dir(path), tree.fileOf(include.node), include, tree.vars, visited)
+		if err != nil {
+			return nil, err
+		}
+		schemaErrors = append(schemaErrors, includeErrors...)
+	}
+
+	return schemaErrors, nil
+}
+
+// validateIncludedModule validates the module files referenced by an
+// entry of an includes module declared in file, then recurses into the
+// files they include themselves
+func validateIncludedModule(parentPath string, file string, include localInclude, vars map[string]string, visited map[string]bool) ([]SchemaError, error) {
+	files, err := expandInclude(parentPath, include.node.Value, include.patterns())
+	if err != nil {
+		return []SchemaError{{
+			File:    file,
+			Line:    include.node.Line,
+			Column:  include.node.Column,
+			Message: err.Error(),
+		}}, nil
+	}
+
+	schemaErrors := []SchemaError{}
+	for _, includedFile := range files {
+		modulePath := filepath.Join(parentPath, includedFile)
+		if visited[modulePath] {
+			continue
+		}
+		visited[modulePath] = true
+
+		if _, err := os.Stat(modulePath); err != nil {
+			schemaErrors = append(schemaErrors, SchemaError{
+				File:    file,
+				Line:    include.node.Line,
+				Column:  include.node.Column,
+				Message: fmt.Sprintf("included module %s not found", modulePath),
+			})
+			continue
+		}
+
+		root, err := parseYAMLFile(modulePath)
+		if err != nil {
+			return nil, err
+		}
+		interpolateNode(root, vars)
+
+		validator, err := newSchemaValidator(modulePath)
+		if err != nil {
+			return nil, err
+		}
+		moduleSchema, err := validator.resolveRef("#/$defs/module")
+		if err != nil {
+			return nil, err
+		}
+		moduleErrors, _ := validator.validate(moduleSchema, root, "", false)
+		schemaErrors = append(schemaErrors, moduleErrors...)
+
+		for _, nested := range findModuleIncludes(root) {
+			nestedErrors, err := validateIncludedModule(parentPath, modulePath, nested, vars, visited)
+			if err != nil {
+				return nil, err
+			}
+			schemaErrors = append(schemaErrors, nestedErrors...)
+		}
+	}
+
+	return schemaErrors, nil
+}
+
+// parseYAMLFile parses a YAML file into its root node
+func parseYAMLFile(path string) (*yaml.Node, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var document yaml.Node
+	err = yaml.Unmarshal(content, &document)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(document.Content) == 0 {
+		return nil, fmt.Errorf("%s: empty document", path)
+	}
+
+	return resolveAlias(document.Content[0]), nil
+}
+
+// Local entry of an includes module, along with the exclude patterns of
+// the module, which apply to directory and glob entries
+type localInclude struct {
+	node    *yaml.Node
+	exclude []*yaml.Node
+}
+
+// patterns returns the exclude patterns of the include
+func (i localInclude) patterns() []string {
+	patterns := make([]string, 0, len(i.exclude))
+	for _, pattern := range i.exclude {
+		patterns = append(patterns, pattern.Value)
+	}
+	return patterns
+}
+
+// findLocalIncludes returns the entries of every includes module in
+// the recipe which point to a local file
+func findLocalIncludes(root *yaml.Node) []localInclude {
+	includes := []localInclude{}
+	stages := mappingValue(root, "stages", false)
+	if stages == nil || stages.Kind != yaml.SequenceNode {
+		return includes
+	}
+	for _, stage := range stages.Content {
+		modules := mappingValue(resolveAlias(stage), "modules", false)
+		if modules == nil || modules.Kind != yaml.SequenceNode {
+			continue
+		}
+		for _, module := range modules.Content {
+			includes = append(includes, findModuleIncludes(resolveAlias(module))...)
+		}
+	}
+	return includes
+}
+
+// findModuleIncludes returns the local includes of a module and of all
+// of its nested modules
+func findModuleIncludes(module *yaml.Node) []localInclude {
+	includes := []localInclude{}
+	if module == nil || module.Kind != yaml.MappingNode {
+		return includes
+	}
+
+	moduleType := mappingValue(module, "type", true)
+	entries := mappingValue(module, "includes", true)
+	if moduleType != nil && moduleType.Value == "includes" && entries != nil && entries.Kind == yaml.SequenceNode {
+		var exclude []*yaml.Node
+		if patterns := mappingValue(module, "exclude", true); patterns != nil && patterns.Kind == yaml.SequenceNode {
+			for _, pattern := range patterns.Content {
+				if pattern = resolveAlias(pattern); pattern.Kind == yaml.ScalarNode {
+					exclude = append(exclude, pattern)
+				}
+			}
+		}
+		for _, entry := range entries.Content {
+			entry = resolveAlias(entry)
+			if entry.Kind != yaml.ScalarNode || isRemoteInclude(entry.Value) {
+				continue
+			}
+			includes = append(includes, localInclude{node: entry, exclude: exclude})
+		}
+	}
+
+	nested := mappingValue(module, "modules", true)
+	if nested != nil && nested.Kind == yaml.SequenceNode {
+		for _, nestedModule := range nested.Content {
+			includes = append(includes, findModuleIncludes(resolveAlias(nestedModule))...)
+		}
+	}
+
+	return includes
+}
+
+// mappingValue returns the value stored under key in a mapping node
+func mappingValue(node *yaml.Node, key string, fold bool) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if keyMatches(node.Content[i].Value, key, fold) {
+			return resolveAlias(node.Content[i+1])
+		}
+	}
+	return nil
+}
+
+func keyMatches(key string, name string, fold bool) bool {
+	if fold {
+		return strings.EqualFold(key, name)
+	}
+	return key == name
+}
+
+func resolveAlias(node *yaml.Node) *yaml.Node {
+	for node != nil && node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	return node
+}
+
+func joinSchemaPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func (v *schemaValidator) newError(node *yaml.Node, path string, format string, args ...interface{}) SchemaError {
+	file, ok := v.files[node]
+	if !ok {
+		file = v.file
+	}
+	return SchemaError{
+		File:    file,
+		Line:    node.Line,
+		Column:  node.Column,
+		Path:    path,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+// resolveRef resolves a local reference such as #/$defs/module
+func (v *schemaValidator) resolveRef(ref string) (map[string]interface{}, error) {
+	if ref == "#" {
+		return v.root, nil
+	}
+
+	var current interface{} = v.root
+	for _, part := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+		object, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("unresolvable $ref %s", ref)
+		}
+		current = object[part]
+	}
+
+	resolved, ok := current.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unresolvable $ref %s", ref)
+	}
+	return resolved, nil
+}
+
+// checkRefs resolves every $ref found in the schema, so a reference to
+// a missing definition fails instead of accepting any value
+func (v *schemaValidator) checkRefs(schema interface{}) error {
+	switch schema := schema.(type) {
+	case map[string]interface{}:
+		if ref, ok := schema["$ref"].(string); ok {
+			if _, err := v.resolveRef(ref); err != nil {
+				return err
+			}
+		}
+		for _, value := range schema {
+			if err := v.checkRefs(value); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, value := range schema {
+			if err := v.checkRefs(value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// validate checks node against schema and returns the violations found
+// together with the set of mapping keys evaluated by the schema, which
+// is needed to implement unevaluatedProperties
+func (v *schemaValidator) validate(schema map[string]interface{}, node *yaml.Node, path string, fold bool) ([]SchemaError, map[string]bool) {
+	node = resolveAlias(node)
+	schemaErrors := []SchemaError{}
+	evaluated := map[string]bool{}
+	if schema == nil {
+		return schemaErrors, evaluated
+	}
+
+	if caseInsensitive, ok := schema["x-case-insensitive"].(bool); ok && caseInsensitive {
+		fold = true
+	}
+
+	merge := func(errs []SchemaError, keys map[string]bool) {
+		schemaErrors = append(schemaErrors, errs...)
+		for key := range keys {
+			evaluated[key] = true
+		}
+	}
+
+	if ref, ok := schema["$ref"].(string); ok {
+		resolved, err := v.resolveRef(ref)
+		if err != nil {
+			schemaErrors = append(schemaErrors, v.newError(node, path, "%s", err.Error()))
+			return schemaErrors, evaluated
+		}
+		merge(v.validate(resolved, node, path, fold))
+	}
+
+	if expected, ok := schema["type"]; ok && !nodeHasType(node, expected) {
+		// further checks are meaningless on a value of the wrong type
+		schemaErrors = append(schemaErrors, v.newError(node, path, "expected %s, got %s", describeSchemaType(expected), describeNodeType(node)))
+		return schemaErrors, evaluated
+	}
+
+	if values, ok := schema["enum"].([]interface{}); ok && !nodeInValues(node, values) {
+		allowed := []string{}
+		for _, value := range values {
+			allowed = append(allowed, fmt.Sprint(value))
+		}
+		schemaErrors = append(schemaErrors, v.newError(node, path, "value %q is not one of: %s", node.Value, strings.Join(allowed, ", ")))
+	}
+
+	if value, ok := schema["const"]; ok && !nodeInValues(node, []interface{}{value}) {
+		schemaErrors = append(schemaErrors, v.newError(node, path, "expected value %v", value))
+	}
+
+	if node.Kind == yaml.ScalarNode {
+		if minLength, ok := schema["minLength"].(float64); ok && utf8.RuneCountInString(node.Value) < int(minLength) {
+			schemaErrors = append(schemaErrors, v.newError(node, path, "value must not be empty"))
+		}
+		if minimum, ok := schema["minimum"].(float64); ok && (node.Tag == "!!int" || node.Tag == "!!float") {
+			if value, err := strconv.ParseFloat(node.Value, 64); err == nil && value < minimum {
+				schemaErrors = append(schemaErrors, v.newError(node, path, "value must be at least %v", minimum))
+			}
+		}
+		if pattern, ok := schema["pattern"].(string); ok {
+			re, ok := v.patterns[pattern]
+			if !ok {
+				re = regexp.MustCompile(pattern)
+				v.patterns[pattern] = re
+			}
+			if !re.MatchString(node.Value) {
+				schemaErrors = append(schemaErrors, v.newError(node, path, "value %q does not match %s", node.Value, pattern))
+			}
+		}
+	}
+
+	if node.Kind == yaml.SequenceNode {
+		if minItems, ok := schema["minItems"].(float64); ok && len(node.Content) < int(minItems) {
+			schemaErrors = append(schemaErrors, v.newError(node, path, "expected at least %d items", int(minItems)))
+		}
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range node.Content {
+				errs, _ := v.validate(items, item, fmt.Sprintf("%s[%d]", path, i), fold)
+				schemaErrors = append(schemaErrors, errs...)
+			}
+		}
+	}
+
+	if node.Kind == yaml.MappingNode {
+		merge(v.validateMapping(schema, node, path, fold))
+	}
+
+	if subschemas, ok := schema["allOf"].([]interface{}); ok {
+		for _, subschema := range subschemas {
+			subschema, _ := subschema.(map[string]interface{})
+			merge(v.validate(subschema, node, path, fold))
+		}
+	}
+
+	if subschemas, ok := schema["anyOf"].([]interface{}); ok {
+		var firstErrors []SchemaError
+		matched := false
+		for _, subschema := range subschemas {
+			subschema, _ := subschema.(map[string]interface{})
+			errs, keys := v.validate(subschema, node, path, fold)
+			if len(errs) == 0 {
+				merge(errs, keys)
+				matched = true
+				break
+			}
+			if firstErrors == nil {
+				firstErrors = errs
+			}
+		}
+		if !matched {
+			schemaErrors = append(schemaErrors, firstErrors...)
+		}
+	}
+
+	if condition, ok := schema["if"].(map[string]interface{}); ok {
+		errs, keys := v.validate(condition, node, path, fold)
+		if len(errs) == 0 {
+			merge(nil, keys)
+			if then, ok := schema["then"].(map[string]interface{}); ok {
+				merge(v.validate(then, node, path, fold))
+			}
+		} else if otherwise, ok := schema["else"].(map[string]interface{}); ok {
+			merge(v.validate(otherwise, node, path, fold))
+		}
+	}
+
+	if unevaluated, ok := schema["unevaluatedProperties"].(bool); ok && !unevaluated && node.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i]
+			if !evaluated[normalizeSchemaKey(key.Value, fold)] {
+				schemaErrors = append(schemaErrors, v.newError(key, joinSchemaPath(path, key.Value), "unknown key %q", key.Value))
+			}
+		}
+	}
+
+	return schemaErrors, evaluated
+}
+
+// validateMapping applies the object keywords of schema to a mapping node
+func (v *schemaValidator) validateMapping(schema map[string]interface{}, node *yaml.Node, path string, fold bool) ([]SchemaError, map[string]bool) {
+	schemaErrors := []SchemaError{}
+	evaluated := map[string]bool{}
+	properties, _ := schema["properties"].(map[string]interface{})
+
+	if required, ok := schema["required"].([]interface{}); ok {
+		for _, name := range required {
+			name, _ := name.(string)
+			if mappingValue(node, name, fold) == nil {
+				schemaErrors = append(schemaErrors, v.newError(node, path, "missing required key %q", name))
+			}
+		}
+	}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key := node.Content[i]
+		value := node.Content[i+1]
+		keyPath := joinSchemaPath(path, key.Value)
+
+		matched := false
+		for name, propertySchema := range properties {
+			if !keyMatches(key.Value, name, fold) {
+				continue
+			}
+			propertySchema, _ := propertySchema.(map[string]interface{})
+			errs, _ := v.validate(propertySchema, value, keyPath, fold)
+			schemaErrors = append(schemaErrors, errs...)
+			matched = true
+			break
+		}
+		if matched {
+			evaluated[normalizeSchemaKey(key.Value, fold)] = true
+			continue
+		}
+
+		switch additional := schema["additionalProperties"].(type) {
+		case bool:
+			if !additional {
+				schemaErrors = append(schemaErrors, v.newError(key, keyPath, "unknown key %q", key.Value))
+			}
+			evaluated[normalizeSchemaKey(key.Value, fold)] = true
+		case map[string]interface{}:
+			errs, _ := v.validate(additional, value, keyPath, fold)
+			schemaErrors = append(schemaErrors, errs...)
+			evaluated[normalizeSchemaKey(key.Value, fold)] = true
+		}
+	}
+
+	return schemaErrors, evaluated
+}
+
+func normalizeSchemaKey(key string, fold bool) string {
+	if fold {
+		return strings.ToLower(key)
+	}
+	return key
+}
+
+// nodeHasType reports whether node matches one of the JSON types
+// described by expected, which is either a string or a list of strings
+func nodeHasType(node *yaml.Node, expected interface{}) bool {
+	switch expected := expected.(type) {
+	case string:
+		return nodeHasJSONType(node, expected)
+	case []interface{}:
+		for _, name := range expected {
+			if name, ok := name.(string); ok && nodeHasJSONType(node, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func nodeHasJSONType(node *yaml.Node, name string) bool {
+	switch name {
+	case "object":
+		return node.Kind == yaml.MappingNode
+	case "array":
+		return node.Kind == yaml.SequenceNode
+	case "string":
+		return node.Kind == yaml.ScalarNode && node.ShortTag() == "!!str"
+	case "integer":
+		return node.Kind == yaml.ScalarNode && node.ShortTag() == "!!int"
+	case "number":
+		return node.Kind == yaml.ScalarNode && (node.ShortTag() == "!!int" || node.ShortTag() == "!!float")
+	case "boolean":
+		return node.Kind == yaml.ScalarNode && node.ShortTag() == "!!bool"
+	case "null":
+		return node.Kind == yaml.ScalarNode && node.ShortTag() == "!!null"
+	}
+	return false
+}
+
+func describeSchemaType(expected interface{}) string {
+	if names, ok := expected.([]interface{}); ok {
+		parts := []string{}
+		for _, name := range names {
+			parts = append(parts, fmt.Sprint(name))
+		}
+		return strings.Join(parts, " or ")
+	}
+	return fmt.Sprint(expected)
+}
+
+func describeNodeType(node *yaml.Node) string {
+	switch node.Kind {
+	case yaml.MappingNode:
+		return "object"
+	case yaml.SequenceNode:
+		return "array"
+	}
+	switch node.ShortTag() {
+	case "!!int", "!!float":
+		return "number"
+	case "!!bool":
+		return "boolean"
+	case "!!null":
+		return "null"
+	}
+	return "string"
+}
+
+// nodeInValues reports whether a scalar node equals one of values
+func nodeInValues(node *yaml.Node, values []interface{}) bool {
+	if node.Kind != yaml.ScalarNode {
+		return false
+	}
+	for _, value := range values {
+		if fmt.Sprint(value) == node.Value {
+			return true
+		}
+	}
+	return false
+}
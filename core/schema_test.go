@@ -0,0 +1,306 @@
+package core_test
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/vanilla-os/vib/core"
+)
+
+// Test that a well formed recipe passes the schema validation
+func TestValidateRecipeSchemaValid(t *testing.T) {
+	path := writeRecipeFiles(t, map[string]string{
+		"recipe.yml": `name: Test
+id: test
+vibversion: 1.0.0
+stages:
+  - id: build
+    base: debian:sid-slim
+    labels:
+      maintainer: Vanilla OS
+    modules:
+      - name: hello
+        type: shell
+        Commands:
+          - echo hello
+      - name: deps
+        type: apt
+        sources:
+          - packages:
+              - curl
+      - name: custom
+        type: some-third-party-plugin
+        whatever: true
+      - name: included
+        type: includes
+        includes:
+          - modules/00-net.yml
+`,
+		"modules/00-net.yml": `name: net
+type: apt
+sources:
+  - packages:
+      - wget
+`,
+	})
+
+	schemaErrors, err := core.ValidateRecipeSchema(path, nil)
+	if err != nil {
+		t.Fatalf("ValidateRecipeSchema returned an error: %v", err)
+	}
+	if len(schemaErrors) != 0 {
+		t.Errorf("expected no schema errors, got %v", schemaErrors)
+	}
+}
+
+// Test that unknown keys, wrong types and missing required fields are reported with their position
+func TestValidateRecipeSchemaInvalid(t *testing.T) {
+	path := writeRecipeFiles(t, map[string]string{
+		"recipe.yml": `name: Test
+vibversion: 1.0.0
+stages:
+  - id: build
+    base: debian:sid-slim
+    squash: true
+    addincludes: "yes"
+    modules:
+      - name: hello
+        type: shell
+        comands:
+          - echo hello
+      - type: apt
+      - name: included
+        type: includes
+        includes:
+          - modules/00-net.yml
+`,
+		"modules/00-net.yml": `name: net
+type: go
+source:
+  type: svn
+`,
+	})
+
+	schemaErrors, err := core.ValidateRecipeSchema(path, nil)
+	if err != nil {
+		t.Fatalf("ValidateRecipeSchema returned an error: %v", err)
+	}
+
+	expected := []string{
+		`recipe.yml:1:1: missing required key "id"`,
+		`recipe.yml:6:5: stages[0].squash: unknown key "squash"`,
+		`recipe.yml:7:18: stages[0].addincludes: expected boolean, got string`,
+		`recipe.yml:9:9: stages[0].modules[0]: missing required key "commands"`,
+		`recipe.yml:11:9: stages[0].modules[0].comands: unknown key "comands"`,
+		`recipe.yml:13:9: stages[0].modules[1]: missing required key "name"`,
+		`00-net.yml:4:9: source.type: value "svn" is not one of: git, tar, file, local`,
+	}
+
+	messages := []string{}
+	for _, schemaError := range schemaErrors {
+		messages = append(messages, schemaError.Error())
+	}
+	if len(messages) != len(expected) {
+		t.Fatalf("expected %d schema errors, got %d:\n%s", len(expected), len(messages), strings.Join(messages, "\n"))
+	}
+	for i, message := range messages {
+		if !strings.HasSuffix(message, expected[i]) {
+			t.Errorf("expected error ending with %q, got %q", expected[i], message)
+		}
+	}
+}
+
+// Test that the caches of stages and modules are validated
+func TestValidateRecipeSchemaCache(t *testing.T) {
+	path := writeRecipeFiles(t, map[string]string{
+		"recipe.yml": `name: Test
+id: test
+vibversion: 1.0.0
+stages:
+  - id: build
+    base: debian:sid-slim
+    cache: not a list
+    cacheList: []
+    modules:
+      - name: hello
+        type: shell
+        cache: 42
+        commands:
+          - echo hello
+      - name: apt
+        type: shell
+        cache:
+          - target: var/cache/apt
+            sharing: exclusive
+        commands:
+          - echo hello
+`,
+	})
+
+	schemaErrors, err := core.ValidateRecipeSchema(path, nil)
+	if err != nil {
+		t.Fatalf("ValidateRecipeSchema returned an error: %v", err)
+	}
+
+	messages := []string{}
+	for _, schemaError := range schemaErrors {
+		messages = append(messages, schemaError.Error())
+	}
+	expected := []string{
+		`stages[0].cache: expected array, got string`,
+		`stages[0].cacheList: unknown key "cacheList"`,
+		`stages[0].modules[0].cache: expected array, got number`,
+		`stages[0].modules[1].cache[0].target:`,
+		`stages[0].modules[1].cache[0].sharing:`,
+	}
+	if len(messages) != len(expected) {
+		t.Fatalf("expected %d schema errors, got %d:\n%s", len(expected), len(messages), strings.Join(messages, "\n"))
+	}
+	for i, message := range messages {
+		if !strings.Contains(message, expected[i]) {
+			t.Errorf("expected error containing %q, got %q", expected[i], message)
+		}
+	}
+}
+
+// Test that the secrets of the recipe and of the modules are validated,
+// and that stages cannot declare any
+func TestValidateRecipeSchemaSecrets(t *testing.T) {
+	path := writeRecipeFiles(t, map[string]string{
+		"recipe.yml": `name: Test
+id: test
+vibversion: 1.0.0
+secrets: nope
+stages:
+  - id: build
+    base: debian:sid-slim
+    secrets:
+      token:
+        env: TOKEN
+    modules:
+      - name: hello
+        type: shell
+        secrets: nope
+        commands:
+          - echo hello
+      - name: fetch
+        type: shell
+        secrets:
+          token:
+            path: /run/token
+        commands:
+          - echo hello
+`,
+	})
+
+	schemaErrors, err := core.ValidateRecipeSchema(path, nil)
+	if err != nil {
+		t.Fatalf("ValidateRecipeSchema returned an error: %v", err)
+	}
+
+	messages := []string{}
+	for _, schemaError := range schemaErrors {
+		messages = append(messages, schemaError.Error())
+	}
+	expected := []string{
+		`secrets: expected object, got string`,
+		`stages[0].secrets: unknown key "secrets"`,
+		`stages[0].modules[0].secrets: expected object, got string`,
+		`stages[0].modules[1].secrets.token`,
+	}
+	if len(messages) < len(expected) {
+		t.Fatalf("expected %d schema errors, got %d:\n%s", len(expected), len(messages), strings.Join(messages, "\n"))
+	}
+	for _, want := range expected {
+		found := false
+		for _, message := range messages {
+			found = found || strings.Contains(message, want)
+		}
+		if !found {
+			t.Errorf("expected an error containing %q, got:\n%s", want, strings.Join(messages, "\n"))
+		}
+	}
+}
+
+// Test that every $ref of the embedded schema points at a definition
+func TestRecipeSchemaRefs(t *testing.T) {
+	var root map[string]interface{}
+	err := json.Unmarshal(core.RecipeSchema, &root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refs := 0
+	var walk func(node interface{})
+	walk = func(node interface{}) {
+		switch node := node.(type) {
+		case map[string]interface{}:
+			if ref, ok := node["$ref"].(string); ok {
+				refs++
+				var current interface{} = root
+				for _, part := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+					object, _ := current.(map[string]interface{})
+					current = object[part]
+				}
+				if _, ok := current.(map[string]interface{}); !ok {
+					t.Errorf("$ref %s points at no definition", ref)
+				}
+			}
+			for _, value := range node {
+				walk(value)
+			}
+		case []interface{}:
+			for _, value := range node {
+				walk(value)
+			}
+		}
+	}
+	walk(root)
+	if refs == 0 {
+		t.Error("expected the schema to have references")
+	}
+}
+
+// Test that missing included modules are reported in the file declaring
+// the include, at the position of the include
+func TestValidateRecipeSchemaMissingInclude(t *testing.T) {
+	path := writeRecipeFiles(t, map[string]string{
+		"recipe.yml": `name: Test
+id: test
+vibversion: 1.0.0
+stages:
+  - id: build
+    base: debian:sid-slim
+    modules:
+      - name: included
+        type: includes
+        includes:
+          - modules/missing.yml
+          - modules/nested.yml
+`,
+		"modules/nested.yml": `name: nested
+type: includes
+includes:
+  - modules/gone.yml
+`,
+	})
+
+	schemaErrors, err := core.ValidateRecipeSchema(path, nil)
+	if err != nil {
+		t.Fatalf("ValidateRecipeSchema returned an error: %v", err)
+	}
+	if len(schemaErrors) != 2 {
+		t.Fatalf("expected 2 schema errors, got %v", schemaErrors)
+	}
+
+	missing := schemaErrors[0]
+	if missing.File != "recipe.yml" || missing.Line != 11 || missing.Column != 13 {
+		t.Errorf("expected the missing include at recipe.yml:11:13, got %s:%d:%d", missing.File, missing.Line, missing.Column)
+	}
+	nested := schemaErrors[1]
+	if nested.File != filepath.Join(filepath.Dir(path), "modules", "nested.yml") || nested.Line != 4 || nested.Column != 5 {
+		t.Errorf("expected the nested missing include at modules/nested.yml:4:5, got %s:%d:%d", nested.File, nested.Line, nested.Column)
+	}
+}
@@ -0,0 +1,111 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+
+	"github.com/vanilla-os/vib/api"
+)
+
+// Secret ids, as accepted by the container engines
+var secretId = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+func checkSecret(id string, secret api.Secret) error {
+	if !secretId.MatchString(id) {
+		return fmt.Errorf("invalid secret id %q", id)
+	}
+	if (secret.File == "") == (secret.Env == "") {
+		return fmt.Errorf("secret %s must have either a file or an env", id)
+	}
+	return nil
+}
+
+// secretMounts returns the RUN flags mounting the secrets of the recipe
+// and of the module, at /run/secrets/<id>. The secrets of the module are
+// recorded in the recipe, so they are passed to the container engine
+func secretMounts(recipe *api.Recipe, moduleSecrets map[string]api.Secret) ([]string, error) {
+	ids := []string{}
+	for id, secret := range recipe.Secrets {
+		err := checkSecret(id, secret)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	for id, secret := range moduleSecrets {
+		err := checkSecret(id, secret)
+		if err != nil {
+			return nil, err
+		}
+		declared, ok := recipe.Secrets[id]
+		if !ok {
+			declared, ok = recipe.ModuleSecrets[id]
+		}
+		if ok && declared != secret {
+			return nil, fmt.Errorf("secret %s is declared more than once with different sources", id)
+		}
+		if recipe.ModuleSecrets == nil {
+			recipe.ModuleSecrets = map[string]api.Secret{}
+		}
+		recipe.ModuleSecrets[id] = secret
+		if !containsString(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+
+	sort.Strings(ids)
+	mounts := []string{}
+	for _, id := range ids {
+		mounts = append(mounts, "--mount=type=secret,id="+id)
+	}
+	return mounts, nil
+}
+
+// secretFlags returns the --secret flags passing the secrets mounted by
+// the Containerfile to docker and podman
+func secretFlags(recipe api.Recipe) ([]string, error) {
+	secrets := map[string]api.Secret{}
+	for id, secret := range recipe.Secrets {
+		secrets[id] = secret
+	}
+	for id, secret := range recipe.ModuleSecrets {
+		secrets[id] = secret
+	}
+
+	ids := []string{}
+	for id := range secrets {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	flags := []string{}
+	for _, id := range ids {
+		secret := secrets[id]
+		err := checkSecret(id, secret)
+		if err != nil {
+			return nil, err
+		}
+
+		if secret.Env != "" {
+			if _, ok := os.LookupEnv(secret.Env); !ok {
+				return nil, fmt.Errorf("environment variable %s of secret %s is not set", secret.Env, id)
+			}
+			flags = append(flags, "--secret", fmt.Sprintf("id=%s,env=%s", id, secret.Env))
+			continue
+		}
+
+		path := secret.File
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(recipe.ParentPath, path)
+		}
+		if _, err := os.Stat(path); err != nil {
+			return nil, fmt.Errorf("file of secret %s: %w", id, err)
+		}
+		flags = append(flags, "--secret", fmt.Sprintf("id=%s,src=%s", id, path))
+	}
+	return flags, nil
+}
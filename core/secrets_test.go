@@ -0,0 +1,79 @@
+package core_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/vanilla-os/vib/api"
+	"github.com/vanilla-os/vib/core"
+)
+
+// Test that the secrets of the recipe and of the module are mounted in
+// order, and that the secrets of the module are recorded in the recipe
+func TestSecretMounts(t *testing.T) {
+	recipe := &api.Recipe{Secrets: map[string]api.Secret{"token": {Env: "TOKEN"}}}
+
+	mounts, err := core.SecretMounts(recipe, nil)
+	expected := []string{"--mount=type=secret,id=token"}
+	if err != nil || !reflect.DeepEqual(mounts, expected) {
+		t.Errorf("expected %v, got %v, %v", expected, mounts, err)
+	}
+
+	mounts, err = core.SecretMounts(recipe, map[string]api.Secret{"netrc": {File: "netrc"}, "token": {Env: "TOKEN"}})
+	expected = []string{"--mount=type=secret,id=netrc", "--mount=type=secret,id=token"}
+	if err != nil || !reflect.DeepEqual(mounts, expected) {
+		t.Errorf("expected %v, got %v, %v", expected, mounts, err)
+	}
+	if !reflect.DeepEqual(recipe.ModuleSecrets, map[string]api.Secret{"netrc": {File: "netrc"}, "token": {Env: "TOKEN"}}) {
+		t.Errorf("expected the secrets of the module in the recipe, got %v", recipe.ModuleSecrets)
+	}
+
+	for message, moduleSecrets := range map[string]map[string]api.Secret{
+		`secret netrc is declared more than once with different sources`: {"netrc": {File: "other"}},
+		`secret bad must have either a file or an env`:                   {"bad": {File: "bad", Env: "BAD"}},
+		`invalid secret id "a b"`:                                        {"a b": {Env: "AB"}},
+	} {
+		_, err := core.SecretMounts(recipe, moduleSecrets)
+		if err == nil || err.Error() != message {
+			t.Errorf("expected the error %q, got %v", message, err)
+		}
+	}
+}
+
+// Test that the secrets are passed to the container engine from their
+// file, relative to the recipe, or their variable, which must exist
+func TestSecretFlags(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "netrc"), []byte("machine example.com\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("VIB_TEST_TOKEN", "secret")
+
+	recipe := api.Recipe{
+		ParentPath:    dir,
+		Secrets:       map[string]api.Secret{"token": {Env: "VIB_TEST_TOKEN"}},
+		ModuleSecrets: map[string]api.Secret{"netrc": {File: "netrc"}},
+	}
+	flags, err := core.SecretFlags(recipe)
+	expected := []string{"--secret", "id=netrc,src=" + filepath.Join(dir, "netrc"), "--secret", "id=token,env=VIB_TEST_TOKEN"}
+	if err != nil || !reflect.DeepEqual(flags, expected) {
+		t.Errorf("expected %v, got %v, %v", expected, flags, err)
+	}
+
+	recipe.Secrets = map[string]api.Secret{"token": {Env: "VIB_TEST_MISSING"}}
+	_, err = core.SecretFlags(recipe)
+	if err == nil || err.Error() != "environment variable VIB_TEST_MISSING of secret token is not set" {
+		t.Errorf("expected an error for the missing variable, got %v", err)
+	}
+
+	recipe.Secrets = nil
+	recipe.ModuleSecrets = map[string]api.Secret{"netrc": {File: "missing"}}
+	_, err = core.SecretFlags(recipe)
+	if err == nil || !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected an error for the missing file, got %v", err)
+	}
+}
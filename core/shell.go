@@ -3,6 +3,8 @@ package core
 import (
 	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/mitchellh/mapstructure"
@@ -15,46 +17,152 @@ type ShellModule struct {
 	Type     string `json:"type"`
 	Sources  []api.Source
 	Commands []string
+	Script   string // Path of a script, relative to the recipe, run before the commands
+	Shell    string // sh or bash
+	Strict   bool   // Stop on unset variables and on failures inside pipes
 	Cleanup  []string
+	Cache    []api.Cache
+	Secrets  map[string]api.Secret
 }
 
-// Build shell module commands and return them as a single string
+// Interpreters selectable through the shell field
+var shellPaths = map[string]string{
+	"sh":   "/bin/sh",
+	"bash": "/bin/bash",
+}
+
+// Reports the failing command when the script stops on an error
+const failedCommandTrap = `trap '[ $? -eq 0 ] || echo "Command failed: $vib_command" >&2' EXIT`
+
+// Build shell module commands and return them as a single RUN instruction.
+// A single command is written as is, several commands are written as a
+// heredoc script stopping at the first failing command, which it reports
 //
-// Returns: Concatenated shell commands or an error if any step fails
-func BuildShellModule(moduleInterface interface{}, recipe *api.Recipe, cleanup []string, arch string) (string, error) {
+// Returns: The RUN instruction of the shell commands or an error if any step fails
+func BuildShellModule(moduleInterface interface{}, recipe *api.Recipe, cleanup []string, caches []api.Cache, env []RunVariable, arch string) ([]Instruction, error) {
 	var module ShellModule
 	err := mapstructure.Decode(moduleInterface, &module)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	for _, source := range module.Sources {
 		if api.TestArch(source.OnlyArches, arch) {
 			if strings.TrimSpace(source.Type) != "" {
-				err := api.DownloadSource(recipe, source, module.Name)
-				if err != nil {
-					return "", err
-				}
-				err = api.MoveSource(recipe.DownloadsPath, recipe.SourcesPath, source, module.Name)
+				err := api.CheckSourceFetched(recipe, source, module.Name)
 				if err != nil {
-					return "", err
+					return nil, err
 				}
 			}
 		}
 	}
 
-	if len(module.Commands) == 0 {
-		return "", errors.New("no commands specified")
+	shell := ""
+	if module.Shell != "" {
+		var ok bool
+		shell, ok = shellPaths[module.Shell]
+		if !ok {
+			return nil, fmt.Errorf("invalid shell %s, expected sh or bash", module.Shell)
+		}
+	} else if module.Strict {
+		shell = shellPaths["sh"]
 	}
 
-	cmd := ""
-	for i, command := range module.Commands {
-		cmd += command
-		if i < len(module.Commands)-1 {
-			cmd += " && "
+	commands := module.Commands
+	if module.Script != "" {
+		scriptCommand, err := copyShellScript(recipe, module)
+		if err != nil {
+			return nil, err
 		}
+		commands = append([]string{scriptCommand}, commands...)
+	}
+	if len(commands) == 0 {
+		return nil, errors.New("no commands specified")
+	}
+
+	moduleCaches, err := resolveCaches(append(append([]api.Cache{}, caches...), module.Cache...), arch)
+	if err != nil {
+		return nil, err
+	}
+	suffix := cleanupSuffix(append(append([]string{}, cleanup...), module.Cleanup...), moduleCaches)
+
+	// a single command is written inline, unless the module asks for a
+	// shell or for strict mode, which only the script sets up
+	var cmd string
+	if len(commands) == 1 && module.Shell == "" && !module.Strict {
+		cmd = commands[0] + suffix
+	} else {
+		cmd = shellScript(commands, suffix, module.Strict, shell)
+	}
+
+	secrets, err := secretMounts(recipe, module.Secrets)
+	if err != nil {
+		return nil, err
 	}
-	cmd += api.GetCleanupSuffix(append(cleanup, module.Cleanup...))
 
-	return fmt.Sprintf("RUN --mount=source=sources/%s,target=/sources/%s,rw ", module.Name, module.Name) + cmd, nil
+	return []Instruction{RunInstruction{Flags: append([]string{SourcesMount(module.Name)}, secrets...), Caches: moduleCaches, Env: env, Shell: shell, Command: cmd}}, nil
+}
+
+// shellScript writes the commands as a script stopping at the first
+// failing command. Before each command, vib_command is set to its text,
+// which the trap prints if the script fails
+func shellScript(commands []string, cleanupSuffix string, strict bool, shell string) string {
+	lines := []string{"set -e"}
+	if strict {
+		lines = []string{"set -eu"}
+		if shell == shellPaths["bash"] {
+			lines = []string{"set -euo pipefail"}
+		} else {
+			// pipefail is missing from some sh, such as older dash
+			lines = append(lines, "if (set -o pipefail) 2>/dev/null; then set -o pipefail; fi")
+		}
+	}
+	lines = append(lines, failedCommandTrap)
+
+	for _, command := range commands {
+		command = strings.TrimRight(command, "\n")
+		lines = append(lines, "vib_command="+shellQuote(command), command)
+	}
+	if cleanupSuffix != "" {
+		lines = append(lines, "vib_command=cleanup", strings.TrimPrefix(cleanupSuffix, " && "))
+	}
+
+	// the script may be part of a layer merging several modules
+	lines = append(lines, "trap - EXIT")
+	return strings.Join(lines, "\n")
+}
+
+// copyShellScript copies the script of the module to its sources, which
+// are mounted in the build, and returns the command running it
+func copyShellScript(recipe *api.Recipe, module ShellModule) (string, error) {
+	scriptPath := module.Script
+	if !filepath.IsAbs(scriptPath) {
+		scriptPath = filepath.Join(recipe.ParentPath, scriptPath)
+	}
+	content, err := os.ReadFile(scriptPath)
+	if err != nil {
+		return "", fmt.Errorf("script %s: %w", module.Script, err)
+	}
+
+	name := filepath.Base(scriptPath)
+	sourcePath := filepath.Join(recipe.SourcesPath, module.Name)
+	err = os.MkdirAll(sourcePath, 0755)
+	if err != nil {
+		return "", err
+	}
+	err = os.WriteFile(filepath.Join(sourcePath, name), content, 0755)
+	if err != nil {
+		return "", err
+	}
+
+	interpreter := "sh"
+	if module.Shell != "" {
+		interpreter = module.Shell
+	}
+	if module.Strict && interpreter == "bash" {
+		interpreter += " -euo pipefail"
+	} else if module.Strict {
+		interpreter += " -eu"
+	}
+	return fmt.Sprintf("%s %s", interpreter, shellQuote(filepath.Join("/sources", module.Name, name))), nil
 }
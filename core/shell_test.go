@@ -0,0 +1,51 @@
+package core_test
+
+import (
+	"testing"
+
+	"github.com/vanilla-os/vib/core"
+)
+
+// Test the scripts of the shell modules: the strict mode, the command
+// reported on failure and the cleanup
+func TestShellScript(t *testing.T) {
+	trap := `trap '[ $? -eq 0 ] || echo "Command failed: $vib_command" >&2' EXIT`
+	cases := []struct {
+		commands []string
+		cleanup  string
+		strict   bool
+		shell    string
+		expected string
+	}{
+		{
+			commands: []string{"apt-get update", "echo 'it''s'\n"},
+			cleanup:  " && rm -rf /var/lib/apt/lists",
+			expected: "set -e\n" + trap + "\n" +
+				"vib_command='apt-get update'\napt-get update\n" +
+				`vib_command='echo '\''it'\'''\''s'\'''` + "\necho 'it''s'\n" +
+				"vib_command=cleanup\nrm -rf /var/lib/apt/lists\n" +
+				"trap - EXIT",
+		},
+		{
+			commands: []string{"curl -fsSL https://example.com | tar -x"},
+			strict:   true,
+			shell:    "/bin/sh",
+			expected: "set -eu\nif (set -o pipefail) 2>/dev/null; then set -o pipefail; fi\n" + trap + "\n" +
+				"vib_command='curl -fsSL https://example.com | tar -x'\ncurl -fsSL https://example.com | tar -x\n" +
+				"trap - EXIT",
+		},
+		{
+			commands: []string{"echo ${HOME}"},
+			strict:   true,
+			shell:    "/bin/bash",
+			expected: "set -euo pipefail\n" + trap + "\n" +
+				"vib_command='echo ${HOME}'\necho ${HOME}\n" +
+				"trap - EXIT",
+		},
+	}
+	for _, c := range cases {
+		if got := core.ShellScript(c.commands, c.cleanup, c.strict, c.shell); got != c.expected {
+			t.Errorf("%q: expected:\n%s\ngot:\n%s", c.commands, c.expected, got)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/vanilla-os/vib/api"
+)
+
+// StageGraph holds the dependencies between the stages of a recipe, a
+// stage depends on the stages its base and its copy.from reference. As
+// for the builders, a base naming a stage declared later is an image
+type StageGraph struct {
+	// stage indexes each stage depends on, in the order of recipe.Stages
+	Dependencies [][]int
+	ids          map[string]int
+}
+
+// isImageReference reports whether a base or copy.from value names an
+// image rather than a stage, as stage ids have no registry, tag or digest
+func isImageReference(reference string) bool {
+	return strings.ContainsAny(reference, "/:@")
+}
+
+// stageIndexes returns the index of each stage of the recipe by id, the
+// first stage wins when several stages share an id
+func stageIndexes(recipe *api.Recipe) map[string]int {
+	ids := map[string]int{}
+	for i, stage := range recipe.Stages {
+		if _, ok := ids[stage.Id]; stage.Id != "" && !ok {
+			ids[stage.Id] = i
+		}
+	}
+	return ids
+}
+
+// copyFromStage returns the index of the stage the copy.from of the
+// stage at index references, or -1 when it references an image. Unknown
+// stages and the stage itself are rejected
+func copyFromStage(ids map[string]int, index int, from string) (int, error) {
+	dependency, ok := ids[from]
+	switch {
+	case !ok && isImageReference(from):
+		return -1, nil
+	case !ok:
+		return -1, fmt.Errorf("copy.from references unknown stage %s", from)
+	case dependency == index:
+		return -1, fmt.Errorf("copy.from references stage %s itself, a stage cannot copy from its own output", from)
+	}
+	return dependency, nil
+}
+
+// laterStageError is the error of a stage referencing a stage declared
+// after it, which the builders cannot resolve
+func laterStageError(id string) error {
+	return fmt.Errorf("references stage %s, which is declared after it", id)
+}
+
+// BuildStageGraph builds the dependency graph of the stages of the recipe.
+// References to unknown stages, to stages declared later and cycles are
+// reported together
+func BuildStageGraph(recipe *api.Recipe) (*StageGraph, error) {
+	graph := &StageGraph{
+		Dependencies: make([][]int, len(recipe.Stages)),
+		ids:          stageIndexes(recipe),
+	}
+	var errs []error
+	stageError := func(index int, err error) {
+		location, _ := StageLocation(recipe, index)
+		errs = append(errs, locateError(location, err))
+	}
+
+	for i, stage := range recipe.Stages {
+		if stage.Id != "" && graph.ids[stage.Id] != i {
+			stageError(i, fmt.Errorf("id %s is already used by another stage", stage.Id))
+		}
+	}
+
+	for i, stage := range recipe.Stages {
+		dependencies := []int{}
+		if base, ok := graph.ids[stage.Base]; ok && base < i {
+			dependencies = append(dependencies, base)
+		}
+		for _, copy := range stage.Copy {
+			if copy.From == "" {
+				continue
+			}
+			dependency, err := copyFromStage(graph.ids, i, copy.From)
+			if err != nil {
+				stageError(i, err)
+				continue
+			}
+			if dependency >= 0 {
+				dependencies = append(dependencies, dependency)
+			}
+		}
+		for _, dependency := range dependencies {
+			if !containsInt(graph.Dependencies[i], dependency) {
+				graph.Dependencies[i] = append(graph.Dependencies[i], dependency)
+			}
+		}
+	}
+
+	// a reference to a later stage is either part of a cycle, reported
+	// with the stages making it, or a reference the builders reject
+	inCycle := map[int]bool{}
+	for _, cycle := range graph.cycles() {
+		names := []string{}
+		for _, index := range cycle {
+			inCycle[index] = true
+			names = append(names, recipe.Stages[index].Id)
+		}
+		stageError(cycle[0], fmt.Errorf("stages depend on each other: %s", strings.Join(names, " -> ")))
+	}
+	for i, dependencies := range graph.Dependencies {
+		for _, dependency := range dependencies {
+			if dependency > i && !inCycle[i] {
+				stageError(i, laterStageError(recipe.Stages[dependency].Id))
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return graph, nil
+}
+
+// cycles returns each cycle of the graph once, as the path of stages
+// starting and ending with the same stage
+func (g *StageGraph) cycles() [][]int {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(g.Dependencies))
+	path := []int{}
+	cycles := [][]int{}
+
+	var visit func(int)
+	visit = func(index int) {
+		state[index] = visiting
+		path = append(path, index)
+		for _, dependency := range g.Dependencies[index] {
+			switch state[dependency] {
+			case unvisited:
+				visit(dependency)
+			case visiting:
+				start := 0
+				for path[start] != dependency {
+					start++
+				}
+				cycle := append(append([]int{}, path[start:]...), dependency)
+				cycles = append(cycles, cycle)
+			}
+		}
+		path = path[:len(path)-1]
+		state[index] = visited
+	}
+
+	for index := range g.Dependencies {
+		if state[index] == unvisited {
+			visit(index)
+		}
+	}
+	return cycles
+}
+
+// StagesFor returns the indexes of the stages needed to build the target
+// stage, the target included, in the order of recipe.Stages
+func (g *StageGraph) StagesFor(target string) ([]int, error) {
+	index, ok := g.ids[target]
+	if !ok {
+		return nil, fmt.Errorf("unknown target stage %s", target)
+	}
+
+	needed := map[int]bool{}
+	var visit func(int)
+	visit = func(index int) {
+		if needed[index] {
+			return
+		}
+		needed[index] = true
+		for _, dependency := range g.Dependencies[index] {
+			visit(dependency)
+		}
+	}
+	visit(index)
+
+	stages := []int{}
+	for i := range g.Dependencies {
+		if needed[i] {
+			stages = append(stages, i)
+		}
+	}
+	return stages, nil
+}
+
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,129 @@
+package core_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/vanilla-os/vib/core"
+)
+
+// Test that vib test rejects cycles, unknown stages, stages copying from
+// themselves and references to stages declared later
+func TestStageGraphErrors(t *testing.T) {
+	path := writeRecipeFiles(t, map[string]string{
+		"recipe.yml": `name: Test
+id: test
+vibversion: 1.0.0
+stages:
+  - id: first
+    base: debian:sid-slim
+    copy:
+      - from: third
+        srcdst:
+          /out: /out
+  - id: second
+    base: debian:sid-slim
+    copy:
+      - from: fourth
+        srcdst:
+          /out: /out
+      - from: docker.io/library/alpine
+        srcdst:
+          /etc/alpine-release: /etc/alpine-release
+  - id: third
+    base: debian:sid-slim
+    copy:
+      - from: first
+        srcdst:
+          /out: /out
+  - id: fifth
+    base: sixth
+    copy:
+      - from: sixth
+        srcdst:
+          /out: /out
+  - id: sixth
+    base: debian:sid-slim
+  - id: seventh
+    base: debian:sid-slim
+    copy:
+      - from: seventh
+        srcdst:
+          /out: /out
+`,
+	})
+
+	_, err := core.TestRecipe(path, nil)
+	if err == nil {
+		t.Fatal("expected the stage graph to be rejected")
+	}
+	for _, expected := range []string{
+		"recipe.yml:11:5: stage second: copy.from references unknown stage fourth",
+		"recipe.yml:5:5: stage first: stages depend on each other: first -> third -> first",
+		"recipe.yml:26:5: stage fifth: references stage sixth, which is declared after it",
+		"recipe.yml:34:5: stage seventh: copy.from references stage seventh itself, a stage cannot copy from its own output",
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected %q in the error, got:\n%v", expected, err)
+		}
+	}
+	if strings.Contains(err.Error(), "alpine") {
+		t.Errorf("expected images in copy.from to be accepted, got:\n%v", err)
+	}
+}
+
+// Test that a target build only emits the stages the target needs
+func TestBuildTarget(t *testing.T) {
+	path := writeRecipeFiles(t, map[string]string{
+		"recipe.yml": `name: Test
+id: test
+vibversion: 1.0.0
+stages:
+  - id: deps
+    base: debian:sid-slim
+  - id: unrelated
+    base: debian:sid-slim
+  - id: build
+    base: deps
+  - id: assets
+    base: debian:sid-slim
+  - id: app
+    base: debian:sid-slim
+    copy:
+      - from: build
+        srcdst:
+          /out: /app
+      - from: assets
+        srcdst:
+          /assets: /app/assets
+  - id: final
+    base: app
+`,
+	})
+
+	_, err := core.BuildRecipe(path, "amd64", core.BuildOptions{Target: "app"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(filepath.Join(filepath.Dir(path), "Containerfile"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stages := []string{}
+	for _, line := range strings.Split(string(content), "\n") {
+		if strings.HasPrefix(line, "FROM ") {
+			stages = append(stages, line[strings.LastIndex(line, " ")+1:])
+		}
+	}
+	if strings.Join(stages, " ") != "deps build assets app" {
+		t.Errorf("expected the stages deps build assets app, got %v:\n%s", stages, content)
+	}
+
+	_, err = core.BuildRecipe(path, "amd64", core.BuildOptions{Target: "missing"})
+	if err == nil || !strings.Contains(err.Error(), "unknown target stage missing") {
+		t.Errorf("expected an error for the unknown target, got %v", err)
+	}
+}
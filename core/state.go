@@ -0,0 +1,40 @@
+package core
+
+import "github.com/vanilla-os/vib/api"
+
+// What vib tracks about a recipe while loading and building it, kept in
+// recipe.BuildState so it lives and dies with the recipe
+type buildState struct {
+	// module locations are keyed by the address of the module maps,
+	// since the same map is handed from the loader down to BuildModule
+	// and the builders
+	moduleLocations map[uintptr]moduleLocation
+	// stage locations, in the order of recipe.Stages
+	stageLocations []Location
+	// the maps of a stage are decoded into Go maps, which have no
+	// order, so the order their keys are declared in is recorded by
+	// stage index and field: labels, env, args, expose, copy.N.srcdst
+	// and adds.N.srcdst
+	stageKeyOrders []map[string][]string
+	// includes being built, from the outermost to the innermost
+	includeChain []string
+	// includes marked once already built in the current stage
+	stageIncludes map[string]bool
+	// downloaded files of the remote includes, by include
+	remoteIncludes map[string]string
+	// plan recorded by PlanRecipe, nil when building
+	planRecorder *planRecorder
+	// BuildOptions.PrefetchJobs of the build
+	prefetchJobs int
+}
+
+// getBuildState returns the build state of the recipe, creating it on
+// first use
+func getBuildState(recipe *api.Recipe) *buildState {
+	state, ok := recipe.BuildState.(*buildState)
+	if !ok {
+		state = &buildState{moduleLocations: map[uintptr]moduleLocation{}}
+		recipe.BuildState = state
+	}
+	return state
+}
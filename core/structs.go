@@ -9,10 +9,16 @@ type Module struct {
 	Workdir string
 	Type    string `json:"type"`
 	Modules []map[string]interface{}
-	Content []byte // The entire module unparsed as a []byte, used by plugins
-	Cleanup []string `json:"cleanup"`
+	Content []byte                // The entire module unparsed as a []byte, used by plugins
+	Cleanup []string              `json:"cleanup"`
+	Layer   string                `json:"layer"`
+	Cache   []api.Cache           `json:"cache"`
+	Secrets map[string]api.Secret `json:"secrets"`
 }
 
+// Layer name of the modules which always get a layer of their own
+const OwnLayer = "own"
+
 // Configuration for finalization steps
 type Finalize struct {
 	Name    string `json:"name"`
@@ -22,16 +28,18 @@ type Finalize struct {
 
 // Configuration for including other modules or recipes
 type IncludesModule struct {
-	Name     string   `json:"name"`
-	Type     string   `json:"type"`
-	Includes []string `json:"includes"`
+	Name     string        `json:"name"`
+	Type     string        `json:"type"`
+	Includes []interface{} `json:"includes"`
+	Exclude  []string      `json:"exclude"`
+	Once     bool          `json:"once"` // Skip the modules already included in the stage
 }
 
 // Information for building a module
 type ModuleCommand struct {
-	Name    string
-	Command []string
-	Workdir string
+	Name         string
+	Instructions []Instruction
+	Workdir      string
 }
 
 // Configuration for a plugin
@@ -0,0 +1,30 @@
+package core_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Write the given files into a temporary directory and return the path
+// of its recipe.yml
+func writeRecipeFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return filepath.Join(dir, "recipe.yml")
+}
+
+// Report whether the content has the given whole lines, in a row
+func hasLines(content string, lines string) bool {
+	return strings.Contains("\n"+content, "\n"+lines)
+}
@@ -0,0 +1,170 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Prefix of the environment variables overriding recipe variables,
+// VIB_VAR_version=1.2 overrides the version variable
+const VarEnvPrefix = "VIB_VAR_"
+
+// matches ${name} and its escaped form $${name}
+var varPattern = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_.-]*)\}`)
+
+// ResolveVars collects the variables of a recipe from its vars block,
+// then applies the overrides from the environment and the given ones,
+// in this order of precedence. Variables may reference each other
+func ResolveVars(root *yaml.Node, overrides map[string]string) (map[string]string, error) {
+	raw := map[string]string{}
+
+	varsNode := mappingValue(root, "vars", false)
+	if varsNode != nil {
+		if varsNode.Kind != yaml.MappingNode {
+			return nil, fmt.Errorf("line %d: vars must be a map", varsNode.Line)
+		}
+		for i := 0; i+1 < len(varsNode.Content); i += 2 {
+			value := resolveAlias(varsNode.Content[i+1])
+			if value.Kind != yaml.ScalarNode {
+				return nil, fmt.Errorf("line %d: variable %s must be a scalar", value.Line, varsNode.Content[i].Value)
+			}
+			raw[varsNode.Content[i].Value] = value.Value
+		}
+	}
+
+	for _, env := range os.Environ() {
+		if !strings.HasPrefix(env, VarEnvPrefix) {
+			continue
+		}
+		name, value, _ := strings.Cut(strings.TrimPrefix(env, VarEnvPrefix), "=")
+		raw[name] = value
+	}
+
+	for name, value := range overrides {
+		raw[name] = value
+	}
+
+	names := make([]string, 0, len(raw))
+	for name := range raw {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	vars := map[string]string{}
+	for _, name := range names {
+		_, err := resolveVar(name, raw, vars, []string{})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return vars, nil
+}
+
+// resolveVar expands the references of a variable to other variables,
+// failing when the references form a cycle
+func resolveVar(name string, raw map[string]string, resolved map[string]string, chain []string) (string, error) {
+	if value, ok := resolved[name]; ok {
+		return value, nil
+	}
+	for _, visited := range chain {
+		if visited == name {
+			return "", fmt.Errorf("variable %s references itself: %s", name, strings.Join(append(chain, name), " → "))
+		}
+	}
+	chain = append(chain, name)
+
+	var resolveErr error
+	value := varPattern.ReplaceAllStringFunc(raw[name], func(match string) string {
+		if strings.HasPrefix(match, "$$") {
+			return match[1:]
+		}
+		reference := varPattern.FindStringSubmatch(match)[1]
+		if _, ok := raw[reference]; !ok {
+			return match
+		}
+		value, err := resolveVar(reference, raw, resolved, chain)
+		if err != nil && resolveErr == nil {
+			resolveErr = err
+		}
+		return value
+	})
+	if resolveErr != nil {
+		return "", resolveErr
+	}
+
+	resolved[name] = value
+	return value, nil
+}
+
+// Interpolate replaces the ${name} references in s with the value of
+// the matching variable. References to unknown variables are left as
+// they are so shell variables keep working, $${name} produces ${name}
+func Interpolate(s string, vars map[string]string) string {
+	return varPattern.ReplaceAllStringFunc(s, func(match string) string {
+		if strings.HasPrefix(match, "$$") {
+			return match[1:]
+		}
+		value, ok := vars[varPattern.FindStringSubmatch(match)[1]]
+		if !ok {
+			return match
+		}
+		return value
+	})
+}
+
+// interpolateRecipe interpolates every scalar value of a recipe, except
+// for the vars block itself which has already been resolved
+func interpolateRecipe(root *yaml.Node, vars map[string]string) {
+	if root.Kind != yaml.MappingNode {
+		interpolateNode(root, vars)
+		return
+	}
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == "vars" {
+			continue
+		}
+		interpolateNode(root.Content[i+1], vars)
+	}
+}
+
+// interpolateNode interpolates every scalar value of a YAML tree
+func interpolateNode(node *yaml.Node, vars map[string]string) {
+	switch node.Kind {
+	case yaml.DocumentNode, yaml.SequenceNode:
+		for _, child := range node.Content {
+			interpolateNode(child, vars)
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			interpolateNode(node.Content[i+1], vars)
+		}
+	case yaml.ScalarNode:
+		if !strings.Contains(node.Value, "${") {
+			return
+		}
+		node.Value = Interpolate(node.Value, vars)
+		// interpolated values stay strings, so a version like 1.10 is not
+		// decoded as a number, except for the booleans and integers of
+		// plain values, which let e.g. addincludes: ${include} decode as
+		// a boolean and healthcheck.retries: ${retries} as an integer
+		if node.Style != 0 || node.Tag != "!!str" {
+			return
+		}
+		switch {
+		case node.Value == "true" || node.Value == "false":
+			node.Tag = "!!bool"
+		case decimalInteger.MatchString(node.Value):
+			node.Tag = "!!int"
+		}
+	}
+}
+
+// integers written in decimal, without the leading zeros YAML could
+// read as octal
+var decimalInteger = regexp.MustCompile(`^-?(0|[1-9][0-9]*)$`)
@@ -0,0 +1,87 @@
+package core_test
+
+import (
+	"testing"
+
+	"github.com/vanilla-os/vib/core"
+)
+
+// Test the interpolation of variables, unknown and escaped references are left for the shell
+func TestInterpolate(t *testing.T) {
+	vars := map[string]string{"version": "1.2.0", "branch": "main"}
+
+	tests := map[string]string{
+		"v${version}":               "v1.2.0",
+		"${branch}-${version}":      "main-1.2.0",
+		"echo ${HOME}":              "echo ${HOME}",
+		"echo $${version}":          "echo ${version}",
+		"echo $HOME ${version}.tar": "echo $HOME 1.2.0.tar",
+		"no references":             "no references",
+	}
+	for input, expected := range tests {
+		if got := core.Interpolate(input, vars); got != expected {
+			t.Errorf("Interpolate(%q) = %q, expected %q", input, got, expected)
+		}
+	}
+}
+
+// Test that variables are resolved with their overrides before the recipe is decoded
+func TestLoadRecipeVars(t *testing.T) {
+	path := writeRecipeFiles(t, map[string]string{
+		"recipe.yml": `name: Test
+id: test
+vibversion: 1.0.0
+vars:
+  tag: sid
+  base: debian:${tag}-slim
+  include: "false"
+  ver: "1.10"
+  retries: 3
+stages:
+  - id: build
+    base: ${base}
+    addincludes: ${include}
+    healthcheck:
+      test: ["true"]
+      retries: ${retries}
+    modules:
+      - name: hello
+        type: shell
+        sources:
+          - type: file
+            url: ${ver}
+        commands:
+          - echo ${greeting} $${HOME}
+`,
+	})
+
+	t.Setenv(core.VarEnvPrefix+"greeting", "hi")
+	recipe, err := core.LoadRecipe(path, map[string]string{"tag": "trixie", "include": "true"})
+	if err != nil {
+		t.Fatalf("LoadRecipe returned an error: %v", err)
+	}
+
+	stage := recipe.Stages[0]
+	if stage.Base != "debian:trixie-slim" {
+		t.Errorf("expected base debian:trixie-slim, got %s", stage.Base)
+	}
+	if !stage.Addincludes {
+		t.Errorf("expected addincludes to be decoded as true")
+	}
+	if stage.Healthcheck.Retries != 3 {
+		t.Errorf("expected healthcheck retries to be decoded as 3, got %+v", stage.Healthcheck)
+	}
+
+	module := stage.Modules[0].(map[string]interface{})
+	command := module["commands"].([]interface{})[0]
+	if command != "echo hi ${HOME}" {
+		t.Errorf("expected interpolated command, got %s", command)
+	}
+	url := module["sources"].([]interface{})[0].(map[string]interface{})["url"]
+	if url != "1.10" {
+		t.Errorf("expected the interpolated url to stay the string 1.10, got %#v", url)
+	}
+	if recipe.Vars["base"] != "debian:trixie-slim" {
+		t.Errorf("expected resolved vars in the recipe, got %v", recipe.Vars)
+	}
+}
@@ -14,6 +14,12 @@ import (
 	"strings"
 )
 
+// Directory of the /var/cache/apt cache mount the packages are downloaded
+// to. Debian and Ubuntu images ship /etc/apt/apt.conf.d/docker-clean,
+// which deletes /var/cache/apt/archives/*.deb after each install and
+// would empty the cache, so the packages are kept aside from it
+const aptArchives = "/var/cache/apt/vib-archives/"
+
 // Configuration for an APT module
 type AptModule struct {
 	Name    string       `json:"name"`
@@ -34,7 +40,13 @@ type AptOptions struct {
 //
 //export PlugInfo
 func PlugInfo() *C.char {
-	plugininfo := &api.PluginInfo{Name: "apt", Type: api.BuildPlugin, UseContainerCmds: false}
+	plugininfo := &api.PluginInfo{
+		Name:             "apt",
+		Type:             api.BuildPlugin,
+		UseContainerCmds: false,
+		// apt locks its cache, so concurrent builds wait for each other
+		Cache: []api.Cache{{Target: "/var/cache/apt", Sharing: "locked"}},
+	}
 	pluginjson, err := json.Marshal(plugininfo)
 	if err != nil {
 		return C.CString(fmt.Sprintf("ERROR: %s", err.Error()))
@@ -109,9 +121,14 @@ func BuildModule(moduleInterface *C.char, recipeInterface *C.char, arch *C.char)
 		}
 	}
 
-	cmd := fmt.Sprintf("apt-get install -y %s %s && apt-get clean", args, packages)
+	return C.CString(aptInstallCommand(args, packages))
+}
 
-	return C.CString(cmd)
+// Generate the apt-get command installing the packages. The downloaded
+// packages are kept in the /var/cache/apt cache mount, which is not part
+// of the image, so there is no need to clean them
+func aptInstallCommand(args string, packages string) string {
+	return fmt.Sprintf("apt-get -o Dir::Cache::Archives=%s install -y %s %s", aptArchives, args, packages)
 }
 
 func main() {}
@@ -0,0 +1,21 @@
+package main
+
+// Run with: go test apt.go apt_test.go
+
+import (
+	"strings"
+	"testing"
+)
+
+// Test that the install command keeps the docker-clean configuration of
+// the image and downloads the packages out of its reach
+func TestAptInstallCommand(t *testing.T) {
+	cmd := aptInstallCommand("--no-install-recommends ", "curl git ")
+	expected := "apt-get -o Dir::Cache::Archives=/var/cache/apt/vib-archives/ install -y --no-install-recommends  curl git "
+	if cmd != expected {
+		t.Errorf("expected %q, got %q", expected, cmd)
+	}
+	if strings.Contains(cmd, "docker-clean") || strings.Contains(cmd, "rm ") {
+		t.Errorf("expected the command not to remove docker-clean, got %q", cmd)
+	}
+}
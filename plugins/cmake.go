@@ -52,11 +52,7 @@ func BuildModule(moduleInterface *C.char, recipeInterface *C.char, arch *C.char)
 		return C.CString("")
 	}
 
-	err = api.DownloadSource(recipe, module.Source, module.Name)
-	if err != nil {
-		return C.CString(fmt.Sprintf("ERROR: %s", err.Error()))
-	}
-	err = api.MoveSource(recipe.DownloadsPath, recipe.SourcesPath, module.Source, module.Name)
+	err = api.CheckSourceFetched(recipe, module.Source, module.Name)
 	if err != nil {
 		return C.CString(fmt.Sprintf("ERROR: %s", err.Error()))
 	}
@@ -17,11 +17,25 @@ type GoModule struct {
 	BuildFlags string
 }
 
+// Locations of the module and build caches, mounted as caches by vib
+const (
+	goModCache   = "/root/go/pkg/mod"
+	goBuildCache = "/root/.cache/go-build"
+)
+
 // Provide plugin information as a JSON string
 //
 //export PlugInfo
 func PlugInfo() *C.char {
-	plugininfo := &api.PluginInfo{Name: "go", Type: api.BuildPlugin, UseContainerCmds: false}
+	plugininfo := &api.PluginInfo{
+		Name:             "go",
+		Type:             api.BuildPlugin,
+		UseContainerCmds: false,
+		Cache: []api.Cache{
+			{Target: goModCache},
+			{Target: goBuildCache},
+		},
+	}
 	pluginjson, err := json.Marshal(plugininfo)
 	if err != nil {
 		return C.CString(fmt.Sprintf("ERROR: %s", err.Error()))
@@ -52,11 +66,7 @@ func BuildModule(moduleInterface *C.char, recipeInterface *C.char, arch *C.char)
 		return C.CString("")
 	}
 
-	err = api.DownloadSource(recipe, module.Source, module.Name)
-	if err != nil {
-		return C.CString(fmt.Sprintf("ERROR: %s", err.Error()))
-	}
-	err = api.MoveSource(recipe.DownloadsPath, recipe.SourcesPath, module.Source, module.Name)
+	err = api.CheckSourceFetched(recipe, module.Source, module.Name)
 	if err != nil {
 		return C.CString(fmt.Sprintf("ERROR: %s", err.Error()))
 	}
@@ -77,8 +87,10 @@ func BuildModule(moduleInterface *C.char, recipeInterface *C.char, arch *C.char)
 	}
 
 	cmd := fmt.Sprintf(
-		"cd /sources/%s && go build%s -o %s",
+		"cd /sources/%s && GOMODCACHE=%s GOCACHE=%s go build%s -o %s",
 		api.GetSourcePath(module.Source, module.Name),
+		goModCache,
+		goBuildCache,
 		buildFlags,
 		buildVars["GO_OUTPUT_BIN"],
 	)
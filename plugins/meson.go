@@ -50,11 +50,7 @@ func BuildModule(moduleInterface *C.char, recipeInterface *C.char, arch *C.char)
 
 	for _, source := range module.Sources {
 		if api.TestArch(source.OnlyArches, C.GoString(arch)) {
-			err = api.DownloadSource(recipe, source, module.Name)
-			if err != nil {
-				return C.CString(fmt.Sprintf("ERROR: %s", err.Error()))
-			}
-			err = api.MoveSource(recipe.DownloadsPath, recipe.SourcesPath, source, module.Name)
+			err = api.CheckSourceFetched(recipe, source, module.Name)
 			if err != nil {
 				return C.CString(fmt.Sprintf("ERROR: %s", err.Error()))
 			}